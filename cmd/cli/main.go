@@ -1,40 +1,176 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"image"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/aeperfilev/instafix/config"
 	"github.com/aeperfilev/instafix/pkg/instafix"
-
-	"github.com/disintegration/imaging"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "grid" {
+		runGrid(os.Args[2:])
+		return
+	}
+
 	var (
 		configPath  string
 		profileName string
 		watermark   string
 		outputPath  string
+		page        int
+		format      string
+		focus       string
+		split       string
+		palette     bool
+		vars        = keyValues{}
+		layers      = keyValues{}
 	)
 
 	flag.StringVar(&configPath, "config", "", "Path to profiles.toml (optional)")
 	flag.StringVar(&profileName, "profile", "default", "Profile name to apply")
 	flag.StringVar(&watermark, "watermark", "", "Watermark text (optional)")
+	flag.Var(vars, "var", "Watermark template variable key=value, repeatable (optional)")
+	flag.Var(layers, "watermark-layer", "Text of a watermark layer name=text, repeatable (optional)")
 	flag.StringVar(&outputPath, "out", "", "Output image path (optional)")
+	flag.IntVar(&page, "page", 0, "Page of a multi-page TIFF input (0 is the first page)")
+	flag.StringVar(&format, "format", "", "Output format: jpeg, jpeg_progressive, png or webp (defaults to the profile's)")
+	flag.StringVar(&focus, "focus", "", "Focal point x,y in 0..1 for the cover and smart fit modes (optional)")
+	flag.StringVar(&split, "split", "", "Split a panorama into carousel slides of this fixed format, e.g. portrait (optional)")
+	flag.BoolVar(&palette, "palette", false, "Print the palette of the input image")
 	flag.Parse()
 
 	if flag.NArg() < 1 {
 		exitWithError("input image path is required")
 	}
 	inputPath := flag.Arg(0)
-	if outputPath == "" {
-		outputPath = defaultOutputPath(inputPath)
+	focalPoint, err := instafix.ParseFocalPoint(focus)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	processor, decoded := openInput(configPath, profileName, inputPath, page)
+
+	if palette {
+		colors, err := processor.Palette(decoded.Image, profileName)
+		if err != nil {
+			exitWithError(err.Error())
+		}
+		for _, c := range colors {
+			fmt.Printf("palette: %s %.0f%%\n", c.Hex(), c.Share*100)
+		}
+	}
+
+	processOpts := instafix.ProcessOptions{
+		WatermarkText: watermark,
+		Focus:         focalPoint,
+		Exif:          decoded.Exif,
+		Watermarks:    layers,
+		Vars:          vars,
+		Filename:      inputPath,
+	}
+	if split != "" {
+		slides, _, err := processor.ProcessCarousel(decoded.Image, profileName, split, processOpts)
+		if err != nil {
+			exitWithError(err.Error())
+		}
+		for i, slide := range slides {
+			writeOutput(processor, profileName, slide, decoded.Metadata, format, func(outFormat string) string {
+				path := outputPath
+				if path == "" {
+					path = defaultOutputPath(inputPath, outFormat)
+				}
+				return slidePath(path, i+1)
+			})
+		}
+		return
+	}
+
+	result, _, err := processor.ProcessWithOptions(decoded.Image, profileName, processOpts)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	writeOutput(processor, profileName, result, decoded.Metadata, format, func(outFormat string) string {
+		if outputPath == "" {
+			return defaultOutputPath(inputPath, outFormat)
+		}
+		return outputPath
+	})
+}
+
+// runGrid implements "instafix grid": it cuts the input into profile grid
+// tiles and writes them numbered in posting order.
+func runGrid(args []string) {
+	var (
+		configPath  string
+		profileName string
+		watermark   string
+		outputPath  string
+		page        int
+		format      string
+		focus       string
+		tile        string
+		grid        instafix.GridOptions
+		vars        = keyValues{}
+		layers      = keyValues{}
+	)
+
+	fs := flag.NewFlagSet("grid", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "", "Path to profiles.toml (optional)")
+	fs.StringVar(&profileName, "profile", "default", "Profile name to apply")
+	fs.StringVar(&watermark, "watermark", "", "Watermark text (optional)")
+	fs.Var(vars, "var", "Watermark template variable key=value, repeatable (optional)")
+	fs.Var(layers, "watermark-layer", "Text of a watermark layer name=text, repeatable (optional)")
+	fs.StringVar(&outputPath, "out", "", "Output image path; tiles are numbered _1, _2, ... in posting order (optional)")
+	fs.IntVar(&page, "page", 0, "Page of a multi-page TIFF input (0 is the first page)")
+	fs.StringVar(&format, "format", "", "Output format: jpeg, jpeg_progressive, png or webp (defaults to the profile's)")
+	fs.StringVar(&focus, "focus", "", "Focal point x,y in 0..1 for the cover and smart fit modes (optional)")
+	fs.StringVar(&tile, "tile", "", "Fixed tile format, e.g. square or portrait (defaults to the profile's)")
+	fs.IntVar(&grid.Rows, "rows", 0, "Number of tile rows (0 picks it from the image ratio)")
+	fs.Float64Var(&grid.Gap, "gap", 0, "Gap between grid cells as a share of the cell width (0 uses the default, -1 disables)")
+	fs.BoolVar(&grid.FullTiles, "full-tiles", false, "Lay out whole tiles instead of the 3:4 grid preview crop")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		exitWithError("input image path is required")
+	}
+	inputPath := fs.Arg(0)
+	focalPoint, err := instafix.ParseFocalPoint(focus)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	processor, decoded := openInput(configPath, profileName, inputPath, page)
+	tiles, _, err := processor.ProcessGrid(decoded.Image, profileName, tile, grid, instafix.ProcessOptions{
+		WatermarkText: watermark,
+		Focus:         focalPoint,
+		Exif:          decoded.Exif,
+		Watermarks:    layers,
+		Vars:          vars,
+		Filename:      inputPath,
+	})
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	for i, img := range tiles {
+		writeOutput(processor, profileName, img, decoded.Metadata, format, func(outFormat string) string {
+			path := outputPath
+			if path == "" {
+				path = defaultOutputPath(inputPath, outFormat)
+			}
+			return slidePath(path, i+1)
+		})
 	}
+}
 
+// openInput loads the config and decodes the input with the profile's decode options.
+func openInput(configPath, profileName, inputPath string, page int) (*instafix.Processor, *instafix.Decoded) {
 	cfg, err := loadConfig(configPath)
 	if err != nil {
 		exitWithError(err.Error())
@@ -51,27 +187,41 @@ func main() {
 	}
 	defer srcFile.Close()
 
-	srcImg, err := instafix.DecodeImage(srcFile, inputPath)
+	opts, err := processor.DecodeOptions(profileName, instafix.DecodeOptions{Page: page})
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	decoded, err := instafix.DecodeImageWithOptions(srcFile, inputPath, opts)
 	if err != nil {
 		exitWithError(fmt.Sprintf("decode input image: %v", err))
 	}
+	return processor, decoded
+}
 
-	result, quality, err := processor.Process(srcImg, profileName, watermark)
+// writeOutput encodes img and writes it to the path returned for the final format.
+func writeOutput(processor *instafix.Processor, profileName string, img image.Image, sourceMeta instafix.Metadata, format string, pathFor func(format string) string) {
+	meta, err := processor.OutputMetadata(profileName, sourceMeta, img.Bounds().Dx(), img.Bounds().Dy())
 	if err != nil {
 		exitWithError(err.Error())
 	}
 
+	var out bytes.Buffer
+	encoded, err := processor.Encode(&out, profileName, img, meta, format)
+	if err != nil {
+		exitWithError(fmt.Sprintf("encode output: %v", err))
+	}
+
+	outputPath := pathFor(encoded.Format)
 	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
 		exitWithError(fmt.Sprintf("create output dir: %v", err))
 	}
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		exitWithError(fmt.Sprintf("create output: %v", err))
+	if err := os.WriteFile(outputPath, out.Bytes(), 0o644); err != nil {
+		exitWithError(fmt.Sprintf("write output: %v", err))
 	}
-	defer outFile.Close()
-
-	if err := imaging.Encode(outFile, result, imaging.JPEG, imaging.JPEGQuality(quality)); err != nil {
-		exitWithError(fmt.Sprintf("encode output: %v", err))
+	if encoded.Quality > 0 {
+		fmt.Printf("%s: %d bytes, %s quality %d\n", outputPath, encoded.Size, encoded.Format, encoded.Quality)
+	} else {
+		fmt.Printf("%s: %d bytes, %s\n", outputPath, encoded.Size, encoded.Format)
 	}
 }
 
@@ -83,10 +233,39 @@ func loadConfig(path string) (config.Config, error) {
 	return config.Load(path)
 }
 
-func defaultOutputPath(inputPath string) string {
+func defaultOutputPath(inputPath, format string) string {
 	base := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
 	dir := filepath.Dir(inputPath)
-	return filepath.Join(dir, base+"_instafix.jpg")
+	ext := ".jpg"
+	switch format {
+	case config.OutputFormatPNG:
+		ext = ".png"
+	case config.OutputFormatWebP:
+		ext = ".webp"
+	}
+	return filepath.Join(dir, base+"_instafix"+ext)
+}
+
+// slidePath numbers an output path: out.jpg becomes out_1.jpg.
+func slidePath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// keyValues collects repeated key=value flags such as --var.
+type keyValues map[string]string
+
+func (v keyValues) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v keyValues) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("want key=value, got %q", s)
+	}
+	v[strings.TrimSpace(key)] = value
+	return nil
 }
 
 func exitWithError(msg string) {
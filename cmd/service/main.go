@@ -1,18 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
-	"image"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/aeperfilev/instafix/config"
 	"github.com/aeperfilev/instafix/pkg/instafix"
 
-	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 )
 
@@ -20,9 +20,12 @@ func main() {
 	var (
 		configPath string
 		addr       string
+		limits     instafix.DecodeOptions
 	)
 	flag.StringVar(&configPath, "config", "", "Path to profiles.toml (optional)")
 	flag.StringVar(&addr, "addr", "", "Listen address (defaults to :8080 or :$PORT)")
+	flag.Int64Var(&limits.MaxBytes, "max-bytes", 0, "Max upload size in bytes (0 uses the default, -1 disables)")
+	flag.Int64Var(&limits.MaxPixels, "max-pixels", 0, "Max decoded image pixels (0 uses the default, -1 disables)")
 	flag.Parse()
 
 	if strings.TrimSpace(addr) == "" {
@@ -49,7 +52,7 @@ func main() {
 	router := gin.Default()
 	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
 	router.POST("/fix", authMiddleware(), func(c *gin.Context) {
-		handleFix(c, processor)
+		handleFix(c, processor, limits)
 	})
 
 	if err := router.Run(addr); err != nil {
@@ -57,50 +60,178 @@ func main() {
 	}
 }
 
-func handleFix(c *gin.Context, processor *instafix.Processor) {
+func handleFix(c *gin.Context, processor *instafix.Processor, limits instafix.DecodeOptions) {
 	profileName := strings.TrimSpace(c.DefaultQuery("profile", "default"))
 	watermark := c.Query("watermark")
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+		return
+	}
+	withPalette, err := strconv.ParseBool(c.DefaultQuery("palette", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid palette"})
+		return
+	}
+	focus, err := instafix.ParseFocalPoint(c.Query("focus"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts := limits
+	opts.Page = page
+	opts, err = processor.DecodeOptions(profileName, opts)
+	if err != nil {
+		respondProcessError(c, err)
+		return
+	}
 
-	var srcImg image.Image
-	var err error
+	if maxBody := requestBodyLimit(limits.MaxBytes); maxBody > 0 && c.Request.Body != nil {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBody)
+	}
 
-	if fileHeader, errMultipart := c.FormFile("image"); errMultipart == nil {
+	var decoded *instafix.Decoded
+	var filename string
+
+	fileHeader, errMultipart := c.FormFile("image")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(errMultipart, &maxBytesErr) {
+		logRequestError(c, errMultipart)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errMultipart.Error()})
+		return
+	}
+	if errMultipart == nil {
 		file, errOpen := fileHeader.Open()
 		if errOpen != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to read image file"})
 			return
 		}
 		defer file.Close()
-		srcImg, err = instafix.DecodeImage(file, fileHeader.Filename)
+		filename = fileHeader.Filename
+		decoded, err = instafix.DecodeImageWithOptions(file, filename, opts)
 	} else {
 		if c.Request.Body == nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "empty request body"})
 			return
 		}
 		defer c.Request.Body.Close()
-		srcImg, err = instafix.DecodeImage(c.Request.Body, "")
+		decoded, err = instafix.DecodeImageWithOptions(c.Request.Body, "", opts)
 	}
 	if err != nil {
 		logRequestError(c, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid image format or decode failed: " + err.Error()})
+		switch {
+		case errors.Is(err, instafix.ErrInputTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, instafix.ErrImageTooLarge):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case errors.Is(err, instafix.ErrUnsupportedCodec):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid image format or decode failed: " + err.Error()})
+		}
 		return
 	}
 
-	result, quality, err := processor.Process(srcImg, profileName, watermark)
+	result, _, err := processor.ProcessWithOptions(decoded.Image, profileName, instafix.ProcessOptions{
+		WatermarkText: watermark,
+		Watermarks:    watermarkLayers(c),
+		Focus:         focus,
+		Exif:          decoded.Exif,
+		Vars:          c.QueryMap("var"),
+		Filename:      filename,
+	})
 	if err != nil {
-		status := http.StatusBadRequest
-		if !isUserError(err) {
-			status = http.StatusInternalServerError
+		respondProcessError(c, err)
+		return
+	}
+	// The palette is a k-means pass over the photo, so it is only computed
+	// when the client asks for it.
+	var palette []instafix.PaletteColor
+	if withPalette {
+		palette, err = processor.Palette(decoded.Image, profileName)
+		if err != nil {
+			respondProcessError(c, err)
+			return
 		}
-		logRequestError(c, err)
-		c.JSON(status, gin.H{"error": err.Error()})
+	}
+	meta, err := processor.OutputMetadata(profileName, decoded.Metadata, result.Bounds().Dx(), result.Bounds().Dy())
+	if err != nil {
+		respondProcessError(c, err)
 		return
 	}
 
-	c.Header("Content-Type", "image/jpeg")
-	if err := imaging.Encode(c.Writer, result, imaging.JPEG, imaging.JPEGQuality(quality)); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "encode failed"})
+	format := c.Query("format")
+	if format == "" {
+		format, err = processor.NegotiateFormat(profileName, c.GetHeader("Accept"))
+		if err != nil {
+			respondProcessError(c, err)
+			return
+		}
+	}
+
+	var out bytes.Buffer
+	encoded, err := processor.Encode(&out, profileName, result, meta, format)
+	if err != nil {
+		if errors.Is(err, instafix.ErrOutputTooLarge) {
+			logRequestError(c, err)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		respondProcessError(c, err)
+		return
+	}
+
+	c.Header("Vary", "Accept")
+	if encoded.Quality > 0 {
+		c.Header("X-Output-Quality", strconv.Itoa(encoded.Quality))
+	}
+	c.Header("X-Output-Size", strconv.FormatInt(encoded.Size, 10))
+	if withPalette {
+		c.Header("X-Palette", paletteHeader(palette))
+	}
+	c.Data(http.StatusOK, encoded.ContentType, out.Bytes())
+}
+
+// paletteHeader formats a palette as "#rrggbb;share=0.42, ...".
+func paletteHeader(palette []instafix.PaletteColor) string {
+	parts := make([]string, len(palette))
+	for i, c := range palette {
+		parts[i] = fmt.Sprintf("%s;share=%.2f", c.Hex(), c.Share)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// watermarkLayers collects the text of watermark layers from
+// watermark.<layer>=text query parameters.
+func watermarkLayers(c *gin.Context) map[string]string {
+	layers := make(map[string]string)
+	for key, values := range c.Request.URL.Query() {
+		if name, ok := strings.CutPrefix(key, "watermark."); ok && name != "" && len(values) > 0 {
+			layers[name] = values[0]
+		}
+	}
+	return layers
+}
+
+func respondProcessError(c *gin.Context, err error) {
+	status := http.StatusBadRequest
+	if !isUserError(err) {
+		status = http.StatusInternalServerError
+	}
+	logRequestError(c, err)
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// requestBodyLimit allows some room above the image limit for multipart framing.
+func requestBodyLimit(maxBytes int64) int64 {
+	const multipartOverhead = 1 << 20
+	if maxBytes < 0 {
+		return 0
+	}
+	if maxBytes == 0 {
+		maxBytes = instafix.DefaultMaxBytes
 	}
+	return maxBytes + multipartOverhead
 }
 
 func loadConfig(path string) (config.Config, error) {
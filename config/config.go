@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -13,13 +14,148 @@ import (
 const (
 	FormatTypeFixed = "fixed"
 	FormatTypeAuto  = "auto"
+	FormatTypeRange = "range"
+)
+
+// Fit modes: how the photo is placed into the padded area of the canvas.
+const (
+	FitContain = "contain"
+	FitCover   = "cover"
+	FitSmart   = "smart"
+)
+
+// Gradient background shapes and color sources.
+const (
+	GradientLinear      = "linear"
+	GradientRadial      = "radial"
+	ColorSourceEdges    = "edges"
+	ColorSourceDominant = "dominant"
+)
+
+// Palette background strategies: which palette color fills the background.
+const (
+	PaletteDominant  = "dominant"
+	PaletteSaturated = "saturated"
+	PaletteDarkest   = "darkest"
+	PaletteLightest  = "lightest"
+)
+
+// Image background modes: how the texture covers the canvas.
+const (
+	ImageModeTile    = "tile"
+	ImageModeCover   = "cover"
+	ImageModeStretch = "stretch"
+)
+
+// Background layer types that only make sense on top of other layers.
+const (
+	LayerNoise    = "noise"
+	LayerVignette = "vignette"
+	LayerTint     = "tint"
+)
+
+// Blend modes of background layers.
+const (
+	BlendNormal   = "normal"
+	BlendMultiply = "multiply"
+	BlendScreen   = "screen"
+	BlendOverlay  = "overlay"
+)
+
+// Watermark kinds: text drawn with a font, or an image such as a logo.
+const (
+	WatermarkKindText  = "text"
+	WatermarkKindImage = "image"
+)
+
+// Watermark modes: one placed watermark, or a rotated pattern repeated over
+// the whole anchor area.
+const (
+	WatermarkModeSingle = "single"
+	WatermarkModeTile   = "tile"
+)
+
+// Watermark anchor areas.
+const (
+	AnchorCanvas  = "canvas"
+	AnchorPhoto   = "photo"
+	AnchorPadding = "padding"
+)
+
+// WatermarkColorAuto picks the light or dark watermark color, whichever
+// contrasts more with the pixels under the text.
+const WatermarkColorAuto = "auto"
+
+// Default light and dark colors of color = "auto" watermarks.
+const (
+	DefaultWatermarkLightColor = "#ffffff"
+	DefaultWatermarkDarkColor  = "#000000"
+)
+
+// MinWatermarkContrast is the contrast ratio under which auto_outline adds an
+// outline to a watermark.
+const MinWatermarkContrast = 3.0
+
+// DefaultVignetteRadius is where a vignette starts, as a fraction of the
+// distance from the center to the corners.
+const DefaultVignetteRadius = 0.5
+
+// DefaultTintOpacity is used when a tint color is set without tint_opacity.
+const DefaultTintOpacity = 0.3
+
+// DefaultShadowOpacity is used when a shadow is set without opacity.
+const DefaultShadowOpacity = 0.35
+
+// MaxShadowBlur caps shadow.blur in pixels. The shadow is rendered on a layer
+// grown by three times the blur on each side, so the cost grows quickly.
+const MaxShadowBlur = 100.0
+
+// OpticalCenterShift moves the photo up by this share of the canvas height
+// left around it, so the bottom margin is a little heavier than the top one.
+const OpticalCenterShift = 0.05
+
+// Caption strip defaults.
+const (
+	DefaultCaptionHeightPercent = 10.0
+	DefaultCaptionBackground    = "#ffffff"
+	DefaultCaptionColor         = "#1a1a1a"
+	DefaultCaptionMutedColor    = "#8a8a8a"
+)
+
+// DefaultPaletteSize is the number of palette colors extracted by default.
+const DefaultPaletteSize = 5
+
+// Output formats.
+const (
+	OutputFormatJPEG            = "jpeg"
+	OutputFormatJPEGProgressive = "jpeg_progressive"
+	OutputFormatPNG             = "png"
+	OutputFormatWebP            = "webp"
+)
+
+// Chroma subsampling modes for JPEG output.
+const (
+	ChromaSubsampling420 = "4:2:0"
+	ChromaSubsampling444 = "4:4:4"
+)
+
+// DefaultMinJpegQuality is the lowest JPEG quality tried to fit max_bytes.
+const DefaultMinJpegQuality = 50
+
+// Metadata policies for EXIF/XMP/IPTC carried into the output image.
+const (
+	MetadataKeepAll   = "keep_all"
+	MetadataStripAll  = "strip_all"
+	MetadataStripGPS  = "strip_gps"
+	MetadataAllowlist = "allowlist"
 )
 
 var (
-	ErrProfileNotFound    = errors.New("profile not found")
-	ErrFormatNotFound     = errors.New("format not found")
-	ErrBackgroundNotFound = errors.New("background not found")
-	ErrWatermarkNotFound  = errors.New("watermark not found")
+	ErrProfileNotFound     = errors.New("profile not found")
+	ErrFormatNotFound      = errors.New("format not found")
+	ErrBackgroundNotFound  = errors.New("background not found")
+	ErrWatermarkNotFound   = errors.New("watermark not found")
+	ErrUnknownOutputFormat = errors.New("unknown output format")
 )
 
 type Config struct {
@@ -31,19 +167,163 @@ type Config struct {
 }
 
 type Settings struct {
-	JpegQuality int    `toml:"jpeg_quality"`
-	AssetsPath  string `toml:"assets_path"`
+	JpegQuality    int    `toml:"jpeg_quality"`
+	AssetsPath     string `toml:"assets_path"`
+	MetadataPolicy string `toml:"metadata_policy"`
 }
 
 type Profile struct {
-	BackgroundRef  string   `toml:"background_ref"`
-	WatermarkRef   string   `toml:"watermark_ref"`
-	FormatRef      string   `toml:"format_ref"`
-	PaddingPercent *float64 `toml:"padding_percent"`
-	BorderWidth    int      `toml:"border_width"`
-	BorderColor    string   `toml:"border_color"`
-	NoUpscale      bool     `toml:"no_upscale"`
-	JpegQuality    int      `toml:"jpeg_quality"`
+	BackgroundRef     string   `toml:"background_ref"`
+	WatermarkRef      string   `toml:"watermark_ref"`
+	FormatRef         string   `toml:"format_ref"`
+	PaddingPercent    *float64 `toml:"padding_percent"`
+	BorderWidth       int      `toml:"border_width"`
+	BorderColor       string   `toml:"border_color"`
+	NoUpscale         bool     `toml:"no_upscale"`
+	FitMode           string   `toml:"fit_mode"`
+	JpegQuality       int      `toml:"jpeg_quality"`
+	MetadataPolicy    string   `toml:"metadata_policy"`
+	MetadataTags      []string `toml:"metadata_tags"`
+	KeepColorProfile  bool     `toml:"keep_color_profile"`
+	MaxBytes          int64    `toml:"max_bytes"`
+	MinJpegQuality    int      `toml:"min_jpeg_quality"`
+	OutputFormat      string   `toml:"output_format"`
+	ChromaSubsampling string   `toml:"chroma_subsampling"`
+	// Shadow is a soft drop shadow behind the photo and its border;
+	// CornerRadius rounds them both.
+	Shadow       *Shadow `toml:"shadow"`
+	CornerRadius Length  `toml:"corner_radius"`
+	// Padding sets each side separately and replaces padding_percent;
+	// OpticalCenter moves the photo slightly above the center.
+	Padding       *Padding `toml:"padding"`
+	OpticalCenter bool     `toml:"optical_center"`
+	// Caption reserves a strip at the bottom of the canvas for the camera,
+	// lens and exposure settings read from EXIF.
+	Caption *Caption `toml:"caption"`
+	// Watermarks are drawn in order and replace watermark_ref.
+	Watermarks []WatermarkLayer `toml:"watermarks"`
+}
+
+// WatermarkLayer places a watermark style on a profile. Name keys the runtime
+// text of the layer and defaults to the style name.
+type WatermarkLayer struct {
+	Name         string `toml:"name"`
+	WatermarkRef string `toml:"watermark_ref"`
+}
+
+// Layers returns the watermark layers of the profile: Watermarks, or a single
+// layer for watermark_ref.
+func (p Profile) Layers() []WatermarkLayer {
+	if p.WatermarkRef != "" {
+		return []WatermarkLayer{{Name: p.WatermarkRef, WatermarkRef: p.WatermarkRef}}
+	}
+	layers := make([]WatermarkLayer, len(p.Watermarks))
+	for i, layer := range p.Watermarks {
+		if strings.TrimSpace(layer.Name) == "" {
+			layer.Name = layer.WatermarkRef
+		}
+		layers[i] = layer
+	}
+	return layers
+}
+
+// Caption is an EXIF caption strip. Camera and lens are drawn on the left,
+// the exposure settings on the right, aligned with the photo edges, and the
+// optional logo in the middle.
+type Caption struct {
+	// Height is px or a percentage of the canvas height (default 10%).
+	Height     Length `toml:"height"`
+	Background string `toml:"background"`
+	// Font is used for the camera and settings, MutedFont (default Font) for
+	// the lens; both are files in assets_path.
+	Font      string `toml:"font"`
+	MutedFont string `toml:"muted_font"`
+	// Size is the font size in px, 22% of the strip height by default.
+	Size       float64 `toml:"size"`
+	Color      string  `toml:"color"`
+	MutedColor string  `toml:"muted_color"`
+	// Logo is an image in assets_path scaled to 45% of the strip height.
+	Logo string `toml:"logo"`
+}
+
+// Padding is the space around the photo on each side. Percentages are of the
+// canvas width for left and right and of its height for top and bottom; sides
+// left out are 0.
+type Padding struct {
+	Top    Length `toml:"top"`
+	Right  Length `toml:"right"`
+	Bottom Length `toml:"bottom"`
+	Left   Length `toml:"left"`
+}
+
+// Shadow is a drop shadow offset and blurred by pixel amounts.
+type Shadow struct {
+	OffsetX float64 `toml:"offset_x"`
+	OffsetY float64 `toml:"offset_y"`
+	Blur    float64 `toml:"blur"`
+	Color   string  `toml:"color"`
+	Opacity float64 `toml:"opacity"`
+}
+
+// Length is a size in pixels or, written as "5%" in TOML, in percent of a
+// reference size that depends on the setting.
+type Length struct {
+	Value   float64
+	Percent bool
+}
+
+// UnmarshalTOML accepts a number of pixels or a string such as "12", "12px"
+// or "5%".
+func (l *Length) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case int64:
+		*l = Length{Value: float64(v)}
+	case float64:
+		*l = Length{Value: v}
+	case string:
+		parsed, err := ParseLength(v)
+		if err != nil {
+			return err
+		}
+		*l = parsed
+	default:
+		return fmt.Errorf("invalid length: %v", v)
+	}
+	return nil
+}
+
+// ParseLength parses "12", "12px" or "5%".
+func ParseLength(s string) (Length, error) {
+	s = strings.TrimSpace(s)
+	var l Length
+	switch {
+	case strings.HasSuffix(s, "%"):
+		l.Percent = true
+		s = strings.TrimSuffix(s, "%")
+	case strings.HasSuffix(s, "px"):
+		s = strings.TrimSuffix(s, "px")
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return Length{}, fmt.Errorf("invalid length: %q", s)
+	}
+	l.Value = v
+	return l, nil
+}
+
+// Pixels resolves the length against the reference size of percentages.
+func (l Length) Pixels(reference float64) float64 {
+	if l.Percent {
+		return l.Value / 100 * reference
+	}
+	return l.Value
+}
+
+func (l Length) String() string {
+	if l.Percent {
+		return strconv.FormatFloat(l.Value, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(l.Value, 'f', -1, 64) + "px"
 }
 
 type Format struct {
@@ -51,6 +331,8 @@ type Format struct {
 	Width          int      `toml:"width"`
 	Height         int      `toml:"height"`
 	FromList       []string `toml:"from_list"`
+	MinRatio       float64  `toml:"min_ratio"`
+	MaxRatio       float64  `toml:"max_ratio"`
 	PaddingPercent float64  `toml:"padding_percent"`
 }
 
@@ -59,33 +341,124 @@ type Background struct {
 	Color      string  `toml:"color"`
 	BlurRadius float64 `toml:"blur_radius"`
 	Darken     float64 `toml:"darken"`
+	// Gradient is linear (default) or radial; Angle is the direction of a
+	// linear gradient in degrees, 0 running left to right and 90 top to bottom.
+	Gradient string  `toml:"gradient"`
+	Angle    float64 `toml:"angle"`
+	// Colors are evenly spaced gradient stops. ColorSource samples them from
+	// the photo instead: its edges or its dominant colors.
+	Colors      []string `toml:"colors"`
+	ColorSource string   `toml:"color_source"`
+	// Strategy picks the palette color of a palette background from
+	// PaletteSize clusters; Saturation and Lightness shift it in HSL (-1..1).
+	Strategy    string  `toml:"strategy"`
+	PaletteSize int     `toml:"palette_size"`
+	Saturation  float64 `toml:"saturation"`
+	Lightness   float64 `toml:"lightness"`
+	// Image is a texture file in assets_path for image backgrounds, laid out
+	// by Mode (cover by default) and optionally tinted.
+	Image       string  `toml:"image"`
+	Mode        string  `toml:"mode"`
+	Tint        string  `toml:"tint"`
+	TintOpacity float64 `toml:"tint_opacity"`
+	// Layers are composited in order over the background (or over a
+	// transparent canvas when Type is empty). A layer is any background type
+	// or one of noise, vignette and tint, with its own Opacity (0 means 1) and
+	// Blend mode. Radius is where a vignette starts (0..1).
+	Layers  []Background `toml:"layers"`
+	Opacity float64      `toml:"opacity"`
+	Blend   string       `toml:"blend"`
+	Radius  float64      `toml:"radius"`
+}
+
+// Images returns the asset names used by bg and its layers.
+func (bg Background) Images() []string {
+	var images []string
+	if bg.Image != "" {
+		images = append(images, bg.Image)
+	}
+	for _, layer := range bg.Layers {
+		images = append(images, layer.Images()...)
+	}
+	return images
 }
 
 type Watermark struct {
-	Font         string  `toml:"font"`
-	Size         float64 `toml:"size"`
-	Color        string  `toml:"color"`
-	Opacity      float64 `toml:"opacity"`
-	Align        string  `toml:"align"`
-	OffsetX      float64 `toml:"offset_x"`
-	OffsetY      float64 `toml:"offset_y"`
+	// Kind is text (default) or image.
+	Kind string `toml:"kind"`
+	Font string `toml:"font"`
+	// Size, OffsetX and Width percentages are of the width of the anchor
+	// area, OffsetY ones of its height.
+	Size    Length  `toml:"size"`
+	Color   string  `toml:"color"`
+	Opacity float64 `toml:"opacity"`
+	Align   string  `toml:"align"`
+	// Anchor is the area the watermark is aligned in: canvas (default),
+	// photo or padding, the margin below the photo.
+	Anchor       string  `toml:"anchor"`
+	OffsetX      Length  `toml:"offset_x"`
+	OffsetY      Length  `toml:"offset_y"`
 	Outline      bool    `toml:"outline"`
 	OutlineColor string  `toml:"outline_color"`
 	OutlineWidth float64 `toml:"outline_width"`
+	// LightColor and DarkColor are the choices of color = "auto".
+	// AutoOutline outlines the text when it contrasts too little with the
+	// pixels under it.
+	LightColor  string `toml:"light_color"`
+	DarkColor   string `toml:"dark_color"`
+	AutoOutline bool   `toml:"auto_outline"`
+	// Template is the default watermark text, e.g. "{text} · {date:2006-01-02}";
+	// {text} is the runtime text. Empty means "{text}".
+	Template string `toml:"template"`
+	// Mode is single (default) or tile. Tiled watermarks repeat over the
+	// anchor area, rotated by Angle degrees counter-clockwise, Spacing apart
+	// (the font size, or the image height, by default).
+	Mode    string  `toml:"mode"`
+	Angle   float64 `toml:"angle"`
+	Spacing Length  `toml:"spacing"`
+	// Image is the file drawn by image watermarks, relative to assets_path.
+	// Width is its width; Tint recolors it to a single color, keeping its
+	// alpha.
+	Image string `toml:"image"`
+	Width Length `toml:"width"`
+	Tint  string `toml:"tint"`
+}
+
+// ResolvedWatermark is a watermark layer with its style.
+type ResolvedWatermark struct {
+	Name string
+	Watermark
 }
 
 type ResolvedProfile struct {
-	Name           string
-	Background     Background
-	Watermark      *Watermark
-	Format         Format
-	FormatName     string
-	PaddingPercent float64
-	BorderWidth    int
-	BorderColor    string
-	NoUpscale      bool
-	JpegQuality    int
-	AssetsPath     string
+	Name              string
+	Background        Background
+	Watermarks        []ResolvedWatermark
+	Format            Format
+	FormatName        string
+	PaddingPercent    float64
+	BorderWidth       int
+	BorderColor       string
+	NoUpscale         bool
+	FitMode           string
+	JpegQuality       int
+	AssetsPath        string
+	MetadataPolicy    string
+	MetadataTags      []string
+	KeepColorProfile  bool
+	MaxBytes          int64
+	MinJpegQuality    int
+	OutputFormat      string
+	ChromaSubsampling string
+	// Shadow is nil without a shadow; its color and opacity are defaulted.
+	Shadow *Shadow
+	// CornerRadius percentages are of the shorter side of the bordered photo.
+	CornerRadius Length
+	// Padding is nil when PaddingPercent applies on every side.
+	Padding       *Padding
+	OpticalCenter bool
+	// Caption is nil without a caption strip; its defaults are filled in.
+	Caption *Caption
 }
 
 // Load reads a TOML config file and validates it.
@@ -157,6 +530,12 @@ func (c *Config) Validate() error {
 	if strings.TrimSpace(c.Settings.AssetsPath) == "" {
 		c.Settings.AssetsPath = "assets"
 	}
+	if strings.TrimSpace(c.Settings.MetadataPolicy) == "" {
+		c.Settings.MetadataPolicy = MetadataStripAll
+	}
+	if err := validateMetadataPolicy("settings.metadata_policy", c.Settings.MetadataPolicy, nil); err != nil {
+		return err
+	}
 
 	for name, format := range c.Formats {
 		if err := validateFormat(name, format); err != nil {
@@ -181,16 +560,27 @@ func (c *Config) Validate() error {
 		if err := validateBackground(name, bg); err != nil {
 			return err
 		}
+		for _, file := range bg.Images() {
+			if !fileExists(AssetPath(c.Settings.AssetsPath, file)) {
+				return fmt.Errorf("backgrounds.%s.image not found: %s", name, AssetPath(c.Settings.AssetsPath, file))
+			}
+		}
 	}
 	for name, wm := range c.Watermarks {
 		if err := validateWatermark(name, wm); err != nil {
 			return err
 		}
+		if wm.Image != "" && !fileExists(AssetPath(c.Settings.AssetsPath, wm.Image)) {
+			return fmt.Errorf("watermarks.%s.image not found: %s", name, AssetPath(c.Settings.AssetsPath, wm.Image))
+		}
 	}
 	for name, profile := range c.Profiles {
 		if err := c.validateProfile(name, profile); err != nil {
 			return err
 		}
+		if cp := profile.Caption; cp != nil && cp.Logo != "" && !fileExists(AssetPath(c.Settings.AssetsPath, cp.Logo)) {
+			return fmt.Errorf("profiles.%s.caption.logo not found: %s", name, AssetPath(c.Settings.AssetsPath, cp.Logo))
+		}
 	}
 
 	return nil
@@ -213,13 +603,80 @@ func (c Config) validateProfile(name string, profile Profile) error {
 		if _, ok := c.Watermarks[profile.WatermarkRef]; !ok {
 			return fmt.Errorf("profiles.%s.watermark_ref not found: %s", name, profile.WatermarkRef)
 		}
+		if len(profile.Watermarks) > 0 {
+			return fmt.Errorf("profiles.%s sets both watermark_ref and watermarks", name)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, layer := range profile.Layers() {
+		if _, ok := c.Watermarks[layer.WatermarkRef]; !ok {
+			return fmt.Errorf("profiles.%s.watermarks[%d].watermark_ref not found: %s", name, i, layer.WatermarkRef)
+		}
+		if seen[layer.Name] {
+			return fmt.Errorf("profiles.%s.watermarks has duplicate name: %s", name, layer.Name)
+		}
+		seen[layer.Name] = true
 	}
 	if profile.JpegQuality != 0 && (profile.JpegQuality < 1 || profile.JpegQuality > 100) {
 		return fmt.Errorf("profiles.%s.jpeg_quality out of range: %d", name, profile.JpegQuality)
 	}
+	if profile.MaxBytes < 0 {
+		return fmt.Errorf("profiles.%s.max_bytes must be >= 0", name)
+	}
+	if profile.MinJpegQuality != 0 && (profile.MinJpegQuality < 1 || profile.MinJpegQuality > 100) {
+		return fmt.Errorf("profiles.%s.min_jpeg_quality out of range: %d", name, profile.MinJpegQuality)
+	}
+	if profile.OutputFormat != "" {
+		if _, err := ParseOutputFormat(profile.OutputFormat); err != nil {
+			return fmt.Errorf("profiles.%s.output_format: %w", name, err)
+		}
+	}
+	switch strings.TrimSpace(profile.ChromaSubsampling) {
+	case "", ChromaSubsampling420, ChromaSubsampling444:
+	default:
+		return fmt.Errorf("profiles.%s.chroma_subsampling has unknown value: %s", name, profile.ChromaSubsampling)
+	}
+	switch strings.ToLower(strings.TrimSpace(profile.FitMode)) {
+	case "", FitContain, FitCover, FitSmart:
+	default:
+		return fmt.Errorf("profiles.%s.fit_mode has unknown value: %s", name, profile.FitMode)
+	}
 	if profile.PaddingPercent != nil && (*profile.PaddingPercent < 0 || *profile.PaddingPercent > 50) {
 		return fmt.Errorf("profiles.%s.padding_percent must be 0..50", name)
 	}
+	if profile.Padding != nil {
+		if err := validatePadding(name, *profile.Padding, c.Formats[profile.FormatRef]); err != nil {
+			return err
+		}
+	}
+	if profile.Caption != nil {
+		if err := validateCaption(name, *profile.Caption); err != nil {
+			return err
+		}
+	}
+	if profile.CornerRadius.Value < 0 || (profile.CornerRadius.Percent && profile.CornerRadius.Value > 50) {
+		return fmt.Errorf("profiles.%s.corner_radius must be >= 0 (and at most 50%%)", name)
+	}
+	if sh := profile.Shadow; sh != nil {
+		if sh.Blur < 0 || sh.Blur > MaxShadowBlur {
+			return fmt.Errorf("profiles.%s.shadow.blur must be 0..%g", name, MaxShadowBlur)
+		}
+		if sh.Opacity < 0 || sh.Opacity > 1 {
+			return fmt.Errorf("profiles.%s.shadow.opacity must be 0..1", name)
+		}
+		if sh.Color != "" && !isHexColor(sh.Color) {
+			return fmt.Errorf("profiles.%s.shadow.color has invalid color: %s", name, sh.Color)
+		}
+	}
+	if profile.MetadataPolicy != "" || len(profile.MetadataTags) > 0 {
+		policy := profile.MetadataPolicy
+		if policy == "" {
+			policy = c.Settings.MetadataPolicy
+		}
+		if err := validateMetadataPolicy("profiles."+name+".metadata_policy", policy, profile.MetadataTags); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -246,16 +703,16 @@ func (c Config) ResolveProfile(name string) (ResolvedProfile, error) {
 		return ResolvedProfile{}, err
 	}
 
-	var watermark *Watermark
-	if profile.WatermarkRef != "" {
-		wm, ok := c.Watermarks[profile.WatermarkRef]
+	var watermarks []ResolvedWatermark
+	for _, layer := range profile.Layers() {
+		wm, ok := c.Watermarks[layer.WatermarkRef]
 		if !ok {
-			return ResolvedProfile{}, fmt.Errorf("%w: %s", ErrWatermarkNotFound, profile.WatermarkRef)
+			return ResolvedProfile{}, fmt.Errorf("%w: %s", ErrWatermarkNotFound, layer.WatermarkRef)
 		}
-		if err := validateWatermark(profile.WatermarkRef, wm); err != nil {
+		if err := validateWatermark(layer.WatermarkRef, wm); err != nil {
 			return ResolvedProfile{}, err
 		}
-		watermark = &wm
+		watermarks = append(watermarks, ResolvedWatermark{Name: layer.Name, Watermark: wm})
 	}
 
 	jpegQuality := c.Settings.JpegQuality
@@ -263,6 +720,27 @@ func (c Config) ResolveProfile(name string) (ResolvedProfile, error) {
 		jpegQuality = profile.JpegQuality
 	}
 
+	minJpegQuality := profile.MinJpegQuality
+	if minJpegQuality == 0 {
+		minJpegQuality = DefaultMinJpegQuality
+	}
+	if minJpegQuality > jpegQuality {
+		minJpegQuality = jpegQuality
+	}
+
+	outputFormat := OutputFormatJPEG
+	if profile.OutputFormat != "" {
+		outputFormat, _ = ParseOutputFormat(profile.OutputFormat)
+	}
+	fitMode := strings.ToLower(strings.TrimSpace(profile.FitMode))
+	if fitMode == "" {
+		fitMode = FitContain
+	}
+	chroma := strings.TrimSpace(profile.ChromaSubsampling)
+	if chroma == "" {
+		chroma = ChromaSubsampling420
+	}
+
 	assetsPath := strings.TrimSpace(c.Settings.AssetsPath)
 	if assetsPath == "" {
 		assetsPath = "assets"
@@ -273,21 +751,96 @@ func (c Config) ResolveProfile(name string) (ResolvedProfile, error) {
 		paddingPercent = *profile.PaddingPercent
 	}
 
+	metadataPolicy := strings.ToLower(strings.TrimSpace(c.Settings.MetadataPolicy))
+	if profile.MetadataPolicy != "" {
+		metadataPolicy = strings.ToLower(strings.TrimSpace(profile.MetadataPolicy))
+	}
+	if metadataPolicy == "" {
+		metadataPolicy = MetadataStripAll
+	}
+
+	var shadow *Shadow
+	if profile.Shadow != nil {
+		sh := *profile.Shadow
+		if sh.Color == "" {
+			sh.Color = "#000000"
+		}
+		if sh.Opacity == 0 {
+			sh.Opacity = DefaultShadowOpacity
+		}
+		shadow = &sh
+	}
+
+	var caption *Caption
+	if profile.Caption != nil {
+		cp := *profile.Caption
+		if cp.Height.Value == 0 {
+			cp.Height = Length{Value: DefaultCaptionHeightPercent, Percent: true}
+		}
+		if cp.Background == "" {
+			cp.Background = DefaultCaptionBackground
+		}
+		if cp.MutedFont == "" {
+			cp.MutedFont = cp.Font
+		}
+		if cp.Color == "" {
+			cp.Color = DefaultCaptionColor
+		}
+		if cp.MutedColor == "" {
+			cp.MutedColor = DefaultCaptionMutedColor
+		}
+		caption = &cp
+	}
+
 	return ResolvedProfile{
-		Name:           name,
-		Background:     background,
-		Watermark:      watermark,
-		Format:         format,
-		FormatName:     profile.FormatRef,
-		PaddingPercent: paddingPercent,
-		BorderWidth:    profile.BorderWidth,
-		BorderColor:    profile.BorderColor,
-		NoUpscale:      profile.NoUpscale,
-		JpegQuality:    jpegQuality,
-		AssetsPath:     assetsPath,
+		Name:              name,
+		Background:        background,
+		Watermarks:        watermarks,
+		Format:            format,
+		FormatName:        profile.FormatRef,
+		PaddingPercent:    paddingPercent,
+		BorderWidth:       profile.BorderWidth,
+		BorderColor:       profile.BorderColor,
+		NoUpscale:         profile.NoUpscale,
+		FitMode:           fitMode,
+		JpegQuality:       jpegQuality,
+		AssetsPath:        assetsPath,
+		MetadataPolicy:    metadataPolicy,
+		MetadataTags:      profile.MetadataTags,
+		KeepColorProfile:  profile.KeepColorProfile,
+		MaxBytes:          profile.MaxBytes,
+		MinJpegQuality:    minJpegQuality,
+		OutputFormat:      outputFormat,
+		ChromaSubsampling: chroma,
+		Shadow:            shadow,
+		CornerRadius:      profile.CornerRadius,
+		Padding:           profile.Padding,
+		OpticalCenter:     profile.OpticalCenter,
+		Caption:           caption,
 	}, nil
 }
 
+// AssetPath resolves an asset file name against assets_path; absolute names
+// are used as is.
+func AssetPath(assetsPath, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(assetsPath, name)
+}
+
+// ParseOutputFormat normalizes an output format name; "jpg" is accepted for "jpeg".
+func ParseOutputFormat(format string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(format)); f {
+	case "jpg":
+		return OutputFormatJPEG, nil
+	case OutputFormatJPEG, OutputFormatJPEGProgressive, OutputFormatPNG, OutputFormatWebP:
+		return f, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownOutputFormat, format)
+	}
+}
+
 func validateFormat(name string, format Format) error {
 	switch strings.ToLower(strings.TrimSpace(format.Type)) {
 	case FormatTypeFixed:
@@ -297,6 +850,9 @@ func validateFormat(name string, format Format) error {
 		if len(format.FromList) > 0 {
 			return fmt.Errorf("formats.%s fixed format must not have from_list", name)
 		}
+		if format.MinRatio != 0 || format.MaxRatio != 0 {
+			return fmt.Errorf("formats.%s fixed format must not have min_ratio/max_ratio", name)
+		}
 	case FormatTypeAuto:
 		if len(format.FromList) == 0 {
 			return fmt.Errorf("formats.%s auto format requires from_list", name)
@@ -304,6 +860,22 @@ func validateFormat(name string, format Format) error {
 		if format.Width != 0 || format.Height != 0 {
 			return fmt.Errorf("formats.%s auto format must not have width/height", name)
 		}
+		if format.MinRatio != 0 || format.MaxRatio != 0 {
+			return fmt.Errorf("formats.%s auto format must not have min_ratio/max_ratio", name)
+		}
+	case FormatTypeRange:
+		if format.Width <= 0 {
+			return fmt.Errorf("formats.%s range format requires width", name)
+		}
+		if format.Height != 0 || len(format.FromList) > 0 {
+			return fmt.Errorf("formats.%s range format must not have height or from_list", name)
+		}
+		if format.MinRatio <= 0 || format.MaxRatio <= 0 {
+			return fmt.Errorf("formats.%s range format requires min_ratio and max_ratio", name)
+		}
+		if format.MinRatio > format.MaxRatio {
+			return fmt.Errorf("formats.%s.min_ratio must not exceed max_ratio", name)
+		}
 	default:
 		return fmt.Errorf("formats.%s has unknown type: %s", name, format.Type)
 	}
@@ -315,22 +887,239 @@ func validateFormat(name string, format Format) error {
 
 func validateBackground(name string, bg Background) error {
 	switch strings.ToLower(strings.TrimSpace(bg.Type)) {
+	case "":
+		if len(bg.Layers) == 0 {
+			return fmt.Errorf("backgrounds.%s.type is required", name)
+		}
 	case "solid", "blur", "stretch", "average":
+	case LayerNoise, LayerVignette, LayerTint:
+		return fmt.Errorf("backgrounds.%s type %s is only valid as a layer", name, bg.Type)
+	case "gradient":
+		if err := validateGradient(name, bg); err != nil {
+			return err
+		}
+	case "image":
+		if strings.TrimSpace(bg.Image) == "" {
+			return fmt.Errorf("backgrounds.%s image background requires image", name)
+		}
+		switch strings.ToLower(strings.TrimSpace(bg.Mode)) {
+		case "", ImageModeTile, ImageModeCover, ImageModeStretch:
+		default:
+			return fmt.Errorf("backgrounds.%s.mode has unknown value: %s", name, bg.Mode)
+		}
+	case "palette":
+		switch strings.ToLower(strings.TrimSpace(bg.Strategy)) {
+		case "", PaletteDominant, PaletteSaturated, PaletteDarkest, PaletteLightest:
+		default:
+			return fmt.Errorf("backgrounds.%s.strategy has unknown value: %s", name, bg.Strategy)
+		}
 	default:
 		return fmt.Errorf("backgrounds.%s has unknown type: %s", name, bg.Type)
 	}
 	if bg.Darken < 0 || bg.Darken > 1 {
 		return fmt.Errorf("backgrounds.%s.darken must be 0..1", name)
 	}
+	if bg.Tint != "" && !isHexColor(bg.Tint) {
+		return fmt.Errorf("backgrounds.%s.tint has invalid color: %s", name, bg.Tint)
+	}
+	if bg.TintOpacity < 0 || bg.TintOpacity > 1 {
+		return fmt.Errorf("backgrounds.%s.tint_opacity must be 0..1", name)
+	}
+	if bg.PaletteSize != 0 && (bg.PaletteSize < 2 || bg.PaletteSize > 16) {
+		return fmt.Errorf("backgrounds.%s.palette_size must be 2..16", name)
+	}
+	if bg.Saturation < -1 || bg.Saturation > 1 {
+		return fmt.Errorf("backgrounds.%s.saturation must be -1..1", name)
+	}
+	if bg.Lightness < -1 || bg.Lightness > 1 {
+		return fmt.Errorf("backgrounds.%s.lightness must be -1..1", name)
+	}
+	for i, layer := range bg.Layers {
+		if err := validateLayer(fmt.Sprintf("%s.layers[%d]", name, i), layer); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func validateWatermark(name string, wm Watermark) error {
-	if strings.TrimSpace(wm.Font) == "" {
-		return fmt.Errorf("watermarks.%s.font is required", name)
+func validateCaption(name string, cp Caption) error {
+	if strings.TrimSpace(cp.Font) == "" {
+		return fmt.Errorf("profiles.%s.caption.font is required", name)
+	}
+	if cp.Height.Value < 0 || (cp.Height.Percent && cp.Height.Value >= 50) {
+		return fmt.Errorf("profiles.%s.caption.height must be >= 0 (and under 50%%)", name)
+	}
+	if cp.Size < 0 {
+		return fmt.Errorf("profiles.%s.caption.size must be >= 0", name)
+	}
+	for field, c := range map[string]string{"background": cp.Background, "color": cp.Color, "muted_color": cp.MutedColor} {
+		if c != "" && !isHexColor(c) {
+			return fmt.Errorf("profiles.%s.caption.%s has invalid color: %s", name, field, c)
+		}
+	}
+	return nil
+}
+
+// validatePadding checks that no side is negative and that the padding leaves
+// room for the photo. Pixel sides are checked against the format size when it
+// is known.
+func validatePadding(name string, p Padding, format Format) error {
+	sides := []struct {
+		name string
+		l    Length
+	}{{"top", p.Top}, {"right", p.Right}, {"bottom", p.Bottom}, {"left", p.Left}}
+	for _, side := range sides {
+		if side.l.Value < 0 {
+			return fmt.Errorf("profiles.%s.padding.%s must be >= 0", name, side.name)
+		}
+	}
+	width, height := 0.0, 0.0
+	if strings.ToLower(strings.TrimSpace(format.Type)) == FormatTypeFixed {
+		width, height = float64(format.Width), float64(format.Height)
 	}
-	if wm.Size <= 0 {
-		return fmt.Errorf("watermarks.%s.size must be > 0", name)
+	if !leavesRoom(p.Left, p.Right, width) {
+		return fmt.Errorf("profiles.%s.padding leaves no width for the photo", name)
+	}
+	if !leavesRoom(p.Top, p.Bottom, height) {
+		return fmt.Errorf("profiles.%s.padding leaves no height for the photo", name)
+	}
+	return nil
+}
+
+// leavesRoom reports whether two opposite sides leave part of size free. When
+// size is unknown (0) only the percentages are checked.
+func leavesRoom(a, b Length, size float64) bool {
+	var percent, px float64
+	for _, l := range []Length{a, b} {
+		if l.Percent {
+			percent += l.Value
+		} else {
+			px += l.Value
+		}
+	}
+	if percent >= 100 {
+		return false
+	}
+	return size <= 0 || size*(1-percent/100)-px >= 1
+}
+
+func validateLayer(name string, layer Background) error {
+	if len(layer.Layers) > 0 {
+		return fmt.Errorf("backgrounds.%s must not have nested layers", name)
+	}
+	switch strings.ToLower(strings.TrimSpace(layer.Type)) {
+	case "":
+		return fmt.Errorf("backgrounds.%s.type is required", name)
+	case LayerNoise:
+	case LayerTint:
+		if !isHexColor(layer.Color) {
+			return fmt.Errorf("backgrounds.%s tint layer requires a hex color", name)
+		}
+	case LayerVignette:
+		if layer.Color != "" && !isHexColor(layer.Color) {
+			return fmt.Errorf("backgrounds.%s.color has invalid color: %s", name, layer.Color)
+		}
+		if layer.Radius < 0 || layer.Radius >= 1 {
+			return fmt.Errorf("backgrounds.%s.radius must be 0..1", name)
+		}
+	default:
+		if err := validateBackground(name, layer); err != nil {
+			return err
+		}
+	}
+	if layer.Opacity < 0 || layer.Opacity > 1 {
+		return fmt.Errorf("backgrounds.%s.opacity must be 0..1", name)
+	}
+	switch strings.ToLower(strings.TrimSpace(layer.Blend)) {
+	case "", BlendNormal, BlendMultiply, BlendScreen, BlendOverlay:
+	default:
+		return fmt.Errorf("backgrounds.%s.blend has unknown value: %s", name, layer.Blend)
+	}
+	return nil
+}
+
+func validateGradient(name string, bg Background) error {
+	switch strings.ToLower(strings.TrimSpace(bg.Gradient)) {
+	case "", GradientLinear, GradientRadial:
+	default:
+		return fmt.Errorf("backgrounds.%s.gradient has unknown value: %s", name, bg.Gradient)
+	}
+	switch strings.ToLower(strings.TrimSpace(bg.ColorSource)) {
+	case "":
+		if len(bg.Colors) < 2 {
+			return fmt.Errorf("backgrounds.%s gradient requires at least two colors or a color_source", name)
+		}
+	case ColorSourceEdges, ColorSourceDominant:
+		if len(bg.Colors) > 0 {
+			return fmt.Errorf("backgrounds.%s must not have both colors and color_source", name)
+		}
+	default:
+		return fmt.Errorf("backgrounds.%s.color_source has unknown value: %s", name, bg.ColorSource)
+	}
+	for _, c := range bg.Colors {
+		if !isHexColor(c) {
+			return fmt.Errorf("backgrounds.%s.colors has invalid color: %s", name, c)
+		}
+	}
+	return nil
+}
+
+// isHexColor reports whether s is a #rgb or #rrggbb color.
+func isHexColor(s string) bool {
+	s = strings.TrimSpace(s)
+	if (len(s) != 4 && len(s) != 7) || s[0] != '#' {
+		return false
+	}
+	for _, r := range s[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateMetadataPolicy(field, policy string, tags []string) error {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case MetadataKeepAll, MetadataStripAll, MetadataStripGPS:
+		if len(tags) > 0 {
+			return fmt.Errorf("%s: metadata_tags require the allowlist policy", field)
+		}
+	case MetadataAllowlist:
+		if len(tags) == 0 {
+			return fmt.Errorf("%s: allowlist policy requires metadata_tags", field)
+		}
+	default:
+		return fmt.Errorf("%s has unknown value: %s", field, policy)
+	}
+	return nil
+}
+
+func validateWatermark(name string, wm Watermark) error {
+	switch strings.ToLower(strings.TrimSpace(wm.Kind)) {
+	case "", WatermarkKindText:
+		if strings.TrimSpace(wm.Font) == "" {
+			return fmt.Errorf("watermarks.%s.font is required", name)
+		}
+		if wm.Size.Value <= 0 || (wm.Size.Percent && wm.Size.Value > 100) {
+			return fmt.Errorf("watermarks.%s.size must be > 0 (and at most 100%%)", name)
+		}
+		for field, c := range map[string]string{"light_color": wm.LightColor, "dark_color": wm.DarkColor, "outline_color": wm.OutlineColor} {
+			if c != "" && !isHexColor(c) {
+				return fmt.Errorf("watermarks.%s.%s has invalid color: %s", name, field, c)
+			}
+		}
+	case WatermarkKindImage:
+		if strings.TrimSpace(wm.Image) == "" {
+			return fmt.Errorf("watermarks.%s.image is required for kind=image", name)
+		}
+		if wm.Width.Value <= 0 || (wm.Width.Percent && wm.Width.Value > 100) {
+			return fmt.Errorf("watermarks.%s.width must be > 0 (and at most 100%%)", name)
+		}
+		if wm.Tint != "" && !isHexColor(wm.Tint) {
+			return fmt.Errorf("watermarks.%s.tint has invalid color: %s", name, wm.Tint)
+		}
+	default:
+		return fmt.Errorf("watermarks.%s.kind has unknown value: %s", name, wm.Kind)
 	}
 	if wm.Opacity < 0 || wm.Opacity > 1 {
 		return fmt.Errorf("watermarks.%s.opacity must be 0..1", name)
@@ -338,6 +1127,19 @@ func validateWatermark(name string, wm Watermark) error {
 	if wm.OutlineWidth < 0 {
 		return fmt.Errorf("watermarks.%s.outline_width must be >= 0", name)
 	}
+	switch strings.ToLower(strings.TrimSpace(wm.Anchor)) {
+	case "", AnchorCanvas, AnchorPhoto, AnchorPadding:
+	default:
+		return fmt.Errorf("watermarks.%s.anchor has unknown value: %s", name, wm.Anchor)
+	}
+	switch strings.ToLower(strings.TrimSpace(wm.Mode)) {
+	case "", WatermarkModeSingle, WatermarkModeTile:
+	default:
+		return fmt.Errorf("watermarks.%s.mode has unknown value: %s", name, wm.Mode)
+	}
+	if wm.Spacing.Value < 0 || (wm.Spacing.Percent && wm.Spacing.Value > 100) {
+		return fmt.Errorf("watermarks.%s.spacing must be >= 0 (and at most 100%%)", name)
+	}
 	return nil
 }
 
@@ -2,7 +2,10 @@ package config
 
 import (
 	"errors"
+	"strings"
 	"testing"
+
+	"github.com/BurntSushi/toml"
 )
 
 func TestValidateRejectsAutoWithSize(t *testing.T) {
@@ -17,7 +20,7 @@ func TestValidateRejectsAutoWithSize(t *testing.T) {
 		Watermarks: map[string]Watermark{
 			"standard": {
 				Font:    "roboto.ttf",
-				Size:    12,
+				Size:    Length{Value: 12},
 				Color:   "#ffffff",
 				Opacity: 1,
 			},
@@ -59,3 +62,481 @@ func TestResolveProfileMissing(t *testing.T) {
 		t.Fatalf("expected ErrProfileNotFound, got %v", err)
 	}
 }
+
+func TestResolveProfileMinJpegQuality(t *testing.T) {
+	cfg := Config{
+		Settings: Settings{
+			JpegQuality: 40,
+			AssetsPath:  "assets",
+		},
+		Backgrounds: map[string]Background{
+			"black": {Type: "solid", Color: "#000000"},
+		},
+		Formats: map[string]Format{
+			"square": {Type: "fixed", Width: 100, Height: 100},
+		},
+		Profiles: map[string]Profile{
+			"default": {BackgroundRef: "black", FormatRef: "square", MaxBytes: 1 << 20},
+			"invalid": {BackgroundRef: "black", FormatRef: "square", MinJpegQuality: 101},
+		},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected validation error for min_jpeg_quality out of range")
+	}
+	delete(cfg.Profiles, "invalid")
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	resolved, err := cfg.ResolveProfile("default")
+	if err != nil {
+		t.Fatalf("ResolveProfile: %v", err)
+	}
+	if resolved.MaxBytes != 1<<20 {
+		t.Fatalf("expected max_bytes to be resolved, got %d", resolved.MaxBytes)
+	}
+	if resolved.MinJpegQuality != 40 {
+		t.Fatalf("expected min quality capped at jpeg_quality, got %d", resolved.MinJpegQuality)
+	}
+}
+
+func TestValidateRangeFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		wantErr bool
+	}{
+		{name: "valid", format: Format{Type: "range", Width: 1080, MinRatio: 0.8, MaxRatio: 1.91}},
+		{name: "missing width", format: Format{Type: "range", MinRatio: 0.8, MaxRatio: 1.91}, wantErr: true},
+		{name: "missing ratios", format: Format{Type: "range", Width: 1080}, wantErr: true},
+		{name: "inverted ratios", format: Format{Type: "range", Width: 1080, MinRatio: 1.91, MaxRatio: 0.8}, wantErr: true},
+		{name: "height not allowed", format: Format{Type: "range", Width: 1080, Height: 1080, MinRatio: 0.8, MaxRatio: 1.91}, wantErr: true},
+		{name: "ratios on fixed", format: Format{Type: "fixed", Width: 1080, Height: 1080, MinRatio: 0.8}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFormat("test", tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveProfileFitMode(t *testing.T) {
+	cfg := Config{
+		Settings: Settings{
+			JpegQuality: 90,
+			AssetsPath:  "assets",
+		},
+		Backgrounds: map[string]Background{
+			"black": {Type: "solid", Color: "#000000"},
+		},
+		Formats: map[string]Format{
+			"square": {Type: "fixed", Width: 100, Height: 100},
+		},
+		Profiles: map[string]Profile{
+			"default": {BackgroundRef: "black", FormatRef: "square"},
+			"smart":   {BackgroundRef: "black", FormatRef: "square", FitMode: " Smart "},
+			"invalid": {BackgroundRef: "black", FormatRef: "square", FitMode: "zoom"},
+		},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected validation error for unknown fit_mode")
+	}
+	delete(cfg.Profiles, "invalid")
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	for name, want := range map[string]string{"default": FitContain, "smart": FitSmart} {
+		resolved, err := cfg.ResolveProfile(name)
+		if err != nil {
+			t.Fatalf("ResolveProfile(%s): %v", name, err)
+		}
+		if resolved.FitMode != want {
+			t.Fatalf("ResolveProfile(%s).FitMode = %q, want %q", name, resolved.FitMode, want)
+		}
+	}
+}
+
+func TestValidateGradientBackground(t *testing.T) {
+	tests := []struct {
+		name    string
+		bg      Background
+		wantErr bool
+	}{
+		{name: "explicit colors", bg: Background{Type: "gradient", Angle: 90, Colors: []string{"#f7f7f5", "#e8e8e4"}}},
+		{name: "radial from edges", bg: Background{Type: "gradient", Gradient: "radial", ColorSource: "edges"}},
+		{name: "dominant", bg: Background{Type: "gradient", ColorSource: "dominant"}},
+		{name: "single color", bg: Background{Type: "gradient", Colors: []string{"#fff"}}, wantErr: true},
+		{name: "invalid color", bg: Background{Type: "gradient", Colors: []string{"#fff", "white"}}, wantErr: true},
+		{name: "colors and source", bg: Background{Type: "gradient", Colors: []string{"#fff", "#000"}, ColorSource: "edges"}, wantErr: true},
+		{name: "unknown shape", bg: Background{Type: "gradient", Gradient: "conic", ColorSource: "edges"}, wantErr: true},
+		{name: "unknown source", bg: Background{Type: "gradient", ColorSource: "center"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackground("test", tt.bg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateBackground() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePaletteBackground(t *testing.T) {
+	tests := []struct {
+		name    string
+		bg      Background
+		wantErr bool
+	}{
+		{name: "defaults", bg: Background{Type: "palette"}},
+		{name: "adjusted", bg: Background{Type: "palette", Strategy: "saturated", PaletteSize: 8, Saturation: -0.2, Lightness: 0.1}},
+		{name: "unknown strategy", bg: Background{Type: "palette", Strategy: "brightest"}, wantErr: true},
+		{name: "palette too small", bg: Background{Type: "palette", PaletteSize: 1}, wantErr: true},
+		{name: "lightness out of range", bg: Background{Type: "palette", Lightness: 1.5}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackground("test", tt.bg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateBackground() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateImageBackground(t *testing.T) {
+	tests := []struct {
+		name    string
+		bg      Background
+		wantErr bool
+	}{
+		{name: "cover by default", bg: Background{Type: "image", Image: "paper.jpg"}},
+		{name: "tile with tint", bg: Background{Type: "image", Image: "linen.png", Mode: "tile", Tint: "#c8b8a0", TintOpacity: 0.2}},
+		{name: "missing image", bg: Background{Type: "image"}, wantErr: true},
+		{name: "unknown mode", bg: Background{Type: "image", Image: "paper.jpg", Mode: "mirror"}, wantErr: true},
+		{name: "invalid tint", bg: Background{Type: "image", Image: "paper.jpg", Tint: "sepia"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackground("test", tt.bg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateBackground() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := Config{
+		Settings:    Settings{AssetsPath: t.TempDir()},
+		Backgrounds: map[string]Background{"paper": {Type: "image", Image: "paper.jpg"}},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "backgrounds.paper.image not found") {
+		t.Fatalf("expected missing asset error, got %v", err)
+	}
+}
+
+func TestValidateImageWatermark(t *testing.T) {
+	pct := func(v float64) Length { return Length{Value: v, Percent: true} }
+	tests := []struct {
+		name    string
+		wm      Watermark
+		wantErr bool
+	}{
+		{name: "text by default", wm: Watermark{Font: "Roboto-Bold.ttf", Size: Length{Value: 12}}},
+		{name: "logo", wm: Watermark{Kind: "image", Image: "logo.png", Width: pct(12), Opacity: 0.8, Tint: "#ffffff"}},
+		{name: "logo in pixels", wm: Watermark{Kind: "Image", Image: "logo.png", Width: Length{Value: 120}}},
+		{name: "text without font", wm: Watermark{Kind: "text", Size: Length{Value: 12}}, wantErr: true},
+		{name: "auto color", wm: Watermark{Font: "Roboto-Bold.ttf", Size: Length{Value: 12}, Color: "auto", LightColor: "#f0f0f0", DarkColor: "#2c2c2c", AutoOutline: true}},
+		{name: "tiled", wm: Watermark{Font: "Roboto-Bold.ttf", Size: Length{Value: 4, Percent: true}, Mode: "tile", Angle: 30, Spacing: Length{Value: 6, Percent: true}}},
+		{name: "unknown mode", wm: Watermark{Font: "Roboto-Bold.ttf", Size: Length{Value: 12}, Mode: "mosaic"}, wantErr: true},
+		{name: "negative spacing", wm: Watermark{Font: "Roboto-Bold.ttf", Size: Length{Value: 12}, Mode: "tile", Spacing: Length{Value: -1}}, wantErr: true},
+		{name: "invalid dark color", wm: Watermark{Font: "Roboto-Bold.ttf", Size: Length{Value: 12}, Color: "auto", DarkColor: "black"}, wantErr: true},
+		{name: "missing image", wm: Watermark{Kind: "image", Width: pct(12)}, wantErr: true},
+		{name: "missing width", wm: Watermark{Kind: "image", Image: "logo.png"}, wantErr: true},
+		{name: "width over canvas", wm: Watermark{Kind: "image", Image: "logo.png", Width: pct(120)}, wantErr: true},
+		{name: "invalid tint", wm: Watermark{Kind: "image", Image: "logo.png", Width: pct(12), Tint: "white"}, wantErr: true},
+		{name: "unknown kind", wm: Watermark{Kind: "svg", Image: "logo.svg"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateWatermark("test", tt.wm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateWatermark() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := Config{
+		Settings:   Settings{AssetsPath: t.TempDir()},
+		Watermarks: map[string]Watermark{"logo": {Kind: "image", Image: "logo.png", Width: pct(12)}},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "watermarks.logo.image not found") {
+		t.Fatalf("expected missing asset error, got %v", err)
+	}
+}
+
+func TestValidateLayeredBackground(t *testing.T) {
+	tests := []struct {
+		name    string
+		bg      Background
+		wantErr bool
+	}{
+		{name: "base with layers", bg: Background{Type: "blur", Layers: []Background{
+			{Type: "noise", Opacity: 0.1, Blend: "overlay"},
+			{Type: "vignette", Radius: 0.6},
+			{Type: "tint", Color: "#ffffff", Blend: "screen"},
+		}}},
+		{name: "layers only", bg: Background{Layers: []Background{{Type: "gradient", Colors: []string{"#000", "#fff"}}}}},
+		{name: "no type or layers", bg: Background{}, wantErr: true},
+		{name: "effect as base", bg: Background{Type: "noise"}, wantErr: true},
+		{name: "tint without color", bg: Background{Layers: []Background{{Type: "tint"}}}, wantErr: true},
+		{name: "opacity out of range", bg: Background{Layers: []Background{{Type: "noise", Opacity: 1.5}}}, wantErr: true},
+		{name: "unknown blend", bg: Background{Layers: []Background{{Type: "noise", Blend: "difference"}}}, wantErr: true},
+		{name: "vignette radius", bg: Background{Layers: []Background{{Type: "vignette", Radius: 1}}}, wantErr: true},
+		{name: "invalid layer background", bg: Background{Layers: []Background{{Type: "gradient"}}}, wantErr: true},
+		{name: "nested layers", bg: Background{Layers: []Background{{Type: "solid", Layers: []Background{{Type: "noise"}}}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackground("test", tt.bg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateBackground() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := Config{
+		Settings: Settings{AssetsPath: t.TempDir()},
+		Backgrounds: map[string]Background{"paper": {Type: "solid", Layers: []Background{
+			{Type: "image", Image: "paper.jpg", Blend: "multiply"},
+		}}},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "backgrounds.paper.image not found") {
+		t.Fatalf("expected missing layer asset error, got %v", err)
+	}
+}
+
+func TestProfileShadowAndCornerRadius(t *testing.T) {
+	const data = `
+[backgrounds.black]
+type = "solid"
+color = "#000000"
+
+[formats.square]
+type = "fixed"
+width = 100
+height = 100
+
+[profiles.px]
+background_ref = "black"
+format_ref = "square"
+corner_radius = 12
+
+[profiles.percent]
+background_ref = "black"
+format_ref = "square"
+corner_radius = "2.5%"
+
+[profiles.percent.shadow]
+offset_y = 8
+blur = 10.0
+`
+	var cfg Config
+	if _, err := toml.Decode(data, &cfg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	px, err := cfg.ResolveProfile("px")
+	if err != nil {
+		t.Fatalf("ResolveProfile(px): %v", err)
+	}
+	if px.CornerRadius != (Length{Value: 12}) || px.Shadow != nil {
+		t.Fatalf("px: corner_radius = %v, shadow = %v", px.CornerRadius, px.Shadow)
+	}
+	percent, err := cfg.ResolveProfile("percent")
+	if err != nil {
+		t.Fatalf("ResolveProfile(percent): %v", err)
+	}
+	if got := percent.CornerRadius.Pixels(200); got != 5 {
+		t.Fatalf("percent corner_radius = %v px, want 5", got)
+	}
+	want := Shadow{OffsetY: 8, Blur: 10, Color: "#000000", Opacity: DefaultShadowOpacity}
+	if percent.Shadow == nil || *percent.Shadow != want {
+		t.Fatalf("shadow = %+v, want %+v", percent.Shadow, want)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		profile Profile
+	}{
+		{name: "negative radius", profile: Profile{CornerRadius: Length{Value: -1}}},
+		{name: "radius over half", profile: Profile{CornerRadius: Length{Value: 60, Percent: true}}},
+		{name: "negative blur", profile: Profile{Shadow: &Shadow{Blur: -2}}},
+		{name: "blur over max", profile: Profile{Shadow: &Shadow{Blur: MaxShadowBlur + 1}}},
+		{name: "opacity", profile: Profile{Shadow: &Shadow{Opacity: 2}}},
+		{name: "color", profile: Profile{Shadow: &Shadow{Color: "black"}}},
+	} {
+		tt.profile.BackgroundRef, tt.profile.FormatRef = "black", "square"
+		if err := cfg.validateProfile(tt.name, tt.profile); err == nil {
+			t.Fatalf("%s: expected validation error", tt.name)
+		}
+	}
+	if _, err := ParseLength("wide"); err == nil {
+		t.Fatal("ParseLength(wide): expected error")
+	}
+}
+
+func TestProfileWatermarkLayers(t *testing.T) {
+	const data = `
+[backgrounds.black]
+type = "solid"
+color = "#000000"
+
+[formats.square]
+type = "fixed"
+width = 100
+height = 100
+
+[watermarks.signature]
+font = "Roboto-Bold.ttf"
+size = 12
+
+[profiles.single]
+background_ref = "black"
+format_ref = "square"
+watermark_ref = "signature"
+
+[profiles.layered]
+background_ref = "black"
+format_ref = "square"
+
+[[profiles.layered.watermarks]]
+name = "handle"
+watermark_ref = "signature"
+
+[[profiles.layered.watermarks]]
+watermark_ref = "signature"
+`
+	var cfg Config
+	if _, err := toml.Decode(data, &cfg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	for profile, want := range map[string][]string{"single": {"signature"}, "layered": {"handle", "signature"}} {
+		resolved, err := cfg.ResolveProfile(profile)
+		if err != nil {
+			t.Fatalf("ResolveProfile(%s): %v", profile, err)
+		}
+		var names []string
+		for _, wm := range resolved.Watermarks {
+			names = append(names, wm.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s: layers = %v, want %v", profile, names, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		profile Profile
+	}{
+		{name: "both fields", profile: Profile{WatermarkRef: "signature", Watermarks: []WatermarkLayer{{WatermarkRef: "signature"}}}},
+		{name: "missing style", profile: Profile{Watermarks: []WatermarkLayer{{Name: "handle", WatermarkRef: "missing"}}}},
+		{name: "duplicate name", profile: Profile{Watermarks: []WatermarkLayer{{WatermarkRef: "signature"}, {WatermarkRef: "signature"}}}},
+	} {
+		tt.profile.BackgroundRef, tt.profile.FormatRef = "black", "square"
+		if err := cfg.validateProfile(tt.name, tt.profile); err == nil {
+			t.Fatalf("%s: expected validation error", tt.name)
+		}
+	}
+}
+
+func TestValidateProfilePadding(t *testing.T) {
+	cfg := Config{
+		Backgrounds: map[string]Background{"black": {Type: "solid", Color: "#000000"}},
+		Formats: map[string]Format{
+			"square": {Type: "fixed", Width: 100, Height: 100},
+			"auto":   {Type: "auto", FromList: []string{"square"}},
+		},
+	}
+	px := func(v float64) Length { return Length{Value: v} }
+	pct := func(v float64) Length { return Length{Value: v, Percent: true} }
+	tests := []struct {
+		name    string
+		format  string
+		padding Padding
+		wantErr bool
+	}{
+		{name: "bottom heavy", format: "square", padding: Padding{Top: pct(5), Right: pct(5), Bottom: pct(20), Left: pct(5)}},
+		{name: "mixed units", format: "square", padding: Padding{Left: px(40), Right: pct(50)}},
+		{name: "negative side", format: "square", padding: Padding{Top: px(-1)}, wantErr: true},
+		{name: "percent fills height", format: "square", padding: Padding{Top: pct(40), Bottom: pct(60)}, wantErr: true},
+		{name: "px fill fixed width", format: "square", padding: Padding{Left: px(40), Right: pct(60)}, wantErr: true},
+		{name: "px unchecked without size", format: "auto", padding: Padding{Left: px(400)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			padding := tt.padding
+			err := cfg.validateProfile("test", Profile{BackgroundRef: "black", FormatRef: tt.format, Padding: &padding})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveProfileCaption(t *testing.T) {
+	cfg := Config{
+		Settings:    Settings{AssetsPath: t.TempDir()},
+		Backgrounds: map[string]Background{"black": {Type: "solid", Color: "#000000"}},
+		Formats:     map[string]Format{"square": {Type: "fixed", Width: 100, Height: 100}},
+		Profiles: map[string]Profile{
+			"strip": {BackgroundRef: "black", FormatRef: "square", Caption: &Caption{Font: "Roboto-Bold.ttf"}},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	resolved, err := cfg.ResolveProfile("strip")
+	if err != nil {
+		t.Fatalf("ResolveProfile: %v", err)
+	}
+	want := Caption{
+		Height:     Length{Value: DefaultCaptionHeightPercent, Percent: true},
+		Background: DefaultCaptionBackground,
+		Font:       "Roboto-Bold.ttf",
+		MutedFont:  "Roboto-Bold.ttf",
+		Color:      DefaultCaptionColor,
+		MutedColor: DefaultCaptionMutedColor,
+	}
+	if resolved.Caption == nil || *resolved.Caption != want {
+		t.Fatalf("Caption = %+v, want %+v", resolved.Caption, want)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		caption Caption
+	}{
+		{name: "no font", caption: Caption{}},
+		{name: "height", caption: Caption{Font: "a.ttf", Height: Length{Value: 50, Percent: true}}},
+		{name: "size", caption: Caption{Font: "a.ttf", Size: -1}},
+		{name: "color", caption: Caption{Font: "a.ttf", MutedColor: "gray"}},
+	} {
+		caption := tt.caption
+		if err := cfg.validateProfile(tt.name, Profile{BackgroundRef: "black", FormatRef: "square", Caption: &caption}); err == nil {
+			t.Fatalf("%s: expected validation error", tt.name)
+		}
+	}
+
+	cfg.Profiles["strip"] = Profile{BackgroundRef: "black", FormatRef: "square", Caption: &Caption{Font: "a.ttf", Logo: "maker.png"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "profiles.strip.caption.logo not found") {
+		t.Fatalf("expected missing logo error, got %v", err)
+	}
+}
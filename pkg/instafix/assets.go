@@ -0,0 +1,49 @@
+package instafix
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"sync"
+)
+
+// assetCache keeps decoded asset images for the lifetime of a Processor, so
+// textures are read once rather than on every request.
+type assetCache struct {
+	mu     sync.RWMutex
+	images map[string]image.Image
+}
+
+func newAssetCache() *assetCache {
+	return &assetCache{images: make(map[string]image.Image)}
+}
+
+// image returns the decoded image at path, loading it on first use.
+// A nil cache loads the file every time.
+func (c *assetCache) image(path string) (image.Image, error) {
+	if c != nil {
+		c.mu.RLock()
+		img, ok := c.images[path]
+		c.mu.RUnlock()
+		if ok {
+			return img, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load asset: %w", err)
+	}
+	defer f.Close()
+	decoded, err := DecodeImage(f, path)
+	if err != nil {
+		return nil, fmt.Errorf("decode asset %s: %w", path, err)
+	}
+
+	if c != nil {
+		c.mu.Lock()
+		c.images[path] = decoded.Image
+		c.mu.Unlock()
+	}
+	return decoded.Image, nil
+}
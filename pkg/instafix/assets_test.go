@@ -0,0 +1,79 @@
+package instafix
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestProcess_ImageBackground(t *testing.T) {
+	dir := t.TempDir()
+	// A 2x2 texture: red on the top row, blue on the bottom one.
+	texture := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	texture.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+	texture.SetNRGBA(1, 0, color.NRGBA{R: 255, A: 255})
+	texture.SetNRGBA(0, 1, color.NRGBA{B: 255, A: 255})
+	texture.SetNRGBA(1, 1, color.NRGBA{B: 255, A: 255})
+	f, err := os.Create(filepath.Join(dir, "paper.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, texture); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	padding := 25.0
+	cfg := config.Config{
+		Settings: config.Settings{
+			JpegQuality: 90,
+			AssetsPath:  dir,
+		},
+		Backgrounds: map[string]config.Background{
+			"tiled":  {Type: "image", Image: "paper.png", Mode: "tile"},
+			"tinted": {Type: "image", Image: "paper.png", Mode: "stretch", Tint: "#ffffff", TintOpacity: 1},
+		},
+		Formats: map[string]config.Format{
+			"square": {Type: "fixed", Width: 40, Height: 40},
+		},
+		Profiles: map[string]config.Profile{
+			"tiled":  {BackgroundRef: "tiled", FormatRef: "square", PaddingPercent: &padding},
+			"tinted": {BackgroundRef: "tinted", FormatRef: "square", PaddingPercent: &padding},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+	// The texture is cached, so the file is not needed any more.
+	if err := os.Remove(filepath.Join(dir, "paper.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	src := solidImage(20, 20, color.NRGBA{G: 255, A: 255})
+	out, _, err := processor.Process(src, "tiled", "")
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if !sameColor(out.At(4, 2), color.NRGBA{R: 255, A: 255}) || !sameColor(out.At(4, 3), color.NRGBA{B: 255, A: 255}) {
+		t.Fatalf("expected tiled texture rows, got %v and %v", out.At(4, 2), out.At(4, 3))
+	}
+
+	out, _, err = processor.Process(src, "tinted", "")
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if !sameColor(out.At(0, 0), color.NRGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Fatalf("expected full white tint, got %v", out.At(0, 0))
+	}
+
+	cfg.Backgrounds["missing"] = config.Background{Type: "image", Image: "linen.jpg"}
+	if _, err := NewProcessor(cfg); err == nil {
+		t.Fatal("expected error for a missing texture")
+	}
+}
@@ -0,0 +1,88 @@
+package instafix
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+// Caption strip layout, relative to the strip height.
+const (
+	captionTextSize  = 0.22
+	captionMutedSize = 0.8 // of the text size
+	captionLineGap   = 0.06
+	captionInset     = 0.3
+	captionLogoSize  = 0.45
+)
+
+// captionHeight returns the strip height in pixels on a canvas of the given
+// height.
+func captionHeight(cp config.Caption, canvasH int) float64 {
+	return math.Round(cp.Height.Pixels(float64(canvasH)))
+}
+
+// drawCaption fills the strip of height stripH at the bottom of dc and draws
+// the camera over the lens on the left, the exposure settings on the right
+// and the logo in the middle. Text is aligned with the photo edges, or inset
+// from the canvas edges when the photo touches them.
+func drawCaption(dc *gg.Context, cp config.Caption, info ExifInfo, stripH float64, photo image.Rectangle, assetsPath string, assets *assetCache) error {
+	w, h := float64(dc.Width()), float64(dc.Height())
+	top := h - stripH
+	setHexColor(dc, cp.Background, 1.0)
+	dc.DrawRectangle(0, top, w, stripH)
+	dc.Fill()
+
+	mid := top + stripH/2
+	if cp.Logo != "" {
+		logo, err := assets.image(config.AssetPath(assetsPath, cp.Logo))
+		if err != nil {
+			return fmt.Errorf("load caption logo: %w", err)
+		}
+		if logoH := int(math.Round(stripH * captionLogoSize)); logoH > 0 {
+			dc.DrawImageAnchored(imaging.Resize(logo, 0, logoH, imaging.Lanczos), int(w/2), int(mid), 0.5, 0.5)
+		}
+	}
+
+	inset := stripH * captionInset
+	left := math.Max(float64(photo.Min.X), inset)
+	right := math.Min(float64(photo.Max.X), w-inset)
+	size := cp.Size
+	if size == 0 {
+		size = stripH * captionTextSize
+	}
+	gap := stripH * captionLineGap
+	camera, lens, settings := info.Camera(), info.LensModel, info.Settings()
+
+	if err := dc.LoadFontFace(config.AssetPath(assetsPath, cp.Font), size); err != nil {
+		return fmt.Errorf("load caption font: %w", err)
+	}
+	setHexColor(dc, cp.Color, 1.0)
+	switch {
+	case camera != "" && lens != "":
+		dc.DrawStringAnchored(camera, left, mid-gap/2, 0, 0)
+	case camera != "":
+		dc.DrawStringAnchored(camera, left, mid, 0, 0.5)
+	}
+	if settings != "" {
+		dc.DrawStringAnchored(settings, right, mid, 1, 0.5)
+	}
+
+	if lens == "" {
+		return nil
+	}
+	if err := dc.LoadFontFace(config.AssetPath(assetsPath, cp.MutedFont), size*captionMutedSize); err != nil {
+		return fmt.Errorf("load caption font: %w", err)
+	}
+	setHexColor(dc, cp.MutedColor, 1.0)
+	if camera == "" {
+		dc.DrawStringAnchored(lens, left, mid, 0, 0.5)
+	} else {
+		dc.DrawStringAnchored(lens, left, mid+gap/2, 0, 1)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package instafix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestDecodeImage_ExifInfo(t *testing.T) {
+	app1 := append([]byte(jpegExifHeader), testCameraExif()...)
+	decoded, err := DecodeImage(bytes.NewReader(encodeTestJPEG(t, 20, 10, app1)), "photo.jpg")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	got := decoded.Exif
+	want := ExifInfo{
+		Make:         "FUJIFILM",
+		Model:        "X-T4",
+		LensModel:    "XF35mmF1.4 R",
+		FocalLength:  35,
+		FNumber:      1.4,
+		ExposureTime: 1.0 / 250,
+		ISO:          320,
+		DateTime:     time.Date(2024, 5, 17, 18, 30, 0, 0, time.UTC),
+	}
+	if got != want {
+		t.Fatalf("Exif = %+v, want %+v", got, want)
+	}
+	if camera := got.Camera(); camera != "FUJIFILM X-T4" {
+		t.Fatalf("Camera() = %q", camera)
+	}
+	if settings := got.Settings(); settings != "35mm  f/1.4  1/250s  ISO 320" {
+		t.Fatalf("Settings() = %q", settings)
+	}
+
+	plain, err := DecodeImage(bytes.NewReader(encodeTestJPEG(t, 20, 10, nil)), "plain.jpg")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if plain.Exif != (ExifInfo{}) {
+		t.Fatalf("expected empty Exif without an EXIF block, got %+v", plain.Exif)
+	}
+}
+
+func TestExifInfo_Format(t *testing.T) {
+	tests := []struct {
+		info             ExifInfo
+		camera, settings string
+	}{
+		{info: ExifInfo{Make: "Canon", Model: "Canon EOS R5", ExposureTime: 2, ISO: 100}, camera: "Canon EOS R5", settings: "2s  ISO 100"},
+		{info: ExifInfo{Make: "NIKON CORPORATION", Model: "NIKON Z 6", FocalLength: 24.5, FNumber: 8}, camera: "NIKON Z 6", settings: "24.5mm  f/8"},
+		{info: ExifInfo{Make: "Apple"}, camera: "Apple"},
+		{info: ExifInfo{ExposureTime: 0.6}, settings: "0.6s"},
+		{info: ExifInfo{ExposureTime: 0.3}, settings: "0.3s"},
+		{info: ExifInfo{ExposureTime: 1.0 / 4}, settings: "1/4s"},
+		{},
+	}
+	for _, tt := range tests {
+		if got := tt.info.Camera(); got != tt.camera {
+			t.Errorf("Camera(%+v) = %q, want %q", tt.info, got, tt.camera)
+		}
+		if got := tt.info.Settings(); got != tt.settings {
+			t.Errorf("Settings(%+v) = %q, want %q", tt.info, got, tt.settings)
+		}
+	}
+}
+
+func TestProcess_CaptionStrip(t *testing.T) {
+	cfg := config.Config{
+		Settings:    config.Settings{JpegQuality: 90, AssetsPath: "../../assets"},
+		Backgrounds: map[string]config.Background{"black": {Type: "solid", Color: "#000000"}},
+		Formats:     map[string]config.Format{"square": {Type: "fixed", Width: 200, Height: 200}},
+		Profiles: map[string]config.Profile{
+			"caption": {BackgroundRef: "black", FormatRef: "square", FitMode: config.FitCover, Caption: &config.Caption{
+				Height: config.Length{Value: 20, Percent: true},
+				Font:   "Roboto-Bold.ttf",
+			}},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+	src := solidImage(400, 400, color.NRGBA{R: 255, A: 255})
+	out, _, err := processor.ProcessWithOptions(src, "caption", ProcessOptions{Exif: ExifInfo{Model: "X100V", ISO: 200}})
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	// The photo fills the 200x160 area above a white 40px strip.
+	if got := redBounds(out); got != image.Rect(0, 0, 200, 160) {
+		t.Fatalf("photo at %v, want the area above the strip", got)
+	}
+	if !sameColor(out.At(100, 161), color.NRGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Fatalf("strip = %v, want white", out.At(100, 161))
+	}
+	// Camera text on the left, settings on the right, nothing in between.
+	if !hasDarkPixel(out, image.Rect(8, 160, 60, 200)) || !hasDarkPixel(out, image.Rect(140, 160, 192, 200)) {
+		t.Fatal("expected caption text on both sides of the strip")
+	}
+	if hasDarkPixel(out, image.Rect(90, 160, 110, 200)) {
+		t.Fatal("expected the middle of the strip to stay empty")
+	}
+}
+
+// testCameraExif builds EXIF with maker, model, date and an Exif IFD with
+// lens and exposure settings.
+func testCameraExif() []byte {
+	order := binary.BigEndian
+	rational := func(tag uint16, num, den uint32) exifEntry {
+		value := make([]byte, 8)
+		order.PutUint32(value, num)
+		order.PutUint32(value[4:], den)
+		return exifEntry{tag: tag, typ: 5, count: 1, value: value}
+	}
+	sub := &exifIFD{entries: []exifEntry{
+		rational(exifTagNames["ExposureTime"], 1, 250),
+		rational(exifTagNames["FNumber"], 14, 10),
+		asciiEntry(exifTagNames["DateTimeOriginal"], "2024:05:17 18:30:00"),
+		rational(exifTagNames["FocalLength"], 35, 1),
+		asciiEntry(exifTagNames["LensModel"], "XF35mmF1.4 R"),
+	}}
+	sub.setShort(order, exifTagNames["ISO"], 320)
+	ifd0 := &exifIFD{entries: []exifEntry{
+		asciiEntry(exifTagNames["Make"], "FUJIFILM"),
+		asciiEntry(exifTagNames["Model"], "X-T4"),
+		asciiEntry(exifTagNames["DateTime"], "2024:05:18 09:00:00"),
+		{tag: tagExifPointer, typ: 4, count: 1, sub: sub},
+	}}
+	return (&exifData{order: order, ifd0: ifd0}).encode()
+}
+
+func hasDarkPixel(img image.Image, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if c := colorToNRGBA(img.At(x, y)); c.R < 128 && c.G < 128 {
+				return true
+			}
+		}
+	}
+	return false
+}
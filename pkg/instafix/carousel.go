@@ -0,0 +1,100 @@
+package instafix
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+// MaxCarouselSlides is the number of slides Instagram allows in one carousel.
+const MaxCarouselSlides = 20
+
+// ProcessCarousel splits a wide image into carousel slides of a fixed format:
+// formatName, or the profile's format when empty. The photo is laid out on
+// one strip of N slides, so the padding (a share of the slide size) and the
+// background continue across slides and the seams line up exactly. N is the
+// number of slides the photo covers at the slide height. The caption strip
+// runs along the bottom of every slide with its text on the last slide, where
+// the watermark, if any, is drawn too.
+// It returns the slides in order and the JPEG quality to use for encoding.
+func (p *Processor) ProcessCarousel(src image.Image, profileName, formatName string, opts ProcessOptions) ([]image.Image, int, error) {
+	resolved, err := p.resolveProfile(profileName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	format, err := p.fixedFormat(&resolved, formatName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts, err = prepareProcessOptions(resolved, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	slideW, slideH := format.Width, format.Height
+	pad := paddingInsets(resolved, slideW, slideH)
+	var stripH float64
+	if resolved.Caption != nil {
+		stripH = captionHeight(*resolved.Caption, slideH)
+		pad.bottom += stripH
+	}
+	n := carouselSlideCount(src.Bounds().Dx(), src.Bounds().Dy(), slideW, slideH, pad, resolved.NoUpscale)
+
+	dc, photo, err := renderCanvas(src, resolved, n*slideW, slideH, pad, opts.Focus, p.assets)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resolved.Caption != nil {
+		setHexColor(dc, resolved.Caption.Background, 1.0)
+		dc.DrawRectangle(0, float64(slideH)-stripH, float64(n*slideW), stripH)
+		dc.Fill()
+	}
+	strip := dc.Image()
+	slides := make([]image.Image, n)
+	for i := range slides {
+		slides[i] = imaging.Crop(strip, image.Rect(i*slideW, 0, (i+1)*slideW, slideH))
+	}
+
+	if resolved.Caption != nil || len(resolved.Watermarks) > 0 {
+		last := image.Rect((n-1)*slideW, 0, n*slideW, slideH)
+		lastPhoto := photo.Intersect(last).Sub(last.Min)
+		dc = gg.NewContextForImage(slides[n-1])
+		if resolved.Caption != nil {
+			// Caption text aligns with the photo; with no photo on the last
+			// slide it is inset from the slide edges.
+			captionPhoto := lastPhoto
+			if captionPhoto.Empty() {
+				captionPhoto = image.Rect(0, 0, slideW, slideH)
+			}
+			if err := drawCaption(dc, *resolved.Caption, opts.Exif, stripH, captionPhoto, resolved.AssetsPath, p.assets); err != nil {
+				return nil, 0, err
+			}
+		}
+		areas := newWatermarkAreas(image.Rect(0, 0, slideW, slideH), lastPhoto, resolved.BorderWidth, int(stripH))
+		if err := drawWatermarks(dc, resolved, opts.Watermarks, areas, p.assets); err != nil {
+			return nil, 0, err
+		}
+		slides[n-1] = dc.Image()
+	}
+
+	return slides, resolved.JpegQuality, nil
+}
+
+// carouselSlideCount returns how many slides the photo spans once scaled to
+// the padded slide height, rounded to the nearest whole slide.
+func carouselSlideCount(srcW, srcH, slideW, slideH int, pad insets, noUpscale bool) int {
+	if srcW <= 0 || srcH <= 0 {
+		return 1
+	}
+	scale := (float64(slideH) - pad.top - pad.bottom) / float64(srcH)
+	if noUpscale && scale > 1 {
+		scale = 1
+	}
+	width := float64(srcW)*scale + pad.left + pad.right
+	n := int(math.Round(width / float64(slideW)))
+	return max(1, min(n, MaxCarouselSlides))
+}
@@ -0,0 +1,158 @@
+package instafix
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestProcessCarousel_SeamsLineUp(t *testing.T) {
+	padding := 4.0
+	cfg := config.Config{
+		Settings: config.Settings{
+			JpegQuality: 90,
+			AssetsPath:  "assets",
+		},
+		Backgrounds: map[string]config.Background{
+			"blur": {Type: "blur", BlurRadius: 5},
+		},
+		Formats: map[string]config.Format{
+			"auto":     {Type: "auto", FromList: []string{"portrait"}},
+			"portrait": {Type: "fixed", Width: 100, Height: 125},
+			"strip":    {Type: "fixed", Width: 400, Height: 125},
+		},
+		Profiles: map[string]config.Profile{
+			"default": {BackgroundRef: "blur", FormatRef: "auto"},
+			"padded":  {BackgroundRef: "blur", FormatRef: "portrait", PaddingPercent: &padding},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+
+	// A 300x100 horizontal gradient spans 3.75 slides at 125 px height.
+	src := image.NewNRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / 299), G: uint8(y * 2), B: 128, A: 255})
+		}
+	}
+
+	slides, _, err := processor.ProcessCarousel(src, "default", "portrait", ProcessOptions{})
+	if err != nil {
+		t.Fatalf("ProcessCarousel: %v", err)
+	}
+	if len(slides) != 4 {
+		t.Fatalf("expected 4 slides, got %d", len(slides))
+	}
+
+	// Put back together, the slides must equal one render of the whole strip.
+	joined := image.NewNRGBA(image.Rect(0, 0, 400, 125))
+	for i, slide := range slides {
+		if b := slide.Bounds(); b.Dx() != 100 || b.Dy() != 125 {
+			t.Fatalf("slide %d: expected 100x125, got %dx%d", i, b.Dx(), b.Dy())
+		}
+		draw.Draw(joined, image.Rect(i*100, 0, (i+1)*100, 125), slide, slide.Bounds().Min, draw.Src)
+	}
+	resolved, err := cfg.ResolveProfile("default")
+	if err != nil {
+		t.Fatalf("ResolveProfile: %v", err)
+	}
+	want, err := renderImage(src, resolved, cfg.Formats["strip"], ProcessOptions{}, nil)
+	if err != nil {
+		t.Fatalf("renderImage: %v", err)
+	}
+	for y := 0; y < 125; y++ {
+		for x := 0; x < 400; x++ {
+			if !sameColor(joined.At(x, y), color.NRGBAModel.Convert(want.At(x, y)).(color.NRGBA)) {
+				t.Fatalf("pixel %d,%d differs from the strip render", x, y)
+			}
+		}
+	}
+
+	// Padding is a share of the slide, not of the strip.
+	slides, _, err = processor.ProcessCarousel(src, "padded", "", ProcessOptions{})
+	if err != nil {
+		t.Fatalf("ProcessCarousel: %v", err)
+	}
+	if len(slides) != 4 {
+		t.Fatalf("expected 4 padded slides, got %d", len(slides))
+	}
+
+	_, _, err = processor.ProcessCarousel(src, "default", "", ProcessOptions{})
+	var userErr UserError
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError for an auto slide format, got %v", err)
+	}
+	_, _, err = processor.ProcessCarousel(src, "default", "missing", ProcessOptions{})
+	if !errors.Is(err, config.ErrFormatNotFound) {
+		t.Fatalf("expected ErrFormatNotFound, got %v", err)
+	}
+}
+
+func TestProcessCarousel_Caption(t *testing.T) {
+	cfg := config.Config{
+		Settings:    config.Settings{JpegQuality: 90, AssetsPath: "../../assets"},
+		Backgrounds: map[string]config.Background{"black": {Type: "solid", Color: "#000000"}},
+		Formats:     map[string]config.Format{"portrait": {Type: "fixed", Width: 100, Height: 125}},
+		Profiles: map[string]config.Profile{
+			"caption": {BackgroundRef: "black", FormatRef: "portrait", Caption: &config.Caption{
+				Height: config.Length{Value: 20, Percent: true},
+				Font:   "Roboto-Bold.ttf",
+			}},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+	// At the 100 px photo height left above the strip, 400x100 spans 4 slides.
+	src := solidImage(400, 100, color.NRGBA{R: 255, A: 255})
+	slides, _, err := processor.ProcessCarousel(src, "caption", "", ProcessOptions{Exif: ExifInfo{Model: "X100V", ISO: 200}})
+	if err != nil {
+		t.Fatalf("ProcessCarousel: %v", err)
+	}
+	if len(slides) != 4 {
+		t.Fatalf("expected 4 slides, got %d", len(slides))
+	}
+	strip := image.Rect(0, 100, 100, 125)
+	for i, slide := range slides {
+		if got := redBounds(slide); got != image.Rect(0, 0, 100, 100) {
+			t.Fatalf("slide %d: photo at %v, want the area above the strip", i, got)
+		}
+		if !sameColor(slide.At(50, 101), color.NRGBA{R: 255, G: 255, B: 255, A: 255}) {
+			t.Fatalf("slide %d: strip = %v, want white", i, slide.At(50, 101))
+		}
+		if text := hasDarkPixel(slide, strip); text != (i == len(slides)-1) {
+			t.Fatalf("slide %d: caption text drawn = %v, want it on the last slide only", i, text)
+		}
+	}
+}
+
+func TestCarouselSlideCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		srcW, srcH int
+		noUpscale  bool
+		want       int
+	}{
+		{name: "portrait photo", srcW: 800, srcH: 1000, want: 1},
+		{name: "three slides", srcW: 3240, srcH: 1350, want: 3},
+		{name: "rounds to nearest", srcW: 3500, srcH: 1350, want: 3},
+		{name: "no upscale keeps small photo", srcW: 1500, srcH: 300, noUpscale: true, want: 1},
+		{name: "capped", srcW: 100000, srcH: 1000, want: MaxCarouselSlides},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := carouselSlideCount(tt.srcW, tt.srcH, 1080, 1350, insets{}, tt.noUpscale)
+			if got != tt.want {
+				t.Fatalf("carouselSlideCount = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"math"
 	"strings"
 
 	"github.com/disintegration/imaging"
@@ -73,3 +74,58 @@ func averageColor(src image.Image) color.NRGBA {
 		A: 255,
 	}
 }
+
+// luminance returns the relative luminance of c (Rec. 601 weights), 0..1.
+func luminance(c color.NRGBA) float64 {
+	return (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) / 255
+}
+
+// rgbToHSL converts c to hue (0..360), saturation and lightness (0..1).
+func rgbToHSL(c color.NRGBA) (float64, float64, float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	maxC := math.Max(r, math.Max(g, b))
+	minC := math.Min(r, math.Min(g, b))
+	l := (maxC + minC) / 2
+	d := maxC - minC
+	if d == 0 {
+		return 0, 0, l
+	}
+	s := d / (1 - math.Abs(2*l-1))
+	var h float64
+	switch maxC {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, l
+}
+
+// hslToRGB converts hue (0..360), saturation and lightness (0..1) to an opaque color.
+func hslToRGB(h, s, l float64) color.NRGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.NRGBA{R: roundByte((r + m) * 255), G: roundByte((g + m) * 255), B: roundByte((b + m) * 255), A: 255}
+}
@@ -0,0 +1,170 @@
+package instafix
+
+import (
+	"image"
+	"math"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// saliencyMaxSide bounds the image the saliency map is computed on.
+	saliencyMaxSide = 160
+	// saliencyBlock is the side of the blocks local entropy is measured over.
+	saliencyBlock = 8
+)
+
+// cropToRatio crops src to the largest window with the given aspect ratio.
+// The window is centered on focus when set, on the most salient region in
+// smart mode and on the image center otherwise.
+func cropToRatio(src image.Image, ratio float64, fitMode string, focus *FocalPoint) image.Image {
+	b := src.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	cropW, cropH := srcW, srcH
+	if float64(srcW)/float64(srcH) > ratio {
+		cropW = int(math.Round(float64(srcH) * ratio))
+	} else {
+		cropH = int(math.Round(float64(srcW) / ratio))
+	}
+	cropW = max(1, min(cropW, srcW))
+	cropH = max(1, min(cropH, srcH))
+	if cropW == srcW && cropH == srcH {
+		return src
+	}
+
+	cx, cy := float64(srcW)/2, float64(srcH)/2
+	switch {
+	case focus != nil:
+		cx, cy = focus.X*float64(srcW), focus.Y*float64(srcH)
+	case fitMode == config.FitSmart:
+		cx, cy = salientCenter(src, cropW, cropH)
+	}
+
+	x0 := clampInt(int(math.Round(cx-float64(cropW)/2)), 0, srcW-cropW)
+	y0 := clampInt(int(math.Round(cy-float64(cropH)/2)), 0, srcH-cropH)
+	rect := image.Rect(x0, y0, x0+cropW, y0+cropH).Add(b.Min)
+	return imaging.Crop(src, rect)
+}
+
+// salientCenter returns the center of the cropW x cropH window of src that
+// holds the most saliency. Since the window spans src along one axis, it only
+// slides along the other; ties go to the window closest to the center.
+func salientCenter(src image.Image, cropW, cropH int) (float64, float64) {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	sal, w, h := saliencyMap(src)
+
+	horizontal := cropW < srcW
+	n, window := h, float64(cropH)/float64(srcH)*float64(h)
+	if horizontal {
+		n, window = w, float64(cropW)/float64(srcW)*float64(w)
+	}
+	profile := make([]float64, n+1) // prefix sums of saliency along the sliding axis
+	for i := 0; i < n; i++ {
+		sum := 0.0
+		if horizontal {
+			for y := 0; y < h; y++ {
+				sum += sal[y*w+i]
+			}
+		} else {
+			for x := 0; x < w; x++ {
+				sum += sal[i*w+x]
+			}
+		}
+		profile[i+1] = profile[i] + sum
+	}
+
+	size := max(1, min(n, int(math.Round(window))))
+	eps := profile[n] * 1e-6
+	mid := float64(n-size) / 2
+	best, bestScore := 0, math.Inf(-1)
+	for start := 0; start+size <= n; start++ {
+		score := profile[start+size] - profile[start]
+		closer := math.Abs(float64(start)-mid) < math.Abs(float64(best)-mid)
+		if score > bestScore+eps || (score >= bestScore-eps && closer) {
+			best, bestScore = start, score
+		}
+	}
+
+	center := (float64(best) + float64(size)/2) / float64(n)
+	if horizontal {
+		return center * float64(srcW), float64(srcH) / 2
+	}
+	return float64(srcW) / 2, center * float64(srcH)
+}
+
+// saliencyMap scores each pixel of a downscaled copy of img by its normalized
+// edge energy (luminance gradient) plus the normalized entropy of the
+// luminance histogram of its block. Flat areas score zero.
+func saliencyMap(img image.Image) ([]float64, int, int) {
+	var small *image.NRGBA
+	if b := img.Bounds(); b.Dx() > saliencyMaxSide || b.Dy() > saliencyMaxSide {
+		small = imaging.Fit(img, saliencyMaxSide, saliencyMaxSide, imaging.Box)
+	} else {
+		small = imaging.Clone(img)
+	}
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+
+	lum := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < w; x++ {
+			p := row[x*4:]
+			lum[y*w+x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	}
+
+	edge := make([]float64, w*h)
+	maxEdge := 0.0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := lum[y*w+min(x+1, w-1)] - lum[y*w+max(x-1, 0)]
+			gy := lum[min(y+1, h-1)*w+x] - lum[max(y-1, 0)*w+x]
+			e := math.Hypot(gx, gy)
+			edge[y*w+x] = e
+			maxEdge = math.Max(maxEdge, e)
+		}
+	}
+
+	sal := make([]float64, w*h)
+	for by := 0; by < h; by += saliencyBlock {
+		for bx := 0; bx < w; bx += saliencyBlock {
+			x1, y1 := min(bx+saliencyBlock, w), min(by+saliencyBlock, h)
+			var hist [16]int
+			for y := by; y < y1; y++ {
+				for x := bx; x < x1; x++ {
+					hist[min(int(lum[y*w+x])/16, 15)]++
+				}
+			}
+			total := float64((x1 - bx) * (y1 - by))
+			entropy := 0.0
+			for _, c := range hist {
+				if c > 0 {
+					p := float64(c) / total
+					entropy -= p * math.Log2(p)
+				}
+			}
+			for y := by; y < y1; y++ {
+				for x := bx; x < x1; x++ {
+					s := entropy / 4 // log2(16) bins
+					if maxEdge > 0 {
+						s += edge[y*w+x] / maxEdge
+					}
+					sal[y*w+x] = s
+				}
+			}
+		}
+	}
+	return sal, w, h
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -2,80 +2,335 @@ package instafix
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"image/gif"
 	"io"
 	"path/filepath"
 	"strings"
 
 	"github.com/disintegration/imaging"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
 )
 
+// Input containers detected by DecodeImage.
+const (
+	ContainerJPEG = "jpeg"
+	ContainerPNG  = "png"
+	ContainerGIF  = "gif"
+	ContainerWebP = "webp"
+	ContainerBMP  = "bmp"
+	ContainerHEIC = "heic"
+	ContainerTIFF = "tiff"
+	ContainerDNG  = "dng"
+	ContainerCR2  = "cr2"
+	ContainerNEF  = "nef"
+	ContainerARW  = "arw"
+	ContainerORF  = "orf"
+	ContainerRAF  = "raf"
+	ContainerPEF  = "pef"
+)
+
+// Decoded is a decoded source image with information about its container.
+type Decoded struct {
+	Image image.Image
+	// Container is the detected input format, e.g. "jpeg", "png" or "dng".
+	Container string
+	// Preview is set when the image is an embedded preview of a RAW file.
+	Preview *RawPreview
+	// Metadata holds the EXIF/XMP/IPTC blocks of the source file and the ICC
+	// profile of Image.
+	Metadata Metadata
+	// Exif holds the camera, lens and exposure details parsed from
+	// Metadata.EXIF, for captions.
+	Exif ExifInfo
+	// ColorProfile is the description of the source ICC profile, if any.
+	ColorProfile string
+}
+
+// Default decode limits, used when the matching DecodeOptions field is zero.
+const (
+	DefaultMaxBytes     = 100 << 20
+	DefaultMaxPixels    = 50_000_000
+	DefaultMaxDimension = 20000
+)
+
+var (
+	// ErrInputTooLarge means the encoded input exceeds DecodeOptions.MaxBytes.
+	ErrInputTooLarge = errors.New("input too large")
+	// ErrImageTooLarge means the image header exceeds the pixel or dimension limits.
+	ErrImageTooLarge = errors.New("image too large")
+	// ErrUnsupportedCodec means the container was recognized but its image
+	// data uses a codec with no decoder available, e.g. HEVC in HEIC.
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+)
+
+// DecodeOptions tunes how DecodeImageWithOptions reads the input.
+// Zero limits use the package defaults; negative limits disable the check.
+type DecodeOptions struct {
+	// Page selects the page of a multi-page TIFF (0 is the first page).
+	Page int
+	// MaxBytes limits the size of the encoded input.
+	MaxBytes int64
+	// MaxPixels limits width*height of the image to decode.
+	MaxPixels int64
+	// MaxWidth and MaxHeight limit each dimension of the image to decode.
+	MaxWidth  int
+	MaxHeight int
+	// KeepColorProfile skips the conversion to sRGB and keeps the source ICC profile.
+	KeepColorProfile bool
+}
+
+func (o DecodeOptions) withDefaults() DecodeOptions {
+	if o.MaxBytes == 0 {
+		o.MaxBytes = DefaultMaxBytes
+	}
+	if o.MaxPixels == 0 {
+		o.MaxPixels = DefaultMaxPixels
+	}
+	if o.MaxWidth == 0 {
+		o.MaxWidth = DefaultMaxDimension
+	}
+	if o.MaxHeight == 0 {
+		o.MaxHeight = DefaultMaxDimension
+	}
+	return o
+}
+
+// checkSize validates image dimensions read from a header before decoding.
+func (o DecodeOptions) checkSize(w, h int) error {
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("invalid image size: %dx%d", w, h)
+	}
+	if o.MaxWidth > 0 && w > o.MaxWidth {
+		return UserError{Err: fmt.Errorf("%w: width %d exceeds %d", ErrImageTooLarge, w, o.MaxWidth)}
+	}
+	if o.MaxHeight > 0 && h > o.MaxHeight {
+		return UserError{Err: fmt.Errorf("%w: height %d exceeds %d", ErrImageTooLarge, h, o.MaxHeight)}
+	}
+	if o.MaxPixels > 0 && int64(w)*int64(h) > o.MaxPixels {
+		return UserError{Err: fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrImageTooLarge, w, h, o.MaxPixels)}
+	}
+	return nil
+}
+
+// checkConfig reads the image header and validates its size. Headers the
+// standard decoders cannot parse are left to the full decode to report.
+func (o DecodeOptions) checkConfig(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return o.checkSize(cfg.Width, cfg.Height)
+}
+
 // DecodeImage reads image data and handles common formats plus DNG/RAW previews.
-func DecodeImage(r io.Reader, filename string) (image.Image, error) {
-	data, err := io.ReadAll(r)
+func DecodeImage(r io.Reader, filename string) (*Decoded, error) {
+	return DecodeImageWithOptions(r, filename, DecodeOptions{})
+}
+
+// DecodeImageWithOptions is DecodeImage with explicit decode options.
+// The container is detected from magic bytes; the filename extension is
+// only used to route unrecognized data to the RAW preview extractor.
+// Pixels with an embedded RGB ICC profile are converted to sRGB unless
+// opts.KeepColorProfile is set.
+func DecodeImageWithOptions(r io.Reader, filename string, opts DecodeOptions) (*Decoded, error) {
+	opts = opts.withDefaults()
+	data, err := readLimited(r, opts.MaxBytes)
 	if err != nil {
-		return nil, fmt.Errorf("read image: %w", err)
+		return nil, err
 	}
+	decoded, err := decodeData(data, filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded.Metadata = extractMetadata(data, decoded.Container)
+	decoded.Exif = parseExifInfo(decoded.Metadata.EXIF)
+	icc := extractICC(data, decoded)
+	if iccColorSpace(icc) != "RGB " {
+		// Gray and CMYK profiles do not describe the RGB pixels we produce.
+		return decoded, nil
+	}
+	if prof, err := parseICC(icc); err == nil {
+		decoded.ColorProfile = prof.description
+	}
+	decoded.Metadata.ICC = icc
+	if !opts.KeepColorProfile {
+		if img, ok := convertToSRGB(decoded.Image, icc); ok {
+			decoded.Image = img
+			decoded.Metadata.ICC = srgbICC()
+		}
+	}
+	return decoded, nil
+}
 
+func decodeData(data []byte, filename string, opts DecodeOptions) (*Decoded, error) {
+	container := sniffContainer(data)
 	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".dng", ".raw":
-		return decodeDNGPreview(data)
+	if isRawContainer(container) || (rawExtensions[ext] && (container == "" || container == ContainerTIFF)) {
+		return decodeRaw(data, opts)
+	}
+
+	switch container {
+	case ContainerTIFF, ContainerHEIC:
+		// Size is checked per page or item while decoding.
 	default:
-		img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
-		if err == nil {
-			return img, nil
+		if err := opts.checkConfig(data); err != nil {
+			return nil, err
 		}
-		// Fallback: try to parse embedded JPEG if body contains one (Tasker/raw uploads).
-		if preview, perr := decodeDNGPreview(data); perr == nil {
-			return preview, nil
+	}
+
+	var img image.Image
+	var err error
+	switch container {
+	case ContainerGIF:
+		// gif.Decode returns the first frame of animated images.
+		img, err = gif.Decode(bytes.NewReader(data))
+	case ContainerWebP:
+		img, err = webp.Decode(bytes.NewReader(data))
+	case ContainerBMP:
+		img, err = bmp.Decode(bytes.NewReader(data))
+	case ContainerTIFF:
+		img, err = decodeTIFFPage(data, opts)
+	case ContainerHEIC:
+		img, err = decodeHEIF(data, opts)
+	default:
+		img, err = imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	}
+	if err == nil {
+		if container == "" {
+			_, container, _ = image.DecodeConfig(bytes.NewReader(data))
 		}
+		return &Decoded{Image: img, Container: container}, nil
+	}
+	var userErr UserError
+	if errors.As(err, &userErr) {
 		return nil, err
 	}
+	// Fallback: try to parse embedded JPEG if body contains one (Tasker/raw uploads).
+	if decoded, perr := decodeRaw(data, opts); perr == nil {
+		if container != "" {
+			decoded.Container = container
+		}
+		return decoded, nil
+	}
+	if errors.Is(err, ErrUnsupportedCodec) {
+		return nil, UserError{Err: fmt.Errorf("decode %s: %w", container, err)}
+	}
+	if container != "" {
+		return nil, fmt.Errorf("decode %s: %w", container, err)
+	}
+	return nil, err
 }
 
-func decodeDNGPreview(data []byte) (image.Image, error) {
-	candidates := extractJPEGs(data)
-	if len(candidates) == 0 {
-		return nil, fmt.Errorf("no embedded JPEG preview found in DNG")
+func readLimited(r io.Reader, maxBytes int64) ([]byte, error) {
+	if maxBytes > 0 {
+		r = io.LimitReader(r, maxBytes+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read image: %w", err)
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, UserError{Err: fmt.Errorf("%w: exceeds %d bytes", ErrInputTooLarge, maxBytes)}
 	}
+	return data, nil
+}
 
-	var best image.Image
-	bestArea := 0
-	for _, candidate := range candidates {
-		img, err := imaging.Decode(bytes.NewReader(candidate), imaging.AutoOrientation(true))
-		if err != nil {
-			continue
-		}
-		area := img.Bounds().Dx() * img.Bounds().Dy()
-		if area > bestArea {
-			bestArea = area
-			best = img
-		}
+// sniffContainer detects the image container from its leading bytes.
+func sniffContainer(data []byte) string {
+	switch {
+	case len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+		return ContainerJPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ContainerPNG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return ContainerGIF
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return ContainerWebP
+	case len(data) >= 26 && string(data[:2]) == "BM":
+		return ContainerBMP
+	case isHEIF(data):
+		return ContainerHEIC
 	}
-	if best == nil {
-		return nil, fmt.Errorf("failed to decode embedded JPEG preview")
+	if raw := detectRawContainer(data); raw != "" {
+		return raw
+	}
+	if bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")) {
+		return ContainerTIFF
+	}
+	return ""
+}
+
+func isRawContainer(container string) bool {
+	switch container {
+	case ContainerDNG, ContainerCR2, ContainerNEF, ContainerARW, ContainerORF, ContainerRAF, ContainerPEF:
+		return true
+	default:
+		return false
 	}
-	return best, nil
 }
 
-func extractJPEGs(data []byte) [][]byte {
-	var results [][]byte
-	for i := 0; i < len(data)-1; i++ {
-		if data[i] != 0xFF || data[i+1] != 0xD8 {
-			continue
+// decodeTIFFPage decodes one page of a (possibly multi-page) TIFF and applies
+// the orientation stored in that page's IFD.
+func decodeTIFFPage(data []byte, opts DecodeOptions) (image.Image, error) {
+	page := opts.Page
+	if page < 0 || page >= tiffMaxPages {
+		return nil, UserError{Err: fmt.Errorf("invalid tiff page: %d (must be 0..%d)", page, tiffMaxPages-1)}
+	}
+	t, err := newTIFFReader(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	off := t.first
+	visited := map[int]bool{off: true}
+	for i := 0; i < page; i++ {
+		ifd, err := t.readIFD(off)
+		if err != nil {
+			return nil, err
 		}
-		j := bytes.Index(data[i+2:], []byte{0xFF, 0xD9})
-		if j == -1 {
-			continue
+		if ifd.next == 0 {
+			return nil, UserError{Err: fmt.Errorf("tiff page %d out of range (%d pages)", page, i+1)}
 		}
-		end := i + 2 + j + 2
-		if end > len(data) {
-			continue
+		if visited[ifd.next] {
+			return nil, fmt.Errorf("tiff IFD chain loops at offset %d", ifd.next)
 		}
-		results = append(results, data[i:end])
-		i = end - 1
+		visited[ifd.next] = true
+		off = ifd.next
+	}
+	ifd, err := t.readIFD(off)
+	if err != nil {
+		return nil, err
+	}
+
+	// The TIFF decoder only reads the first IFD, so point the header at the
+	// requested page. IFD offsets are absolute, so nothing else needs patching.
+	src := data
+	if off != t.first {
+		src = append([]byte(nil), data...)
+		t.order.PutUint32(src[4:], uint32(off))
+	}
+	if err := opts.checkConfig(src); err != nil {
+		return nil, err
+	}
+	img, err := tiff.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	if orient, ok := t.uint(ifd, tagOrientation); ok {
+		img = applyOrientation(img, int(orient))
+	}
+	return img, nil
+}
+
+func decodeRaw(data []byte, opts DecodeOptions) (*Decoded, error) {
+	img, preview, err := decodeRawPreview(data, opts)
+	if err != nil {
+		return nil, err
 	}
-	return results
+	return &Decoded{Image: img, Container: preview.Container, Preview: &preview}, nil
 }
@@ -2,10 +2,18 @@ package instafix
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"os"
 	"testing"
+
+	"golang.org/x/image/bmp"
 )
 
 func TestDecodeImage_DNGPreview(t *testing.T) {
@@ -28,7 +36,604 @@ func TestDecodeImage_DNGPreview(t *testing.T) {
 	if err != nil {
 		t.Fatalf("DecodeImage: %v", err)
 	}
-	if decoded.Bounds().Dx() != 32 || decoded.Bounds().Dy() != 24 {
-		t.Fatalf("unexpected decoded size: %dx%d", decoded.Bounds().Dx(), decoded.Bounds().Dy())
+	if decoded.Image.Bounds().Dx() != 32 || decoded.Image.Bounds().Dy() != 24 {
+		t.Fatalf("unexpected decoded size: %dx%d", decoded.Image.Bounds().Dx(), decoded.Image.Bounds().Dy())
+	}
+}
+
+func TestDecodeImage_DNGPicksLargestIFDPreview(t *testing.T) {
+	thumb := encodeTestJPEG(t, 16, 12, nil)
+	large := encodeTestJPEG(t, 64, 48, nil)
+
+	// Layout: header, IFD0 (DNGVersion + SubIFDs), IFD1 (thumbnail), SubIFD0 (preview strip).
+	const ifd0, ifd1, sub0, payload = 8, 38, 68, 110
+	thumbOff := payload
+	largeOff := payload + len(thumb)
+
+	var buf bytes.Buffer
+	buf.WriteString("II*\x00")
+	writeLE32(&buf, ifd0)
+	writeIFD(&buf, ifd1,
+		tiffTestEntry{tagDNGVersion, 1, 4, 0x00000401},
+		tiffTestEntry{tagSubIFDs, 4, 1, sub0},
+	)
+	writeIFD(&buf, 0,
+		tiffTestEntry{tagJPEGInterchangeFormat, 4, 1, uint32(thumbOff)},
+		tiffTestEntry{tagJPEGInterchangeFormatLength, 4, 1, uint32(len(thumb))},
+	)
+	writeIFD(&buf, 0,
+		tiffTestEntry{tagCompression, 3, 1, 7},
+		tiffTestEntry{tagStripOffsets, 4, 1, uint32(largeOff)},
+		tiffTestEntry{tagStripByteCounts, 4, 1, uint32(len(large))},
+	)
+	if buf.Len() != payload {
+		t.Fatalf("unexpected header layout size: %d", buf.Len())
+	}
+	buf.Write(thumb)
+	buf.Write(large)
+
+	// No extension: the container must be detected from the TIFF tags.
+	decoded, err := DecodeImage(bytes.NewReader(buf.Bytes()), "")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.Image.Bounds().Dx() != 64 || decoded.Image.Bounds().Dy() != 48 {
+		t.Fatalf("expected largest preview, got %dx%d", decoded.Image.Bounds().Dx(), decoded.Image.Bounds().Dy())
+	}
+	if decoded.Preview == nil {
+		t.Fatal("expected preview info")
+	}
+	if decoded.Preview.Container != ContainerDNG || decoded.Preview.IFD != "IFD0/SubIFD0" {
+		t.Fatalf("unexpected preview source: %s %s", decoded.Preview.Container, decoded.Preview.IFD)
+	}
+}
+
+func TestDecodeImage_NestedThumbnailDoesNotTruncatePreview(t *testing.T) {
+	thumb := encodeTestJPEG(t, 8, 8, nil)
+	// Wrap the thumbnail in an APP1 segment the way EXIF stores IFD1 thumbnails.
+	app1 := append([]byte("Exif\x00\x00"), thumb...)
+	preview := encodeTestJPEG(t, 40, 30, app1)
+
+	payload := append([]byte("ORFAKE"), preview...)
+	decoded, err := DecodeImage(bytes.NewReader(payload), "test.orf")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.Image.Bounds().Dx() != 40 || decoded.Image.Bounds().Dy() != 30 {
+		t.Fatalf("unexpected decoded size: %dx%d", decoded.Image.Bounds().Dx(), decoded.Image.Bounds().Dy())
+	}
+}
+
+func TestDecodeImage_Formats(t *testing.T) {
+	tiffPages := buildGrayTIFF(t, [][2]int{{20, 10}, {12, 30}})
+
+	tests := []struct {
+		name          string
+		data          []byte
+		filename      string
+		opts          DecodeOptions
+		wantContainer string
+		wantW, wantH  int
+	}{
+		{name: "webp lossy", data: readTestdata(t, "blue-purple-pink.lossy.webp"), wantContainer: ContainerWebP, wantW: 150, wantH: 100},
+		{name: "webp lossless", data: readTestdata(t, "gopher-doc.1bpp.lossless.webp"), wantContainer: ContainerWebP, wantW: 75, wantH: 100},
+		{name: "webp with wrong extension", data: readTestdata(t, "blue-purple-pink.lossy.webp"), filename: "photo.jpg", wantContainer: ContainerWebP, wantW: 150, wantH: 100},
+		{name: "tiff first page", data: tiffPages, wantContainer: ContainerTIFF, wantW: 20, wantH: 10},
+		{name: "tiff second page", data: tiffPages, filename: "scan.tif", opts: DecodeOptions{Page: 1}, wantContainer: ContainerTIFF, wantW: 12, wantH: 30},
+		{name: "bmp", data: encodeTestBMP(t, 17, 9), wantContainer: ContainerBMP, wantW: 17, wantH: 9},
+		{name: "gif first frame", data: encodeTestGIF(t, 14, 6), wantContainer: ContainerGIF, wantW: 14, wantH: 6},
+		{name: "jpeg", data: encodeTestJPEG(t, 10, 5, nil), wantContainer: ContainerJPEG, wantW: 10, wantH: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := DecodeImageWithOptions(bytes.NewReader(tt.data), tt.filename, tt.opts)
+			if err != nil {
+				t.Fatalf("DecodeImageWithOptions: %v", err)
+			}
+			if decoded.Container != tt.wantContainer {
+				t.Fatalf("expected container %s, got %s", tt.wantContainer, decoded.Container)
+			}
+			b := decoded.Image.Bounds()
+			if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Fatalf("expected %dx%d, got %dx%d", tt.wantW, tt.wantH, b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestDecodeImage_TIFFPageOutOfRange(t *testing.T) {
+	data := buildGrayTIFF(t, [][2]int{{4, 4}})
+	_, err := DecodeImageWithOptions(bytes.NewReader(data), "", DecodeOptions{Page: 3})
+	if err == nil {
+		t.Fatal("expected error for missing tiff page")
+	}
+	var userErr UserError
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError, got %v", err)
+	}
+}
+
+func TestDecodeImage_TIFFManyPages(t *testing.T) {
+	sizes := make([][2]int, 40)
+	for i := range sizes {
+		sizes[i] = [2]int{4, i + 1}
+	}
+	data := buildGrayTIFF(t, sizes)
+	decoded, err := DecodeImageWithOptions(bytes.NewReader(data), "", DecodeOptions{Page: 30})
+	if err != nil {
+		t.Fatalf("DecodeImageWithOptions: %v", err)
+	}
+	if h := decoded.Image.Bounds().Dy(); h != 31 {
+		t.Fatalf("expected page 30 (height 31), got height %d", h)
+	}
+}
+
+func TestDecodeImage_TIFFPageAboveLimit(t *testing.T) {
+	data := buildGrayTIFF(t, [][2]int{{4, 4}})
+	_, err := DecodeImageWithOptions(bytes.NewReader(data), "", DecodeOptions{Page: 1 << 30})
+	var userErr UserError
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError, got %v", err)
+	}
+}
+
+func TestDecodeImage_TIFFPageChainLoop(t *testing.T) {
+	data := buildGrayTIFF(t, [][2]int{{4, 4}})
+	// Point the only IFD's next offset back at itself.
+	first := binary.LittleEndian.Uint32(data[4:])
+	count := binary.LittleEndian.Uint16(data[first:])
+	binary.LittleEndian.PutUint32(data[int(first)+2+12*int(count):], first)
+
+	_, err := DecodeImageWithOptions(bytes.NewReader(data), "", DecodeOptions{Page: 5})
+	if err == nil {
+		t.Fatal("expected error for a looping IFD chain")
+	}
+}
+
+func TestDecodeImage_HEIFJPEGItemWithExifOrientation(t *testing.T) {
+	exif := buildExifOrientation(6)
+	data := buildTestHEIF([]heifTestItem{
+		{id: 1, typ: "jpeg", payload: encodeTestJPEG(t, 20, 10, nil)},
+		{id: 2, typ: "Exif", payload: exif, refType: "cdsc", refTo: 1},
+	}, 1, nil)
+
+	decoded, err := DecodeImage(bytes.NewReader(data), "IMG_0001.HEIC")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.Container != ContainerHEIC {
+		t.Fatalf("expected heic container, got %s", decoded.Container)
+	}
+	// Orientation 6 rotates the 20x10 item into portrait.
+	if decoded.Image.Bounds().Dx() != 10 || decoded.Image.Bounds().Dy() != 20 {
+		t.Fatalf("unexpected decoded size: %dx%d", decoded.Image.Bounds().Dx(), decoded.Image.Bounds().Dy())
+	}
+}
+
+func TestDecodeImage_HEIFIrotOverridesExif(t *testing.T) {
+	data := buildTestHEIF([]heifTestItem{
+		{id: 1, typ: "jpeg", payload: encodeTestJPEG(t, 20, 10, nil), props: []int{1}},
+		{id: 2, typ: "Exif", payload: buildExifOrientation(1), refType: "cdsc", refTo: 1},
+	}, 1, [][]byte{bmffBoxBytes("irot", []byte{1})})
+
+	decoded, err := DecodeImage(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.Image.Bounds().Dx() != 10 || decoded.Image.Bounds().Dy() != 20 {
+		t.Fatalf("expected irot to rotate the item, got %dx%d", decoded.Image.Bounds().Dx(), decoded.Image.Bounds().Dy())
+	}
+}
+
+func TestDecodeImage_HEVCFallsBackToThumbnail(t *testing.T) {
+	data := buildTestHEIF([]heifTestItem{
+		{id: 1, typ: "hvc1", payload: []byte{0, 0, 0, 1, 0x26}},
+		{id: 2, typ: "jpeg", payload: encodeTestJPEG(t, 16, 12, nil), refType: "thmb", refTo: 1},
+	}, 1, nil)
+
+	decoded, err := DecodeImage(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.Image.Bounds().Dx() != 16 || decoded.Image.Bounds().Dy() != 12 {
+		t.Fatalf("expected thumbnail, got %dx%d", decoded.Image.Bounds().Dx(), decoded.Image.Bounds().Dy())
+	}
+	if decoded.Preview != nil {
+		t.Fatal("expected the HEIF thumbnail item, not a scanned JPEG")
+	}
+}
+
+func TestDecodeImage_HEVCWithoutDecoder(t *testing.T) {
+	data := buildTestHEIF([]heifTestItem{
+		{id: 1, typ: "hvc1", payload: []byte{0, 0, 0, 1, 0x26}},
+	}, 1, nil)
+
+	_, err := DecodeImage(bytes.NewReader(data), "")
+	var userErr UserError
+	if !errors.As(err, &userErr) || !errors.Is(err, ErrUnsupportedCodec) {
+		t.Fatalf("expected UserError wrapping ErrUnsupportedCodec, got %v", err)
+	}
+}
+
+func TestDecodeImage_HEVCUsesRegisteredDecoder(t *testing.T) {
+	RegisterHEVCDecoder(func(config, data []byte) (image.Image, error) {
+		if !bytes.Equal(config, []byte{1, 2, 3}) {
+			t.Errorf("unexpected hvcC payload: %v", config)
+		}
+		return image.NewNRGBA(image.Rect(0, 0, 30, 20)), nil
+	})
+	defer RegisterHEVCDecoder(nil)
+
+	data := buildTestHEIF([]heifTestItem{
+		{id: 1, typ: "hvc1", payload: []byte{0, 0, 0, 1, 0x26}, props: []int{1}},
+	}, 1, [][]byte{bmffBoxBytes("hvcC", []byte{1, 2, 3})})
+
+	decoded, err := DecodeImage(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.Image.Bounds().Dx() != 30 || decoded.Image.Bounds().Dy() != 20 {
+		t.Fatalf("unexpected decoded size: %dx%d", decoded.Image.Bounds().Dx(), decoded.Image.Bounds().Dy())
+	}
+}
+
+func TestDecodeImage_HEIFSelfReferencingGrid(t *testing.T) {
+	// Primary grid item 1 lists itself as its only dimg tile; the 1x1 grid
+	// descriptor lives in idat.
+	infe := bmffBoxBytes("infe", []byte{2, 0, 0, 0, 0, 1, 0, 0, 'g', 'r', 'i', 'd', 0})
+	meta := bytes.Join([][]byte{
+		{0, 0, 0, 0},
+		bmffBoxBytes("pitm", []byte{0, 0, 0, 0, 0, 1}),
+		bmffBoxBytes("iinf", append([]byte{0, 0, 0, 0, 0, 1}, infe...)),
+		bmffBoxBytes("iloc", []byte{1, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 1, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 8}),
+		bmffBoxBytes("iref", append([]byte{0, 0, 0, 0}, bmffBoxBytes("dimg", []byte{0, 1, 0, 1, 0, 1})...)),
+		bmffBoxBytes("idat", []byte{0, 0, 0, 0, 0, 1, 0, 1}),
+	}, nil)
+	data := append(bmffBoxBytes("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")), bmffBoxBytes("meta", meta)...)
+
+	if _, err := DecodeImage(bytes.NewReader(data), "loop.heic"); err == nil {
+		t.Fatal("expected an error for a grid that references itself")
+	}
+}
+
+func TestDecodeHEIF_GridTileSizes(t *testing.T) {
+	ispe := func(w, h uint32) []byte {
+		data := make([]byte, 12)
+		binary.BigEndian.PutUint32(data[4:], w)
+		binary.BigEndian.PutUint32(data[8:], h)
+		return bmffBoxBytes("ispe", data)
+	}
+	grid := []byte{0, 0, 0, 0, 0, 16, 0, 12} // 1x1 grid, 16x12
+	tile := encodeTestJPEG(t, 16, 12, nil)
+
+	tests := []struct {
+		name    string
+		props   []int
+		wantErr bool
+	}{
+		{name: "matching ispe", props: []int{1}},
+		{name: "missing ispe", wantErr: true},
+		{name: "tile smaller than grid", props: []int{2}, wantErr: true},
+		{name: "tile far larger than grid", props: []int{3}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildTestHEIF([]heifTestItem{
+				{id: 1, typ: "grid", payload: grid, refType: "dimg", refTo: 2},
+				{id: 2, typ: "jpeg", payload: tile, props: tt.props},
+			}, 1, [][]byte{ispe(16, 12), ispe(8, 12), ispe(40, 12)})
+
+			// decodeHEIF directly: DecodeImage would fall back to the
+			// JPEG tile found by scanning the file.
+			img, err := decodeHEIF(data, DecodeOptions{}.withDefaults())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeHEIF: %v", err)
+			}
+			if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 12 {
+				t.Fatalf("unexpected decoded size: %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestHEIFPayloadCappedAtSourceSize(t *testing.T) {
+	f := &heifFile{data: make([]byte, 100)}
+	// Zero-length extents run to the end of the file; repeating one must
+	// not multiply the payload.
+	item := &heifItem{id: 1, extents: [][2]uint64{{0, 0}, {0, 0}, {0, 0}}}
+	if _, err := f.payload(item); err == nil {
+		t.Fatal("expected an error for extents larger than the file")
+	}
+}
+
+func TestDecodeImage_Limits(t *testing.T) {
+	jpegData := encodeTestJPEG(t, 300, 200, nil)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		opts    DecodeOptions
+		wantErr error
+	}{
+		{name: "within limits", data: jpegData, opts: DecodeOptions{MaxPixels: 60000, MaxWidth: 300, MaxHeight: 200}},
+		{name: "max bytes", data: jpegData, opts: DecodeOptions{MaxBytes: 100}, wantErr: ErrInputTooLarge},
+		{name: "max pixels", data: jpegData, opts: DecodeOptions{MaxPixels: 10000}, wantErr: ErrImageTooLarge},
+		{name: "max width", data: jpegData, opts: DecodeOptions{MaxWidth: 299}, wantErr: ErrImageTooLarge},
+		{name: "crafted png header", data: craftedPNGHeader(t, 100000, 100000), wantErr: ErrImageTooLarge},
+		{name: "raw preview over limit", data: append([]byte("DNGFAKE"), jpegData...), opts: DecodeOptions{MaxHeight: 100}, wantErr: ErrImageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := ""
+			if bytes.HasPrefix(tt.data, []byte("DNGFAKE")) {
+				filename = "test.dng"
+			}
+			_, err := DecodeImageWithOptions(bytes.NewReader(tt.data), filename, tt.opts)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			var userErr UserError
+			if !errors.As(err, &userErr) {
+				t.Fatalf("expected UserError, got %T", err)
+			}
+		})
+	}
+}
+
+// craftedPNGHeader returns a tiny PNG whose IHDR claims the given size.
+func craftedPNGHeader(t *testing.T, w, h uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	data := buf.Bytes()
+	// IHDR payload starts after the 8-byte signature and the chunk length/type.
+	binary.BigEndian.PutUint32(data[16:], w)
+	binary.BigEndian.PutUint32(data[20:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+type heifTestItem struct {
+	id      uint16
+	typ     string
+	payload []byte
+	refType string
+	refTo   uint16
+	props   []int // 1-based indices into the ipco property list
+}
+
+// buildTestHEIF assembles a minimal HEIF file: ftyp, meta (pitm, iinf, iloc,
+// iref, iprp) and an mdat holding all item payloads.
+func buildTestHEIF(items []heifTestItem, primary uint16, props [][]byte) []byte {
+	ftyp := bmffBoxBytes("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+
+	buildMeta := func(mdatStart int) []byte {
+		var iinf bytes.Buffer
+		binary.Write(&iinf, binary.BigEndian, uint32(0))
+		binary.Write(&iinf, binary.BigEndian, uint16(len(items)))
+		for _, it := range items {
+			var infe bytes.Buffer
+			infe.Write([]byte{2, 0, 0, 0})
+			binary.Write(&infe, binary.BigEndian, it.id)
+			binary.Write(&infe, binary.BigEndian, uint16(0))
+			infe.WriteString(it.typ)
+			infe.WriteByte(0)
+			iinf.Write(bmffBoxBytes("infe", infe.Bytes()))
+		}
+
+		var iloc bytes.Buffer
+		iloc.Write([]byte{0, 0, 0, 0, 0x44, 0x00})
+		binary.Write(&iloc, binary.BigEndian, uint16(len(items)))
+		off := mdatStart
+		for _, it := range items {
+			binary.Write(&iloc, binary.BigEndian, it.id)
+			binary.Write(&iloc, binary.BigEndian, uint16(0))
+			binary.Write(&iloc, binary.BigEndian, uint16(1))
+			binary.Write(&iloc, binary.BigEndian, uint32(off))
+			binary.Write(&iloc, binary.BigEndian, uint32(len(it.payload)))
+			off += len(it.payload)
+		}
+
+		var iref bytes.Buffer
+		iref.Write([]byte{0, 0, 0, 0})
+		for _, it := range items {
+			if it.refType == "" {
+				continue
+			}
+			var ref bytes.Buffer
+			binary.Write(&ref, binary.BigEndian, it.id)
+			binary.Write(&ref, binary.BigEndian, uint16(1))
+			binary.Write(&ref, binary.BigEndian, it.refTo)
+			iref.Write(bmffBoxBytes(it.refType, ref.Bytes()))
+		}
+
+		var ipma bytes.Buffer
+		ipma.Write([]byte{0, 0, 0, 0})
+		binary.Write(&ipma, binary.BigEndian, uint32(len(items)))
+		for _, it := range items {
+			binary.Write(&ipma, binary.BigEndian, it.id)
+			ipma.WriteByte(byte(len(it.props)))
+			for _, p := range it.props {
+				ipma.WriteByte(byte(p))
+			}
+		}
+		var iprp bytes.Buffer
+		iprp.Write(bmffBoxBytes("ipco", bytes.Join(props, nil)))
+		iprp.Write(bmffBoxBytes("ipma", ipma.Bytes()))
+
+		var pitm bytes.Buffer
+		pitm.Write([]byte{0, 0, 0, 0})
+		binary.Write(&pitm, binary.BigEndian, primary)
+
+		var meta bytes.Buffer
+		meta.Write([]byte{0, 0, 0, 0})
+		meta.Write(bmffBoxBytes("pitm", pitm.Bytes()))
+		meta.Write(bmffBoxBytes("iinf", iinf.Bytes()))
+		meta.Write(bmffBoxBytes("iloc", iloc.Bytes()))
+		meta.Write(bmffBoxBytes("iref", iref.Bytes()))
+		meta.Write(bmffBoxBytes("iprp", iprp.Bytes()))
+		return bmffBoxBytes("meta", meta.Bytes())
+	}
+
+	metaLen := len(buildMeta(0))
+	meta := buildMeta(len(ftyp) + metaLen + 8)
+
+	var mdat bytes.Buffer
+	for _, it := range items {
+		mdat.Write(it.payload)
+	}
+	out := append(ftyp, meta...)
+	return append(out, bmffBoxBytes("mdat", mdat.Bytes())...)
+}
+
+func bmffBoxBytes(typ string, payload []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(payload)+8))
+	buf.WriteString(typ)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// buildExifOrientation builds a HEIF Exif item payload with an orientation tag.
+func buildExifOrientation(orient uint32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(6))
+	buf.WriteString("Exif\x00\x00")
+	buf.WriteString("II*\x00")
+	writeLE32(&buf, 8)
+	writeIFD(&buf, 0, tiffTestEntry{tagOrientation, 3, 1, orient})
+	return buf.Bytes()
+}
+
+type tiffTestEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value uint32
+}
+
+func writeIFD(buf *bytes.Buffer, next uint32, entries ...tiffTestEntry) {
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, binary.LittleEndian, e.tag)
+		binary.Write(buf, binary.LittleEndian, e.typ)
+		binary.Write(buf, binary.LittleEndian, e.count)
+		binary.Write(buf, binary.LittleEndian, e.value)
+	}
+	writeLE32(buf, next)
+}
+
+func writeLE32(buf *bytes.Buffer, v uint32) {
+	binary.Write(buf, binary.LittleEndian, v)
+}
+
+// encodeTestJPEG encodes a solid JPEG, optionally inserting an APP1 segment after SOI.
+func encodeTestJPEG(t *testing.T, w, h int, app1 []byte) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: 40, G: 120, B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		t.Fatalf("jpeg encode: %v", err)
+	}
+	if app1 == nil {
+		return buf.Bytes()
+	}
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, 0xFF, 0xE1, byte((len(app1)+2)>>8), byte(len(app1)+2))
+	out = append(out, app1...)
+	return append(out, data[2:]...)
+}
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("read testdata: %v", err)
+	}
+	return data
+}
+
+// buildGrayTIFF writes an uncompressed 8-bit grayscale TIFF with one page per size.
+func buildGrayTIFF(t *testing.T, sizes [][2]int) []byte {
+	t.Helper()
+	const entries = 9
+	ifdSize := 2 + entries*12 + 4
+
+	var buf bytes.Buffer
+	buf.WriteString("II*\x00")
+	writeLE32(&buf, 8)
+
+	pixelsOff := 8 + ifdSize*len(sizes)
+	for i, size := range sizes {
+		w, h := size[0], size[1]
+		next := uint32(0)
+		if i < len(sizes)-1 {
+			next = uint32(8 + ifdSize*(i+1))
+		}
+		writeIFD(&buf, next,
+			tiffTestEntry{0x0100, 3, 1, uint32(w)},
+			tiffTestEntry{0x0101, 3, 1, uint32(h)},
+			tiffTestEntry{0x0102, 3, 1, 8},
+			tiffTestEntry{tagCompression, 3, 1, 1},
+			tiffTestEntry{0x0106, 3, 1, 1},
+			tiffTestEntry{tagStripOffsets, 4, 1, uint32(pixelsOff)},
+			tiffTestEntry{0x0115, 3, 1, 1},
+			tiffTestEntry{0x0116, 3, 1, uint32(h)},
+			tiffTestEntry{tagStripByteCounts, 4, 1, uint32(w * h)},
+		)
+		pixelsOff += w * h
+	}
+	for _, size := range sizes {
+		buf.Write(bytes.Repeat([]byte{0x80}, size[0]*size[1]))
+	}
+	return buf.Bytes()
+}
+
+func encodeTestBMP(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatalf("bmp encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// encodeTestGIF writes a two-frame animation whose second frame is smaller.
+func encodeTestGIF(t *testing.T, w, h int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, w, h), palette),
+			image.NewPaletted(image.Rect(0, 0, w/2, h/2), palette),
+		},
+		Delay: []int{10, 10},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("gif encode: %v", err)
 	}
+	return buf.Bytes()
 }
@@ -0,0 +1,266 @@
+package instafix
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"sync"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	// ErrOutputTooLarge means the output does not fit EncodeOptions.MaxBytes even at
+	// the minimum quality.
+	ErrOutputTooLarge = errors.New("output too large")
+	// ErrFormatUnavailable means no encoder is installed for the output format.
+	ErrFormatUnavailable = errors.New("output format unavailable")
+)
+
+// WebPEncoder encodes an image as WebP with a 1..100 quality.
+type WebPEncoder func(w io.Writer, img image.Image, quality int) error
+
+var (
+	webpEncoderMu sync.RWMutex
+	webpEncoder   WebPEncoder
+)
+
+// RegisterWebPEncoder installs the encoder used for WebP output. There is no
+// pure-Go WebP encoder in our dependencies, so WebP output is unavailable
+// until one is registered.
+func RegisterWebPEncoder(enc WebPEncoder) {
+	webpEncoderMu.Lock()
+	defer webpEncoderMu.Unlock()
+	webpEncoder = enc
+}
+
+func currentWebPEncoder() WebPEncoder {
+	webpEncoderMu.RLock()
+	defer webpEncoderMu.RUnlock()
+	return webpEncoder
+}
+
+// EncodeOptions controls output encoding.
+type EncodeOptions struct {
+	// Format is one of the config.OutputFormat* values; empty means baseline JPEG.
+	Format string
+	// Quality is the JPEG/WebP quality, or the highest one tried when MaxBytes is set.
+	Quality int
+	// MaxBytes, when positive, lowers the quality until the output fits.
+	MaxBytes int64
+	// MinQuality is the lowest quality tried to fit MaxBytes.
+	MinQuality int
+	// ChromaSubsampling is config.ChromaSubsampling420 (default) or config.ChromaSubsampling444.
+	ChromaSubsampling string
+}
+
+// EncodeResult describes an encoded output.
+type EncodeResult struct {
+	Format      string
+	ContentType string
+	// Quality is the final JPEG/WebP quality; zero for PNG.
+	Quality int
+	Size    int64
+}
+
+// formatContentType returns the media type of an output format.
+func formatContentType(format string) string {
+	switch format {
+	case config.OutputFormatPNG:
+		return "image/png"
+	case config.OutputFormatWebP:
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// EncodeJPEG writes img as baseline JPEG and injects the metadata blocks and
+// ICC profile right after SOI.
+func EncodeJPEG(w io.Writer, img image.Image, quality int, meta Metadata) error {
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(quality)); err != nil {
+		return err
+	}
+	return writeJPEGMetadata(w, buf.Bytes(), meta)
+}
+
+func writeJPEGMetadata(w io.Writer, data []byte, meta Metadata) error {
+	var segments [][]byte
+	if len(meta.EXIF) > 0 {
+		segments = append(segments, jpegSegment(0xE1, jpegExifHeader, meta.EXIF))
+	}
+	if len(meta.XMP) > 0 {
+		segments = append(segments, jpegSegment(0xE1, jpegXMPHeader, meta.XMP))
+	}
+	if len(meta.IPTC) > 0 {
+		segments = append(segments, jpegSegment(0xED, jpegIPTCHeader, meta.IPTC))
+	}
+	if len(meta.ICC) > 0 {
+		segments = append(segments, jpegICCSegments(meta.ICC)...)
+	}
+
+	if _, err := w.Write(data[:2]); err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if seg == nil {
+			continue
+		}
+		if _, err := w.Write(seg); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(data[2:])
+	return err
+}
+
+// Encode writes img in opts.Format with the metadata the format can carry.
+// When opts.MaxBytes is set, the highest quality between opts.MinQuality and
+// opts.Quality that fits is found by binary search; PNG output is only checked
+// against the limit.
+func Encode(w io.Writer, img image.Image, opts EncodeOptions, meta Metadata) (EncodeResult, error) {
+	format := opts.Format
+	if format == "" {
+		format = config.OutputFormatJPEG
+	}
+	if format == config.OutputFormatWebP && currentWebPEncoder() == nil {
+		return EncodeResult{}, fmt.Errorf("%w: no webp encoder registered", ErrFormatUnavailable)
+	}
+
+	encode := func(quality int) (*bytes.Buffer, error) {
+		var buf bytes.Buffer
+		err := encodeOnce(&buf, img, format, quality, opts.ChromaSubsampling, meta)
+		return &buf, err
+	}
+	fits := func(buf *bytes.Buffer) bool {
+		return opts.MaxBytes <= 0 || int64(buf.Len()) <= opts.MaxBytes
+	}
+
+	quality := opts.Quality
+	if format == config.OutputFormatPNG {
+		quality = 0
+	}
+	best, err := encode(quality)
+	if err != nil {
+		return EncodeResult{}, err
+	}
+	if !fits(best) {
+		if format == config.OutputFormatPNG {
+			return EncodeResult{}, fmt.Errorf("%w: png exceeds %d bytes", ErrOutputTooLarge, opts.MaxBytes)
+		}
+		lo, hi := opts.MinQuality, quality-1
+		if lo < 1 {
+			lo = 1
+		}
+		best = nil
+		for lo <= hi {
+			mid := (lo + hi) / 2
+			buf, err := encode(mid)
+			if err != nil {
+				return EncodeResult{}, err
+			}
+			if fits(buf) {
+				best, quality = buf, mid
+				lo = mid + 1
+			} else {
+				hi = mid - 1
+			}
+		}
+		if best == nil {
+			return EncodeResult{}, fmt.Errorf("%w: exceeds %d bytes at quality %d", ErrOutputTooLarge, opts.MaxBytes, opts.MinQuality)
+		}
+	}
+
+	n, err := best.WriteTo(w)
+	if err != nil {
+		return EncodeResult{}, err
+	}
+	return EncodeResult{Format: format, ContentType: formatContentType(format), Quality: quality, Size: n}, nil
+}
+
+func encodeOnce(w io.Writer, img image.Image, format string, quality int, chroma string, meta Metadata) error {
+	switch format {
+	case config.OutputFormatPNG:
+		return encodePNG(w, img, meta)
+	case config.OutputFormatWebP:
+		// WebP metadata needs the extended (VP8X) container, which is left to the encoder.
+		return currentWebPEncoder()(w, img, quality)
+	}
+	progressive := format == config.OutputFormatJPEGProgressive
+	if !progressive && chroma != config.ChromaSubsampling444 {
+		return EncodeJPEG(w, img, quality, meta)
+	}
+	var buf bytes.Buffer
+	if err := encodeJPEGExtended(&buf, img, quality, progressive, chroma != config.ChromaSubsampling444); err != nil {
+		return err
+	}
+	return writeJPEGMetadata(w, buf.Bytes(), meta)
+}
+
+// encodePNG writes img as PNG with iCCP, eXIf and XMP (iTXt) chunks after IHDR.
+func encodePNG(w io.Writer, img image.Image, meta Metadata) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	var chunks []byte
+	if len(meta.ICC) > 0 {
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		if _, err := zw.Write(meta.ICC); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		chunks = appendPNGChunk(chunks, "iCCP", append([]byte("ICC Profile\x00\x00"), z.Bytes()...))
+	}
+	if len(meta.EXIF) > 0 {
+		chunks = appendPNGChunk(chunks, "eXIf", meta.EXIF)
+	}
+	if len(meta.XMP) > 0 {
+		// keyword\0, no compression, empty language and translated keyword
+		chunks = appendPNGChunk(chunks, "iTXt", append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), meta.XMP...))
+	}
+
+	const afterIHDR = 8 + 12 + 13
+	if _, err := w.Write(data[:afterIHDR]); err != nil {
+		return err
+	}
+	if _, err := w.Write(chunks); err != nil {
+		return err
+	}
+	_, err := w.Write(data[afterIHDR:])
+	return err
+}
+
+func appendPNGChunk(dst []byte, typ string, payload []byte) []byte {
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = append(dst, typ...)
+	dst = append(dst, payload...)
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[start+4:]))
+}
+
+// jpegSegment builds a marker segment, or nil when the payload does not fit.
+func jpegSegment(marker byte, header string, payload []byte) []byte {
+	n := 2 + len(header) + len(payload)
+	if n > 0xFFFF {
+		return nil
+	}
+	seg := make([]byte, 0, n+2)
+	seg = append(seg, 0xFF, marker, byte(n>>8), byte(n))
+	seg = append(seg, header...)
+	return append(seg, payload...)
+}
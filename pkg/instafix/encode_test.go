@@ -0,0 +1,190 @@
+package instafix
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestEncode_Formats(t *testing.T) {
+	img := noiseImage(40, 24)
+	meta := Metadata{EXIF: testExifBlock(), ICC: srgbICC()}
+
+	tests := []struct {
+		name        string
+		opts        EncodeOptions
+		contentType string
+		sof         byte
+		ratio       image.YCbCrSubsampleRatio
+	}{
+		{name: "baseline", opts: EncodeOptions{Quality: 90}, contentType: "image/jpeg", sof: 0xC0, ratio: image.YCbCrSubsampleRatio420},
+		{name: "baseline 4:4:4", opts: EncodeOptions{Quality: 90, ChromaSubsampling: config.ChromaSubsampling444}, contentType: "image/jpeg", sof: 0xC0, ratio: image.YCbCrSubsampleRatio444},
+		{name: "progressive", opts: EncodeOptions{Format: config.OutputFormatJPEGProgressive, Quality: 90}, contentType: "image/jpeg", sof: 0xC2, ratio: image.YCbCrSubsampleRatio420},
+		{name: "progressive 4:4:4", opts: EncodeOptions{Format: config.OutputFormatJPEGProgressive, Quality: 90, ChromaSubsampling: config.ChromaSubsampling444}, contentType: "image/jpeg", sof: 0xC2, ratio: image.YCbCrSubsampleRatio444},
+		{name: "png", opts: EncodeOptions{Format: config.OutputFormatPNG, Quality: 90}, contentType: "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			res, err := Encode(&buf, img, tt.opts, meta)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if res.ContentType != tt.contentType {
+				t.Fatalf("expected %s, got %s", tt.contentType, res.ContentType)
+			}
+			data := buf.Bytes()
+
+			if tt.contentType == "image/png" {
+				if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+					t.Fatalf("png decode: %v", err)
+				}
+				got := pngMetadata(data)
+				if len(got.EXIF) == 0 || !bytes.Equal(pngICC(data), meta.ICC) {
+					t.Fatal("expected EXIF and ICC in the PNG output")
+				}
+				return
+			}
+
+			out, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("jpeg decode: %v", err)
+			}
+			if out.Bounds() != img.Bounds() {
+				t.Fatalf("unexpected bounds %v", out.Bounds())
+			}
+			if ycc, ok := out.(*image.YCbCr); !ok || ycc.SubsampleRatio != tt.ratio {
+				t.Fatalf("expected subsampling %v, got %T", tt.ratio, out)
+			}
+			var sof byte
+			forEachJPEGSegment(data, func(marker byte, _ []byte) {
+				if marker == 0xC0 || marker == 0xC2 {
+					sof = marker
+				}
+			})
+			if sof != tt.sof {
+				t.Fatalf("expected SOF marker %#x, got %#x", tt.sof, sof)
+			}
+			if len(jpegMetadata(data).EXIF) == 0 || !bytes.Equal(jpegICC(data), meta.ICC) {
+				t.Fatal("expected EXIF and ICC in the JPEG output")
+			}
+		})
+	}
+}
+
+func TestEncode_WebPNeedsEncoder(t *testing.T) {
+	img := noiseImage(8, 8)
+	var buf bytes.Buffer
+	if _, err := Encode(&buf, img, EncodeOptions{Format: config.OutputFormatWebP, Quality: 80}, Metadata{}); !errors.Is(err, ErrFormatUnavailable) {
+		t.Fatalf("expected ErrFormatUnavailable, got %v", err)
+	}
+
+	RegisterWebPEncoder(func(w io.Writer, img image.Image, quality int) error {
+		_, err := w.Write([]byte("RIFF"))
+		return err
+	})
+	defer RegisterWebPEncoder(nil)
+
+	res, err := Encode(&buf, img, EncodeOptions{Format: config.OutputFormatWebP, Quality: 80}, Metadata{})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if res.ContentType != "image/webp" || buf.String() != "RIFF" {
+		t.Fatalf("expected the registered encoder to be used, got %s %q", res.ContentType, buf.String())
+	}
+}
+
+func TestNewProcessor_WebPProfileNeedsEncoder(t *testing.T) {
+	cfg := config.Config{
+		Settings:    config.Settings{JpegQuality: 90},
+		Backgrounds: map[string]config.Background{"black": {Type: "solid", Color: "#000000"}},
+		Formats:     map[string]config.Format{"square": {Type: "fixed", Width: 100, Height: 100}},
+		Profiles:    map[string]config.Profile{"default": {BackgroundRef: "black", FormatRef: "square", OutputFormat: "webp"}},
+	}
+	if _, err := NewProcessor(cfg); !errors.Is(err, ErrFormatUnavailable) {
+		t.Fatalf("expected ErrFormatUnavailable, got %v", err)
+	}
+
+	RegisterWebPEncoder(func(w io.Writer, img image.Image, quality int) error { return nil })
+	defer RegisterWebPEncoder(nil)
+	if _, err := NewProcessor(cfg); err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+}
+
+func TestEncode_MaxBytes(t *testing.T) {
+	img := noiseImage(128, 128)
+	size := func(quality int) int64 {
+		var buf bytes.Buffer
+		if err := EncodeJPEG(&buf, img, quality, Metadata{}); err != nil {
+			t.Fatalf("EncodeJPEG: %v", err)
+		}
+		return int64(buf.Len())
+	}
+	limit := (size(60) + size(90)) / 2
+
+	tests := []struct {
+		name    string
+		opts    EncodeOptions
+		quality int
+		wantErr error
+	}{
+		{name: "no limit", opts: EncodeOptions{Quality: 90}, quality: 90},
+		{name: "fits at max quality", opts: EncodeOptions{Quality: 90, MaxBytes: size(90), MinQuality: 50}, quality: 90},
+		{name: "searches down", opts: EncodeOptions{Quality: 90, MaxBytes: limit, MinQuality: 50}},
+		{name: "below floor", opts: EncodeOptions{Quality: 90, MaxBytes: 1000, MinQuality: 50}, wantErr: ErrOutputTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			res, err := Encode(&buf, img, tt.opts, Metadata{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				if buf.Len() != 0 {
+					t.Fatal("expected nothing written on error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if res.Size != int64(buf.Len()) {
+				t.Fatalf("reported size %d, wrote %d", res.Size, buf.Len())
+			}
+			if tt.quality != 0 && res.Quality != tt.quality {
+				t.Fatalf("expected quality %d, got %d", tt.quality, res.Quality)
+			}
+			if tt.opts.MaxBytes > 0 {
+				if res.Size > tt.opts.MaxBytes {
+					t.Fatalf("size %d exceeds %d", res.Size, tt.opts.MaxBytes)
+				}
+				if res.Quality < tt.opts.Quality && size(res.Quality+1) <= tt.opts.MaxBytes {
+					t.Fatalf("quality %d is not the highest that fits", res.Quality)
+				}
+			}
+		})
+	}
+}
+
+func noiseImage(w, h int) image.Image {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Intn(256))
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
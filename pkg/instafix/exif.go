@@ -0,0 +1,306 @@
+package instafix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EXIF pointer and value tags handled when rewriting metadata.
+const (
+	tagExifPointer       = 0x8769
+	tagGPSPointer        = 0x8825
+	tagInteropPointer    = 0xA005
+	tagMakerNote         = 0x927C
+	tagPixelXDimension   = 0xA002
+	tagPixelYDimension   = 0xA003
+	tagXMLPacket         = 0x02BC
+	exifMaxSegmentLength = 65533 - 6 // APP1 payload minus the "Exif\0\0" header
+)
+
+// exifTagNames maps tag names accepted in metadata allowlists to tag IDs.
+var exifTagNames = map[string]uint16{
+	"ImageDescription":      0x010E,
+	"Make":                  0x010F,
+	"Model":                 0x0110,
+	"Orientation":           0x0112,
+	"XResolution":           0x011A,
+	"YResolution":           0x011B,
+	"ResolutionUnit":        0x0128,
+	"Software":              0x0131,
+	"DateTime":              0x0132,
+	"Artist":                0x013B,
+	"Copyright":             0x8298,
+	"ExposureTime":          0x829A,
+	"FNumber":               0x829D,
+	"ExposureProgram":       0x8822,
+	"GPSInfo":               tagGPSPointer,
+	"ISOSpeedRatings":       0x8827,
+	"ISO":                   0x8827,
+	"DateTimeOriginal":      0x9003,
+	"DateTimeDigitized":     0x9004,
+	"OffsetTime":            0x9010,
+	"OffsetTimeOriginal":    0x9011,
+	"OffsetTimeDigitized":   0x9012,
+	"ShutterSpeedValue":     0x9201,
+	"ApertureValue":         0x9202,
+	"ExposureBiasValue":     0x9204,
+	"MaxApertureValue":      0x9205,
+	"MeteringMode":          0x9207,
+	"Flash":                 0x9209,
+	"FocalLength":           0x920A,
+	"UserComment":           0x9286,
+	"ColorSpace":            0xA001,
+	"FocalLengthIn35mmFilm": 0xA405,
+	"CameraOwnerName":       0xA430,
+	"BodySerialNumber":      0xA431,
+	"LensSpecification":     0xA432,
+	"LensMake":              0xA433,
+	"LensModel":             0xA434,
+	"LensSerialNumber":      0xA435,
+}
+
+// exifDescriptiveTags lists IFD0 tags copied from TIFF-based containers.
+// Everything else in a RAW IFD0 describes pixel data that is not carried over.
+var exifDescriptiveTags = map[uint16]bool{
+	0x010E: true, 0x010F: true, 0x0110: true, 0x0112: true,
+	0x011A: true, 0x011B: true, 0x0128: true, 0x0131: true,
+	0x0132: true, 0x013B: true, 0x8298: true,
+	tagExifPointer: true, tagGPSPointer: true,
+}
+
+// exifOffsetTags reference data outside the IFD and cannot be relocated.
+var exifOffsetTags = map[uint16]bool{
+	tagStripOffsets: true, tagStripByteCounts: true,
+	0x0144: true, 0x0145: true, // TileOffsets, TileByteCounts
+	tagJPEGInterchangeFormat: true, tagJPEGInterchangeFormatLength: true,
+	tagSubIFDs: true,
+}
+
+// lookupExifTag resolves an allowlist entry given as a name or hex ID (0x829a).
+func lookupExifTag(name string) (uint16, bool) {
+	name = strings.TrimSpace(name)
+	if id, ok := exifTagNames[name]; ok {
+		return id, true
+	}
+	for n, id := range exifTagNames {
+		if strings.EqualFold(n, name) {
+			return id, true
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(name), "0x") {
+		v, err := strconv.ParseUint(name[2:], 16, 16)
+		if err == nil {
+			return uint16(v), true
+		}
+	}
+	return 0, false
+}
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte   // raw value bytes in the block's byte order
+	sub   *exifIFD // set for Exif, GPS and Interop pointers
+}
+
+type exifIFD struct {
+	entries []exifEntry
+}
+
+// exifData is a parsed EXIF block: IFD0 with its Exif/GPS/Interop sub-IFDs.
+// The IFD1 thumbnail is intentionally not kept.
+type exifData struct {
+	order binary.ByteOrder
+	ifd0  *exifIFD
+}
+
+// parseExif parses a TIFF-structured EXIF block.
+func parseExif(block []byte) (*exifData, error) {
+	t, err := newTIFFReader(block, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := parseExifIFD(t, t.first, nil, make(map[int]bool))
+	if err != nil {
+		return nil, err
+	}
+	return &exifData{order: t.order, ifd0: ifd0}, nil
+}
+
+// parseExifIFD reads the IFD at off. keep, when non-nil, limits the tags copied.
+func parseExifIFD(t *tiffReader, off int, keep map[uint16]bool, visited map[int]bool) (*exifIFD, error) {
+	if visited[off] {
+		return nil, fmt.Errorf("exif ifd loop at %d", off)
+	}
+	visited[off] = true
+	ifd, err := t.readIFD(off)
+	if err != nil {
+		return nil, err
+	}
+	out := &exifIFD{}
+	for tag, e := range ifd.entries {
+		if keep != nil && !keep[tag] {
+			continue
+		}
+		if exifOffsetTags[tag] {
+			continue
+		}
+		entry := exifEntry{tag: tag, typ: e.typ, count: e.count}
+		switch tag {
+		case tagExifPointer, tagGPSPointer, tagInteropPointer:
+			ptr, ok := t.uint(ifd, tag)
+			if !ok {
+				continue
+			}
+			sub, err := parseExifIFD(t, int(ptr), nil, visited)
+			if err != nil {
+				continue
+			}
+			entry.typ, entry.count, entry.sub = 4, 1, sub
+		default:
+			size := tiffTypeSize(e.typ) * int(e.count)
+			entry.value = append([]byte(nil), t.data[e.pos:e.pos+size]...)
+		}
+		out.entries = append(out.entries, entry)
+	}
+	sort.Slice(out.entries, func(i, j int) bool { return out.entries[i].tag < out.entries[j].tag })
+	return out, nil
+}
+
+func (d *exifData) exifIFD() *exifIFD {
+	if e := d.ifd0.find(tagExifPointer); e != nil {
+		return e.sub
+	}
+	return nil
+}
+
+func (ifd *exifIFD) find(tag uint16) *exifEntry {
+	if ifd == nil {
+		return nil
+	}
+	for i := range ifd.entries {
+		if ifd.entries[i].tag == tag {
+			return &ifd.entries[i]
+		}
+	}
+	return nil
+}
+
+func (ifd *exifIFD) remove(tag uint16) {
+	if ifd == nil {
+		return
+	}
+	kept := ifd.entries[:0]
+	for _, e := range ifd.entries {
+		if e.tag != tag {
+			kept = append(kept, e)
+		}
+	}
+	ifd.entries = kept
+}
+
+// filter keeps the tags in allowed; pointer tags survive while their sub-IFD
+// still holds allowed tags, the GPS IFD only when GPSInfo itself is allowed.
+func (ifd *exifIFD) filter(allowed map[uint16]bool) {
+	kept := ifd.entries[:0]
+	for _, e := range ifd.entries {
+		switch {
+		case e.tag == tagGPSPointer:
+			if !allowed[tagGPSPointer] {
+				continue
+			}
+		case e.sub != nil:
+			e.sub.filter(allowed)
+			if len(e.sub.entries) == 0 {
+				continue
+			}
+		case !allowed[e.tag]:
+			continue
+		}
+		kept = append(kept, e)
+	}
+	ifd.entries = kept
+}
+
+// setLong replaces the value of tag with a single LONG, adding it if missing.
+func (ifd *exifIFD) setLong(order binary.ByteOrder, tag uint16, v uint32) {
+	value := make([]byte, 4)
+	order.PutUint32(value, v)
+	ifd.set(exifEntry{tag: tag, typ: 4, count: 1, value: value})
+}
+
+// setShort replaces the value of tag with a single SHORT, adding it if missing.
+func (ifd *exifIFD) setShort(order binary.ByteOrder, tag uint16, v uint16) {
+	value := make([]byte, 2)
+	order.PutUint16(value, v)
+	ifd.set(exifEntry{tag: tag, typ: 3, count: 1, value: value})
+}
+
+func (ifd *exifIFD) set(entry exifEntry) {
+	if e := ifd.find(entry.tag); e != nil {
+		*e = entry
+		return
+	}
+	ifd.entries = append(ifd.entries, entry)
+	sort.Slice(ifd.entries, func(i, j int) bool { return ifd.entries[i].tag < ifd.entries[j].tag })
+}
+
+// encode serializes the EXIF block as a TIFF structure.
+func (d *exifData) encode() []byte {
+	w := exifWriter{order: d.order}
+	if d.order == binary.BigEndian {
+		w.buf = append(w.buf, 'M', 'M', 0, 42)
+	} else {
+		w.buf = append(w.buf, 'I', 'I', 42, 0)
+	}
+	w.buf = append(w.buf, 0, 0, 0, 8)
+	d.order.PutUint32(w.buf[4:], 8)
+	w.write(d.ifd0)
+	return w.buf
+}
+
+type exifWriter struct {
+	order binary.ByteOrder
+	buf   []byte
+}
+
+func (w *exifWriter) write(ifd *exifIFD) uint32 {
+	start := len(w.buf)
+	n := len(ifd.entries)
+	w.buf = append(w.buf, make([]byte, 2+12*n+4)...)
+	w.order.PutUint16(w.buf[start:], uint16(n))
+
+	type patch struct {
+		pos int
+		sub *exifIFD
+	}
+	var patches []patch
+	for i, e := range ifd.entries {
+		p := start + 2 + 12*i
+		w.order.PutUint16(w.buf[p:], e.tag)
+		w.order.PutUint16(w.buf[p+2:], e.typ)
+		w.order.PutUint32(w.buf[p+4:], e.count)
+		switch {
+		case e.sub != nil:
+			patches = append(patches, patch{pos: p + 8, sub: e.sub})
+		case len(e.value) <= 4:
+			copy(w.buf[p+8:p+12], e.value)
+		default:
+			off := len(w.buf)
+			w.buf = append(w.buf, e.value...)
+			if len(w.buf)%2 == 1 {
+				w.buf = append(w.buf, 0)
+			}
+			w.order.PutUint32(w.buf[p+8:], uint32(off))
+		}
+	}
+	for _, pt := range patches {
+		off := w.write(pt.sub)
+		w.order.PutUint32(w.buf[pt.pos:], off)
+	}
+	return uint32(start)
+}
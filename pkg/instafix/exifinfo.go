@@ -0,0 +1,160 @@
+package instafix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExifInfo holds the shooting details read from the source EXIF. Missing
+// values are zero.
+type ExifInfo struct {
+	Make      string
+	Model     string
+	LensModel string
+	// FocalLength is in millimeters, FNumber is the f-stop and ExposureTime
+	// is in seconds.
+	FocalLength  float64
+	FNumber      float64
+	ExposureTime float64
+	ISO          int
+	// DateTime is DateTimeOriginal, or DateTime when the former is missing,
+	// in the camera's local time.
+	DateTime time.Time
+}
+
+// exifDateLayout is the EXIF date and time format.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// parseExifInfo reads the shooting details from a TIFF-structured EXIF block.
+// A missing or malformed block yields an empty ExifInfo.
+func parseExifInfo(block []byte) ExifInfo {
+	if len(block) == 0 {
+		return ExifInfo{}
+	}
+	d, err := parseExif(block)
+	if err != nil {
+		return ExifInfo{}
+	}
+	sub := d.exifIFD()
+	info := ExifInfo{
+		Make:         exifASCII(d.ifd0, "Make"),
+		Model:        exifASCII(d.ifd0, "Model"),
+		LensModel:    exifASCII(sub, "LensModel"),
+		FocalLength:  exifRational(d.order, sub, "FocalLength"),
+		FNumber:      exifRational(d.order, sub, "FNumber"),
+		ExposureTime: exifRational(d.order, sub, "ExposureTime"),
+		ISO:          int(exifUint(d.order, sub, "ISOSpeedRatings")),
+	}
+	for _, date := range []string{exifASCII(sub, "DateTimeOriginal"), exifASCII(d.ifd0, "DateTime")} {
+		if t, err := time.Parse(exifDateLayout, date); err == nil {
+			info.DateTime = t
+			break
+		}
+	}
+	return info
+}
+
+// Camera returns the camera model prefixed with its maker unless the model
+// already names it, e.g. "FUJIFILM X-T4" or "Canon EOS R5".
+func (e ExifInfo) Camera() string {
+	maker, _, _ := strings.Cut(e.Make, " ")
+	switch {
+	case e.Model == "":
+		return e.Make
+	case maker == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(maker)):
+		return e.Model
+	default:
+		return maker + " " + e.Model
+	}
+}
+
+// Focal returns the focal length as "35mm".
+func (e ExifInfo) Focal() string {
+	if e.FocalLength <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(math.Round(e.FocalLength*10)/10, 'f', -1, 64) + "mm"
+}
+
+// Aperture returns the f-stop as "f/1.8".
+func (e ExifInfo) Aperture() string {
+	if e.FNumber <= 0 {
+		return ""
+	}
+	return "f/" + strconv.FormatFloat(math.Round(e.FNumber*10)/10, 'f', -1, 64)
+}
+
+// Shutter returns the exposure time as "1/250s", or in decimal seconds from
+// 0.3s up ("0.5s", "2s"), where a 1/n fraction would round badly.
+func (e ExifInfo) Shutter() string {
+	switch {
+	case e.ExposureTime <= 0:
+		return ""
+	case e.ExposureTime < 0.3:
+		return fmt.Sprintf("1/%ds", int(math.Round(1/e.ExposureTime)))
+	default:
+		return strconv.FormatFloat(math.Round(e.ExposureTime*10)/10, 'f', -1, 64) + "s"
+	}
+}
+
+// Settings returns focal length, aperture, shutter and ISO as one line,
+// skipping the missing ones.
+func (e ExifInfo) Settings() string {
+	parts := []string{e.Focal(), e.Aperture(), e.Shutter()}
+	if e.ISO > 0 {
+		parts = append(parts, "ISO "+strconv.Itoa(e.ISO))
+	}
+	var out []string
+	for _, p := range parts {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, "  ")
+}
+
+func exifASCII(ifd *exifIFD, name string) string {
+	e := ifd.find(exifTagNames[name])
+	if e == nil || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// exifRational returns the first RATIONAL or SRATIONAL value of a tag.
+func exifRational(order binary.ByteOrder, ifd *exifIFD, name string) float64 {
+	e := ifd.find(exifTagNames[name])
+	if e == nil || len(e.value) < 8 {
+		return 0
+	}
+	var num, den float64
+	switch e.typ {
+	case 5:
+		num, den = float64(order.Uint32(e.value)), float64(order.Uint32(e.value[4:]))
+	case 10:
+		num, den = float64(int32(order.Uint32(e.value))), float64(int32(order.Uint32(e.value[4:])))
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// exifUint returns the first SHORT or LONG value of a tag.
+func exifUint(order binary.ByteOrder, ifd *exifIFD, name string) uint32 {
+	e := ifd.find(exifTagNames[name])
+	if e == nil {
+		return 0
+	}
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(order.Uint16(e.value))
+	case e.typ == 4 && len(e.value) >= 4:
+		return order.Uint32(e.value)
+	}
+	return 0
+}
@@ -12,6 +12,9 @@ func resolveFormat(formats map[string]config.Format, format config.Format, srcW,
 	if strings.ToLower(format.Type) == config.FormatTypeFixed {
 		return format, nil
 	}
+	if strings.ToLower(format.Type) == config.FormatTypeRange {
+		return resolveRangeFormat(format, srcW, srcH)
+	}
 	if strings.ToLower(format.Type) != config.FormatTypeAuto {
 		return config.Format{}, fmt.Errorf("unknown format type: %s", format.Type)
 	}
@@ -45,3 +48,27 @@ func resolveFormat(formats map[string]config.Format, format config.Format, srcW,
 	}
 	return formats[best], nil
 }
+
+// resolveRangeFormat keeps the source ratio when it lies within
+// [min_ratio, max_ratio] and clamps it to the nearest bound otherwise.
+// The result is a fixed format of the configured width.
+func resolveRangeFormat(format config.Format, srcW, srcH int) (config.Format, error) {
+	if format.Width <= 0 || format.MinRatio <= 0 || format.MaxRatio < format.MinRatio {
+		return config.Format{}, fmt.Errorf("range format requires width, min_ratio and max_ratio")
+	}
+	if srcW <= 0 || srcH <= 0 {
+		return config.Format{}, fmt.Errorf("invalid source size")
+	}
+	ratio := float64(srcW) / float64(srcH)
+	ratio = math.Max(format.MinRatio, math.Min(format.MaxRatio, ratio))
+	height := int(math.Round(float64(format.Width) / ratio))
+	if height < 1 {
+		height = 1
+	}
+	return config.Format{
+		Type:           config.FormatTypeFixed,
+		Width:          format.Width,
+		Height:         height,
+		PaddingPercent: format.PaddingPercent,
+	}, nil
+}
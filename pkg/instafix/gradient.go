@@ -0,0 +1,134 @@
+package instafix
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+// gradientSampleSide is the size of the thumbnail gradient colors are sampled from.
+const gradientSampleSide = 64
+
+// drawGradient fills the canvas with a linear or radial gradient.
+func drawGradient(dc *gg.Context, src image.Image, bg config.Background, width, height int) {
+	radial := strings.ToLower(strings.TrimSpace(bg.Gradient)) == config.GradientRadial
+	colors := gradientColors(src, bg, radial)
+
+	w, h := float64(width), float64(height)
+	var grad gg.Gradient
+	if radial {
+		grad = gg.NewRadialGradient(w/2, h/2, 0, w/2, h/2, math.Hypot(w, h)/2)
+	} else {
+		// Span the canvas along the direction so the end stops touch its corners.
+		rad := bg.Angle * math.Pi / 180
+		cos, sin := math.Cos(rad), math.Sin(rad)
+		half := (math.Abs(cos)*w + math.Abs(sin)*h) / 2
+		grad = gg.NewLinearGradient(w/2-cos*half, h/2-sin*half, w/2+cos*half, h/2+sin*half)
+	}
+	for i, c := range colors {
+		grad.AddColorStop(float64(i)/float64(len(colors)-1), c)
+	}
+	dc.SetFillStyle(grad)
+	dc.DrawRectangle(0, 0, w, h)
+	dc.Fill()
+}
+
+// gradientColors returns the configured stops or samples two from the photo.
+func gradientColors(src image.Image, bg config.Background, radial bool) []color.Color {
+	switch strings.ToLower(strings.TrimSpace(bg.ColorSource)) {
+	case config.ColorSourceEdges:
+		from, to := edgeColors(src, bg.Angle, radial)
+		return []color.Color{from, to}
+	case config.ColorSourceDominant:
+		palette := extractPalette(src, config.DefaultPaletteSize)
+		if len(palette) == 1 {
+			palette = append(palette, palette[0])
+		}
+		return []color.Color{palette[0].Color, palette[1].Color}
+	}
+	colors := make([]color.Color, 0, len(bg.Colors))
+	for _, hex := range bg.Colors {
+		c, err := parseHexColor(hex)
+		if err != nil {
+			continue
+		}
+		colors = append(colors, c)
+	}
+	for len(colors) < 2 {
+		colors = append(colors, color.NRGBA{A: 255})
+	}
+	return colors
+}
+
+// edgeColors averages the photo where the gradient starts and ends: the 10%
+// of pixels at either end of the direction of a linear gradient, or the
+// center and the border of the photo for a radial one.
+func edgeColors(src image.Image, angle float64, radial bool) (color.NRGBA, color.NRGBA) {
+	thumb := imaging.Fit(src, gradientSampleSide, gradientSampleSide, imaging.Box)
+	w, h := thumb.Bounds().Dx(), thumb.Bounds().Dy()
+	cx, cy := float64(w-1)/2, float64(h-1)/2
+	rad := angle * math.Pi / 180
+	cos, sin := math.Cos(rad), math.Sin(rad)
+
+	pos := make([]float64, 0, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			if radial {
+				pos = append(pos, math.Hypot(dx/math.Max(cx, 1), dy/math.Max(cy, 1)))
+			} else {
+				pos = append(pos, dx*cos+dy*sin)
+			}
+		}
+	}
+	sorted := append([]float64(nil), pos...)
+	sort.Float64s(sorted)
+	lo := sorted[len(sorted)/10]
+	hi := sorted[len(sorted)-1-len(sorted)/10]
+
+	var from, to colorSum
+	for i, p := range pos {
+		px := thumb.Pix[(i/w)*thumb.Stride+(i%w)*4:]
+		if p <= lo {
+			from.add(px)
+		}
+		if p >= hi {
+			to.add(px)
+		}
+	}
+	return from.mean(), to.mean()
+}
+
+// colorSum accumulates NRGBA pixels for averaging.
+type colorSum struct {
+	r, g, b, n int
+}
+
+func (s *colorSum) add(px []uint8) {
+	s.r += int(px[0])
+	s.g += int(px[1])
+	s.b += int(px[2])
+	s.n++
+}
+
+func (s colorSum) mean() color.NRGBA {
+	if s.n == 0 {
+		return color.NRGBA{A: 255}
+	}
+	return color.NRGBA{R: uint8(s.r / s.n), G: uint8(s.g / s.n), B: uint8(s.b / s.n), A: 255}
+}
+
+// colorDistance is the Euclidean distance of two colors in RGB.
+func colorDistance(a, b color.NRGBA) float64 {
+	dr := float64(a.R) - float64(b.R)
+	dg := float64(a.G) - float64(b.G)
+	db := float64(a.B) - float64(b.B)
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
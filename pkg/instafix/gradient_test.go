@@ -0,0 +1,89 @@
+package instafix
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/fogleman/gg"
+)
+
+func TestDrawGradient(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	// Left 70% red, right 30% blue.
+	photo := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			if x < 70 {
+				photo.SetNRGBA(x, y, red)
+			} else {
+				photo.SetNRGBA(x, y, blue)
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		bg         config.Background
+		start, end image.Point
+		wantStart  color.NRGBA
+		wantEnd    color.NRGBA
+	}{
+		{
+			name:      "linear left to right",
+			bg:        config.Background{Colors: []string{"#000000", "#ffffff"}},
+			start:     image.Pt(0, 50),
+			end:       image.Pt(99, 50),
+			wantStart: color.NRGBA{A: 255},
+			wantEnd:   color.NRGBA{R: 255, G: 255, B: 255, A: 255},
+		},
+		{
+			name:      "linear top to bottom",
+			bg:        config.Background{Angle: 90, Colors: []string{"#000000", "#ffffff"}},
+			start:     image.Pt(50, 0),
+			end:       image.Pt(50, 99),
+			wantStart: color.NRGBA{A: 255},
+			wantEnd:   color.NRGBA{R: 255, G: 255, B: 255, A: 255},
+		},
+		{
+			name:      "radial",
+			bg:        config.Background{Gradient: "radial", Colors: []string{"#ffffff", "#000000"}},
+			start:     image.Pt(50, 50),
+			end:       image.Pt(0, 0),
+			wantStart: color.NRGBA{R: 255, G: 255, B: 255, A: 255},
+			wantEnd:   color.NRGBA{A: 255},
+		},
+		{
+			name:      "edges",
+			bg:        config.Background{ColorSource: "edges"},
+			start:     image.Pt(0, 50),
+			end:       image.Pt(99, 50),
+			wantStart: red,
+			wantEnd:   blue,
+		},
+		{
+			name:      "dominant",
+			bg:        config.Background{ColorSource: "dominant"},
+			start:     image.Pt(0, 50),
+			end:       image.Pt(99, 50),
+			wantStart: red,
+			wantEnd:   blue,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := gg.NewContext(100, 100)
+			drawGradient(dc, photo, tt.bg, 100, 100)
+			img := dc.Image()
+			if got := color.NRGBAModel.Convert(img.At(tt.start.X, tt.start.Y)).(color.NRGBA); colorDistance(got, tt.wantStart) > 12 {
+				t.Fatalf("start %v = %v, want %v", tt.start, got, tt.wantStart)
+			}
+			if got := color.NRGBAModel.Convert(img.At(tt.end.X, tt.end.Y)).(color.NRGBA); colorDistance(got, tt.wantEnd) > 12 {
+				t.Fatalf("end %v = %v, want %v", tt.end, got, tt.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package instafix
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+const (
+	// GridColumns is the number of columns of the Instagram profile grid.
+	GridColumns = 3
+	// MaxGridRows caps the rows chosen for a grid.
+	MaxGridRows = 10
+	// DefaultGridGap is the gap Instagram draws between grid cells, as a
+	// share of the cell width (about one point on a phone screen).
+	DefaultGridGap = 0.01
+	// gridPreviewRatio is the width/height ratio of the profile grid cells.
+	gridPreviewRatio = 3.0 / 4.0
+)
+
+// GridOptions controls how ProcessGrid cuts the mosaic.
+type GridOptions struct {
+	// Rows is the number of tile rows; zero picks the count whose mosaic is
+	// closest to the image ratio.
+	Rows int
+	// Gap is the gap between grid cells as a share of the cell width. Zero
+	// uses DefaultGridGap; a negative value disables it.
+	Gap float64
+	// FullTiles lays out whole tiles edge to edge instead of the 3:4 center
+	// crop the profile grid shows of every post.
+	FullTiles bool
+}
+
+func (o GridOptions) withDefaults() GridOptions {
+	if o.Gap == 0 {
+		o.Gap = DefaultGridGap
+	}
+	if o.Gap < 0 {
+		o.Gap = 0
+	}
+	return o
+}
+
+// gridLayout is the geometry of a grid: tiles of tileW x tileH show a
+// cellW x cellH center crop on the profile grid, with gap pixels between
+// neighbouring cells.
+type gridLayout struct {
+	tileW, tileH int
+	cellW, cellH int
+	gap          int
+	rows         int
+}
+
+func newGridLayout(tileW, tileH int, opts GridOptions) gridLayout {
+	l := gridLayout{tileW: tileW, tileH: tileH, cellW: tileW, cellH: tileH, rows: opts.Rows}
+	if !opts.FullTiles {
+		if float64(tileW)/float64(tileH) > gridPreviewRatio {
+			l.cellW = int(math.Round(float64(tileH) * gridPreviewRatio))
+		} else {
+			l.cellH = int(math.Round(float64(tileW) / gridPreviewRatio))
+		}
+	}
+	l.gap = int(math.Round(opts.Gap * float64(l.cellW)))
+	return l
+}
+
+// mosaicSize is the part of the grid visible on the profile: the cells and
+// the gaps between them.
+func (l gridLayout) mosaicSize(rows int) (int, int) {
+	return GridColumns*l.cellW + (GridColumns-1)*l.gap, rows*l.cellH + (rows-1)*l.gap
+}
+
+// fitRows returns the row count whose mosaic ratio is closest to the image's.
+func (l gridLayout) fitRows(srcW, srcH int) int {
+	best, bestDiff := 1, math.Inf(1)
+	for rows := 1; rows <= MaxGridRows; rows++ {
+		w, h := l.mosaicSize(rows)
+		diff := math.Abs(math.Log(float64(srcW)/float64(srcH)) - math.Log(float64(w)/float64(h)))
+		if diff < bestDiff {
+			best, bestDiff = rows, diff
+		}
+	}
+	return best
+}
+
+// ProcessGrid cuts an image into a 3-column mosaic of tiles for the profile
+// grid, using a fixed format (formatName, or the profile's format when empty)
+// for every tile. The profile is rendered on the visible mosaic, so cells
+// line up across the gaps and the 3:4 preview crop; the parts of the tiles
+// hidden on the grid are filled with the profile background.
+// Tiles are returned in posting order, bottom-right first, so the last post
+// lands in the top-left cell.
+func (p *Processor) ProcessGrid(src image.Image, profileName, formatName string, grid GridOptions, opts ProcessOptions) ([]image.Image, int, error) {
+	resolved, err := p.resolveProfile(profileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	format, err := p.fixedFormat(&resolved, formatName)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts, err = prepareProcessOptions(resolved, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if grid.Rows < 0 || grid.Rows > MaxGridRows {
+		return nil, 0, UserError{Err: fmt.Errorf("grid rows must be 0..%d: %d", MaxGridRows, grid.Rows)}
+	}
+
+	layout := newGridLayout(format.Width, format.Height, grid.withDefaults())
+	if layout.rows == 0 {
+		layout.rows = layout.fitRows(src.Bounds().Dx(), src.Bounds().Dy())
+	}
+	mosaicW, mosaicH := layout.mosaicSize(layout.rows)
+	mosaic, err := renderImage(src, resolved, config.Format{Type: config.FormatTypeFixed, Width: mosaicW, Height: mosaicH}, opts, p.assets)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Tiles overlap the mosaic by the hidden margins around each cell.
+	marginX := (layout.tileW - layout.cellW) / 2
+	marginY := (layout.tileH - layout.cellH) / 2
+	canvasW := (GridColumns-1)*(layout.cellW+layout.gap) + layout.tileW
+	canvasH := (layout.rows-1)*(layout.cellH+layout.gap) + layout.tileH
+	dc := gg.NewContext(canvasW, canvasH)
+	if err := drawBackground(dc, src, resolved.Background, resolved.AssetsPath, p.assets, canvasW, canvasH, mosaic, marginX, marginY); err != nil {
+		return nil, 0, err
+	}
+	dc.DrawImage(mosaic, marginX, marginY)
+	canvas := dc.Image()
+
+	tiles := make([]image.Image, 0, GridColumns*layout.rows)
+	for row := layout.rows - 1; row >= 0; row-- {
+		for col := GridColumns - 1; col >= 0; col-- {
+			x := col * (layout.cellW + layout.gap)
+			y := row * (layout.cellH + layout.gap)
+			tiles = append(tiles, imaging.Crop(canvas, image.Rect(x, y, x+layout.tileW, y+layout.tileH)))
+		}
+	}
+	return tiles, resolved.JpegQuality, nil
+}
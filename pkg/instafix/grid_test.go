@@ -0,0 +1,97 @@
+package instafix
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestProcessGrid_CellsMatchMosaic(t *testing.T) {
+	cfg := config.Config{
+		Settings: config.Settings{
+			JpegQuality: 90,
+			AssetsPath:  "assets",
+		},
+		Backgrounds: map[string]config.Background{
+			"black": {Type: "solid", Color: "#000000"},
+		},
+		Formats: map[string]config.Format{
+			"square": {Type: "fixed", Width: 120, Height: 120},
+		},
+		Profiles: map[string]config.Profile{
+			"default": {BackgroundRef: "black", FormatRef: "square", FitMode: "cover"},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+	resolved, err := cfg.ResolveProfile("default")
+	if err != nil {
+		t.Fatalf("ResolveProfile: %v", err)
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, 544, 482))
+	for y := 0; y < 482; y++ {
+		for x := 0; x < 544; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / 543), G: uint8(y * 255 / 481), B: 64, A: 255})
+		}
+	}
+
+	tests := []struct {
+		name         string
+		grid         GridOptions
+		cellW, cellH int
+		gap          int
+		rows         int
+	}{
+		// Square tiles show a 90x120 center crop, with a 1px gap (1% of 90).
+		{name: "preview crop", grid: GridOptions{}, cellW: 90, cellH: 120, gap: 1, rows: 2},
+		{name: "full tiles without gap", grid: GridOptions{FullTiles: true, Gap: -1, Rows: 3}, cellW: 120, cellH: 120, rows: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiles, _, err := processor.ProcessGrid(src, "default", "", tt.grid, ProcessOptions{})
+			if err != nil {
+				t.Fatalf("ProcessGrid: %v", err)
+			}
+			if len(tiles) != GridColumns*tt.rows {
+				t.Fatalf("expected %d tiles, got %d", GridColumns*tt.rows, len(tiles))
+			}
+
+			mosaicW := GridColumns*tt.cellW + (GridColumns-1)*tt.gap
+			mosaicH := tt.rows*tt.cellH + (tt.rows-1)*tt.gap
+			mosaic, err := renderImage(src, resolved, config.Format{Type: "fixed", Width: mosaicW, Height: mosaicH}, ProcessOptions{}, nil)
+			if err != nil {
+				t.Fatalf("renderImage: %v", err)
+			}
+
+			marginX, marginY := (120-tt.cellW)/2, (120-tt.cellH)/2
+			for i, tile := range tiles {
+				if b := tile.Bounds(); b.Dx() != 120 || b.Dy() != 120 {
+					t.Fatalf("tile %d: expected 120x120, got %dx%d", i, b.Dx(), b.Dy())
+				}
+				// Posting order: the first tile goes to the bottom-right cell.
+				cell := len(tiles) - 1 - i
+				row, col := cell/GridColumns, cell%GridColumns
+				for y := 0; y < tt.cellH; y++ {
+					for x := 0; x < tt.cellW; x++ {
+						want := color.NRGBAModel.Convert(mosaic.At(col*(tt.cellW+tt.gap)+x, row*(tt.cellH+tt.gap)+y)).(color.NRGBA)
+						if !sameColor(tile.At(marginX+x, marginY+y), want) {
+							t.Fatalf("tile %d (row %d, col %d): pixel %d,%d differs from the mosaic", i, row, col, x, y)
+						}
+					}
+				}
+			}
+		})
+	}
+
+	_, _, err = processor.ProcessGrid(src, "default", "", GridOptions{Rows: MaxGridRows + 1}, ProcessOptions{})
+	var userErr UserError
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError for too many rows, got %v", err)
+	}
+}
@@ -0,0 +1,769 @@
+package instafix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// HEVCDecoder decodes one HEVC-coded HEIF item. config is the payload of the
+// item's hvcC property and data holds its length-prefixed NAL units.
+type HEVCDecoder func(config, data []byte) (image.Image, error)
+
+var (
+	hevcMu      sync.RWMutex
+	hevcDecoder HEVCDecoder
+)
+
+// RegisterHEVCDecoder installs a decoder for HEVC-coded HEIC items. None is
+// installed by default, so phone HEIC files, whose primary items and
+// thumbnails are HEVC-coded, fail with ErrUnsupportedCodec.
+// The decoder must not require cgo if the binary is built with CGO_ENABLED=0.
+func RegisterHEVCDecoder(dec HEVCDecoder) {
+	hevcMu.Lock()
+	defer hevcMu.Unlock()
+	hevcDecoder = dec
+}
+
+func currentHEVCDecoder() HEVCDecoder {
+	hevcMu.RLock()
+	defer hevcMu.RUnlock()
+	return hevcDecoder
+}
+
+// heifBrands lists ftyp brands of HEIF still images.
+var heifBrands = map[string]bool{
+	"heic": true,
+	"heix": true,
+	"heim": true,
+	"heis": true,
+	"mif1": true,
+	"msf1": true,
+}
+
+// heifMaxGridTiles caps the number of tiles of a grid item. Camera grids use
+// a few dozen tiles; the format allows up to 65536.
+const heifMaxGridTiles = 1024
+
+// heifCodedTypes lists item types that carry coded image data, as opposed to
+// derived items such as grids.
+var heifCodedTypes = map[string]bool{
+	"jpeg": true,
+	"hvc1": true,
+}
+
+type heifItem struct {
+	id          uint32
+	typ         string
+	contentType string // MIME type of "mime" items, e.g. XMP packets
+	method      int    // iloc construction method: 0 file offset, 1 idat
+	extents     [][2]uint64
+	props       []heifProperty
+	refs        map[string][]uint32 // outgoing references by type (dimg, thmb, cdsc)
+}
+
+type heifProperty struct {
+	typ  string
+	data []byte
+}
+
+type heifFile struct {
+	limits  DecodeOptions
+	data    []byte
+	idat    []byte
+	primary uint32
+	items   map[uint32]*heifItem
+	order   []uint32
+	decoded map[uint32]image.Image // items decoded so far, by id
+}
+
+// isHEIF reports whether data starts with an ftyp box of a HEIF still image.
+func isHEIF(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 16 || size > len(data) {
+		return false
+	}
+	if heifBrands[string(data[8:12])] {
+		return true
+	}
+	for p := 16; p+4 <= size; p += 4 {
+		if heifBrands[string(data[p:p+4])] {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeHEIF decodes the primary item of a HEIF/HEIC file and applies its
+// orientation. The HEIF irot/imir properties take precedence; the EXIF
+// orientation is used only when the item carries no transform properties.
+func decodeHEIF(data []byte, opts DecodeOptions) (image.Image, error) {
+	f, err := parseHEIF(data)
+	if err != nil {
+		return nil, err
+	}
+	f.limits = opts
+	primary, ok := f.items[f.primary]
+	if !ok {
+		return nil, fmt.Errorf("heif primary item %d not found", f.primary)
+	}
+
+	img, err := f.decodeItem(primary)
+	if err == nil {
+		return f.orient(primary, img), nil
+	}
+	var userErr UserError
+	if errors.As(err, &userErr) {
+		return nil, err
+	}
+	// Fall back to thumbnails of the primary item the container can decode.
+	for _, id := range f.order {
+		item := f.items[id]
+		if !containsID(item.refs["thmb"], primary.id) {
+			continue
+		}
+		if thumb, terr := f.decodeItem(item); terr == nil {
+			return f.orient(item, thumb), nil
+		}
+	}
+	return nil, err
+}
+
+func parseHEIF(data []byte) (*heifFile, error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	var meta []byte
+	for _, b := range boxes {
+		if b.typ == "meta" {
+			meta = b.data
+			break
+		}
+	}
+	if len(meta) < 4 {
+		return nil, fmt.Errorf("heif meta box not found")
+	}
+	children, err := readBoxes(meta[4:])
+	if err != nil {
+		return nil, fmt.Errorf("heif meta: %w", err)
+	}
+
+	f := &heifFile{data: data, items: make(map[uint32]*heifItem), decoded: make(map[uint32]image.Image)}
+	var iloc, iref, iprp []byte
+	for _, b := range children {
+		switch b.typ {
+		case "pitm":
+			r := bmffReader{data: b.data}
+			if r.fullBox() == 0 {
+				f.primary = uint32(r.u16())
+			} else {
+				f.primary = r.u32()
+			}
+			if r.err != nil {
+				return nil, fmt.Errorf("heif pitm: %w", r.err)
+			}
+		case "iinf":
+			if err := f.parseIinf(b.data); err != nil {
+				return nil, err
+			}
+		case "iloc":
+			iloc = b.data
+		case "iref":
+			iref = b.data
+		case "iprp":
+			iprp = b.data
+		case "idat":
+			f.idat = b.data
+		}
+	}
+	if iloc == nil {
+		return nil, fmt.Errorf("heif iloc box not found")
+	}
+	if err := f.parseIloc(iloc); err != nil {
+		return nil, err
+	}
+	if iref != nil {
+		if err := f.parseIref(iref); err != nil {
+			return nil, err
+		}
+	}
+	if iprp != nil {
+		if err := f.parseIprp(iprp); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *heifFile) item(id uint32) *heifItem {
+	item, ok := f.items[id]
+	if !ok {
+		item = &heifItem{id: id, refs: make(map[string][]uint32)}
+		f.items[id] = item
+		f.order = append(f.order, id)
+	}
+	return item
+}
+
+func (f *heifFile) parseIinf(data []byte) error {
+	r := bmffReader{data: data}
+	if r.fullBox() == 0 {
+		r.u16()
+	} else {
+		r.u32()
+	}
+	if r.err != nil {
+		return fmt.Errorf("heif iinf: %w", r.err)
+	}
+	boxes, err := readBoxes(data[r.pos:])
+	if err != nil {
+		return fmt.Errorf("heif iinf: %w", err)
+	}
+	for _, b := range boxes {
+		if b.typ != "infe" {
+			continue
+		}
+		br := bmffReader{data: b.data}
+		version := br.fullBox()
+		if version < 2 {
+			continue
+		}
+		var id uint32
+		if version == 2 {
+			id = uint32(br.u16())
+		} else {
+			id = br.u32()
+		}
+		br.u16() // protection index
+		typ := br.fourCC()
+		if br.err != nil {
+			return fmt.Errorf("heif infe: %w", br.err)
+		}
+		item := f.item(id)
+		item.typ = typ
+		if typ == "mime" {
+			br.cString() // item name
+			item.contentType = br.cString()
+		}
+	}
+	return nil
+}
+
+func (f *heifFile) parseIloc(data []byte) error {
+	r := bmffReader{data: data}
+	version := r.fullBox()
+	sizes := r.u16()
+	offsetSize := int(sizes >> 12)
+	lengthSize := int(sizes >> 8 & 0xF)
+	baseOffsetSize := int(sizes >> 4 & 0xF)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xF)
+	}
+	var count uint32
+	if version < 2 {
+		count = uint32(r.u16())
+	} else {
+		count = r.u32()
+	}
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(r.u16())
+		} else {
+			id = r.u32()
+		}
+		item := f.item(id)
+		if version == 1 || version == 2 {
+			item.method = int(r.u16() & 0xF)
+		}
+		r.u16() // data reference index
+		base := r.uN(baseOffsetSize)
+		extents := int(r.u16())
+		for j := 0; j < extents && r.err == nil; j++ {
+			r.uN(indexSize)
+			off := r.uN(offsetSize)
+			length := r.uN(lengthSize)
+			item.extents = append(item.extents, [2]uint64{base + off, length})
+		}
+	}
+	if r.err != nil {
+		return fmt.Errorf("heif iloc: %w", r.err)
+	}
+	return nil
+}
+
+func (f *heifFile) parseIref(data []byte) error {
+	r := bmffReader{data: data}
+	version := r.fullBox()
+	if r.err != nil {
+		return fmt.Errorf("heif iref: %w", r.err)
+	}
+	boxes, err := readBoxes(data[r.pos:])
+	if err != nil {
+		return fmt.Errorf("heif iref: %w", err)
+	}
+	for _, b := range boxes {
+		br := bmffReader{data: b.data}
+		readID := func() uint32 {
+			if version == 0 {
+				return uint32(br.u16())
+			}
+			return br.u32()
+		}
+		from := readID()
+		n := int(br.u16())
+		item := f.item(from)
+		for i := 0; i < n && br.err == nil; i++ {
+			item.refs[b.typ] = append(item.refs[b.typ], readID())
+		}
+		if br.err != nil {
+			return fmt.Errorf("heif iref %s: %w", b.typ, br.err)
+		}
+	}
+	return nil
+}
+
+func (f *heifFile) parseIprp(data []byte) error {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return fmt.Errorf("heif iprp: %w", err)
+	}
+	var props []heifProperty
+	var ipma []byte
+	for _, b := range boxes {
+		switch b.typ {
+		case "ipco":
+			children, err := readBoxes(b.data)
+			if err != nil {
+				return fmt.Errorf("heif ipco: %w", err)
+			}
+			for _, c := range children {
+				props = append(props, heifProperty{typ: c.typ, data: c.data})
+			}
+		case "ipma":
+			ipma = b.data
+		}
+	}
+	if ipma == nil {
+		return nil
+	}
+
+	r := bmffReader{data: ipma}
+	version := r.fullBox()
+	wide := r.flags&1 != 0
+	count := r.u32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var id uint32
+		if version < 1 {
+			id = uint32(r.u16())
+		} else {
+			id = r.u32()
+		}
+		item := f.item(id)
+		n := int(r.u8())
+		for j := 0; j < n && r.err == nil; j++ {
+			var index int
+			if wide {
+				index = int(r.u16() & 0x7FFF)
+			} else {
+				index = int(r.u8() & 0x7F)
+			}
+			// Property indices are 1-based; 0 means "no property".
+			if index > 0 && index <= len(props) {
+				item.props = append(item.props, props[index-1])
+			}
+		}
+	}
+	if r.err != nil {
+		return fmt.Errorf("heif ipma: %w", r.err)
+	}
+	return nil
+}
+
+// payload concatenates the extents of an item. The total is capped at the
+// size of the source, so repeated extents cannot amplify a small file.
+func (f *heifFile) payload(item *heifItem) ([]byte, error) {
+	src := f.data
+	if item.method == 1 {
+		src = f.idat
+	} else if item.method != 0 {
+		return nil, fmt.Errorf("heif item %d uses unsupported construction method %d", item.id, item.method)
+	}
+	var out []byte
+	for _, e := range item.extents {
+		off, length := e[0], e[1]
+		if off > uint64(len(src)) {
+			return nil, fmt.Errorf("heif item %d extent out of range", item.id)
+		}
+		if length == 0 {
+			length = uint64(len(src)) - off
+		}
+		if length > uint64(len(src))-off {
+			return nil, fmt.Errorf("heif item %d extent out of range", item.id)
+		}
+		if uint64(len(out))+length > uint64(len(src)) {
+			return nil, fmt.Errorf("heif item %d extents exceed the file size", item.id)
+		}
+		out = append(out, src[off:off+length]...)
+	}
+	return out, nil
+}
+
+// decodeItem decodes an item once; later calls return the cached image.
+func (f *heifFile) decodeItem(item *heifItem) (image.Image, error) {
+	if img, ok := f.decoded[item.id]; ok {
+		return img, nil
+	}
+	img, err := f.decodeItemData(item)
+	if err != nil {
+		return nil, err
+	}
+	f.decoded[item.id] = img
+	return img, nil
+}
+
+func (f *heifFile) decodeItemData(item *heifItem) (image.Image, error) {
+	if w, h, ok := item.size(); ok {
+		if err := f.limits.checkSize(w, h); err != nil {
+			return nil, err
+		}
+	}
+	switch item.typ {
+	case "jpeg":
+		data, err := f.payload(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.limits.checkConfig(data); err != nil {
+			return nil, err
+		}
+		return imaging.Decode(bytes.NewReader(data))
+	case "hvc1":
+		dec := currentHEVCDecoder()
+		if dec == nil {
+			return nil, fmt.Errorf("%w: heif item %d is HEVC-coded (e.g. a phone photo) and no HEVC decoder is available; convert it to JPEG", ErrUnsupportedCodec, item.id)
+		}
+		data, err := f.payload(item)
+		if err != nil {
+			return nil, err
+		}
+		config := item.property("hvcC")
+		if config == nil {
+			return nil, fmt.Errorf("heif item %d has no hvcC property", item.id)
+		}
+		return dec(config.data, data)
+	case "grid":
+		return f.decodeGrid(item)
+	default:
+		return nil, fmt.Errorf("heif item %d has unsupported type %q", item.id, item.typ)
+	}
+}
+
+// decodeGrid assembles a derived grid image from its dimg tiles.
+func (f *heifFile) decodeGrid(item *heifItem) (image.Image, error) {
+	data, err := f.payload(item)
+	if err != nil {
+		return nil, err
+	}
+	r := bmffReader{data: data}
+	r.u8() // version
+	flags := r.u8()
+	rows := int(r.u8()) + 1
+	cols := int(r.u8()) + 1
+	fieldSize := 2
+	if flags&1 != 0 {
+		fieldSize = 4
+	}
+	width := int(r.uN(fieldSize))
+	height := int(r.uN(fieldSize))
+	if r.err != nil {
+		return nil, fmt.Errorf("heif grid: %w", r.err)
+	}
+	if err := f.limits.checkSize(width, height); err != nil {
+		return nil, err
+	}
+	if rows*cols > heifMaxGridTiles {
+		return nil, fmt.Errorf("heif grid has %d tiles, limit is %d", rows*cols, heifMaxGridTiles)
+	}
+	tiles := item.refs["dimg"]
+	if len(tiles) != rows*cols {
+		return nil, fmt.Errorf("heif grid expects %d tiles, found %d", rows*cols, len(tiles))
+	}
+
+	// Tiles must be coded items of one declared size that covers the grid.
+	// Rejecting derived tiles keeps a grid that references itself, directly
+	// or through another grid, from recursing. Everything is checked before
+	// any tile is decoded.
+	tileItems := make([]*heifItem, len(tiles))
+	tileW, tileH := 0, 0
+	for i, id := range tiles {
+		tileItem, ok := f.items[id]
+		if !ok {
+			return nil, fmt.Errorf("heif grid tile %d not found", id)
+		}
+		if !heifCodedTypes[tileItem.typ] {
+			return nil, fmt.Errorf("heif grid tile %d has unsupported type %q", id, tileItem.typ)
+		}
+		w, h, ok := tileItem.size()
+		if !ok {
+			return nil, fmt.Errorf("heif grid tile %d has no ispe property", id)
+		}
+		if i == 0 {
+			tileW, tileH = w, h
+		} else if w != tileW || h != tileH {
+			return nil, fmt.Errorf("heif grid tile %d is %dx%d, expected %dx%d", id, w, h, tileW, tileH)
+		}
+		tileItems[i] = tileItem
+	}
+	if tileW <= 0 || tileH <= 0 ||
+		tileW*cols < width || tileW*(cols-1) >= width ||
+		tileH*rows < height || tileH*(rows-1) >= height {
+		return nil, fmt.Errorf("heif grid %dx%d does not match %dx%d tiles of %dx%d", width, height, cols, rows, tileW, tileH)
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i, tileItem := range tileItems {
+		tile, err := f.decodeItem(tileItem)
+		if err != nil {
+			return nil, err
+		}
+		tb := tile.Bounds()
+		if tb.Dx() != tileW || tb.Dy() != tileH {
+			return nil, fmt.Errorf("heif grid tile %d decoded to %dx%d, expected %dx%d", tileItem.id, tb.Dx(), tb.Dy(), tileW, tileH)
+		}
+		x, y := i%cols*tileW, i/cols*tileH
+		draw.Draw(canvas, image.Rect(x, y, x+tileW, y+tileH), tile, tb.Min, draw.Src)
+	}
+	return canvas, nil
+}
+
+// orient applies the item's irot/imir transforms, or the EXIF orientation of
+// the primary item when no transform properties are present.
+func (f *heifFile) orient(item *heifItem, img image.Image) image.Image {
+	transformed := false
+	for _, p := range item.props {
+		switch p.typ {
+		case "irot":
+			if len(p.data) < 1 {
+				continue
+			}
+			transformed = true
+			switch p.data[0] & 3 {
+			case 1:
+				img = imaging.Rotate90(img)
+			case 2:
+				img = imaging.Rotate180(img)
+			case 3:
+				img = imaging.Rotate270(img)
+			}
+		case "imir":
+			if len(p.data) < 1 {
+				continue
+			}
+			transformed = true
+			if p.data[0]&1 == 0 {
+				img = imaging.FlipH(img)
+			} else {
+				img = imaging.FlipV(img)
+			}
+		}
+	}
+	if transformed {
+		return img
+	}
+	return applyOrientation(img, f.exifOrientation())
+}
+
+// exifOrientation reads the orientation from the Exif item describing the primary item.
+func (f *heifFile) exifOrientation() int {
+	for _, id := range f.order {
+		item := f.items[id]
+		if item.typ != "Exif" || !containsID(item.refs["cdsc"], f.primary) {
+			continue
+		}
+		data, err := f.payload(item)
+		if err != nil || len(data) < 4 {
+			continue
+		}
+		off := 4 + int(binary.BigEndian.Uint32(data))
+		t, err := newTIFFReader(data, off)
+		if err != nil {
+			continue
+		}
+		ifd0, err := t.readIFD(t.first)
+		if err != nil {
+			continue
+		}
+		if v, ok := t.uint(ifd0, tagOrientation); ok {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// size returns the image size declared by the item's ispe property.
+func (item *heifItem) size() (w, h int, ok bool) {
+	ispe := item.property("ispe")
+	if ispe == nil || len(ispe.data) < 12 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint32(ispe.data[4:])), int(binary.BigEndian.Uint32(ispe.data[8:])), true
+}
+
+func (item *heifItem) property(typ string) *heifProperty {
+	for i := range item.props {
+		if item.props[i].typ == typ {
+			return &item.props[i]
+		}
+	}
+	return nil
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+type bmffBox struct {
+	typ  string
+	data []byte
+}
+
+// readBoxes splits data into consecutive ISOBMFF boxes.
+func readBoxes(data []byte) ([]bmffBox, error) {
+	var boxes []bmffBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, fmt.Errorf("box %q has invalid size %d", typ, size)
+		}
+		boxes = append(boxes, bmffBox{typ: typ, data: data[header:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// bmffReader reads big-endian fields and remembers the first error.
+type bmffReader struct {
+	data  []byte
+	pos   int
+	flags uint32
+	err   error
+}
+
+func (r *bmffReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("unexpected end of box data")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// fullBox reads the version and flags of a full box and returns the version.
+func (r *bmffReader) fullBox() int {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	r.flags = uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	return int(b[0])
+}
+
+func (r *bmffReader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *bmffReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *bmffReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// uN reads an unsigned field of 0, 2, 4 or 8 bytes.
+func (r *bmffReader) uN(size int) uint64 {
+	switch size {
+	case 0:
+		return 0
+	case 2:
+		return uint64(r.u16())
+	case 4:
+		return uint64(r.u32())
+	case 8:
+		if b := r.take(8); b != nil {
+			return binary.BigEndian.Uint64(b)
+		}
+		return 0
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unsupported field size %d", size)
+		}
+		return 0
+	}
+}
+
+// cString reads a null-terminated string; a missing terminator ends at the box end.
+func (r *bmffReader) cString() string {
+	if r.err != nil || r.pos >= len(r.data) {
+		return ""
+	}
+	rest := r.data[r.pos:]
+	if i := bytes.IndexByte(rest, 0); i >= 0 {
+		r.pos += i + 1
+		return string(rest[:i])
+	}
+	r.pos = len(r.data)
+	return string(rest)
+}
+
+func (r *bmffReader) fourCC() string {
+	if b := r.take(4); b != nil {
+		return string(b)
+	}
+	return ""
+}
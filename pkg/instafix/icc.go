@@ -0,0 +1,590 @@
+package instafix
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	iccHeaderSize = 128
+	// iccMaxSize guards decompression of PNG iCCP chunks.
+	iccMaxSize     = 4 << 20
+	jpegICCHeader  = "ICC_PROFILE\x00"
+	jpegICCChunk   = 0xFFFF - 2 - len(jpegICCHeader) - 2
+	tagInterColor  = 0x8773 // TIFF InterColorProfile
+	iccIdentityEps = 0.002
+)
+
+// srgbD50 holds the sRGB colorants adapted to the D50 PCS (Bradford),
+// as found in the rXYZ/gXYZ/bXYZ tags of sRGB ICC profiles. Columns are
+// the red, green and blue colorants.
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// iccProfile is an RGB matrix/TRC profile: per-channel tone curves followed
+// by a 3x3 matrix into PCS XYZ.
+type iccProfile struct {
+	description string
+	matrix      [3][3]float64
+	curves      [3]iccCurve
+}
+
+// iccCurve is a curv or para tone curve mapping device values to linear light.
+type iccCurve struct {
+	table  []float64 // curv table, evenly spaced over 0..1
+	params []float64 // para function type parameters, or a single gamma
+	fn     int       // para function type
+}
+
+func (c iccCurve) eval(x float64) float64 {
+	x = clamp01(x)
+	if len(c.table) > 0 {
+		pos := x * float64(len(c.table)-1)
+		i := int(pos)
+		if i >= len(c.table)-1 {
+			return c.table[len(c.table)-1]
+		}
+		frac := pos - float64(i)
+		return c.table[i]*(1-frac) + c.table[i+1]*frac
+	}
+	if len(c.params) == 0 {
+		return x
+	}
+	p := c.params
+	g := p[0]
+	switch {
+	case c.fn == 1 && len(p) >= 3:
+		if x >= -p[2]/p[1] {
+			return curvePow(p[1]*x+p[2], g)
+		}
+		return 0
+	case c.fn == 2 && len(p) >= 4:
+		if x >= -p[2]/p[1] {
+			return curvePow(p[1]*x+p[2], g) + p[3]
+		}
+		return p[3]
+	case c.fn == 3 && len(p) >= 5:
+		if x >= p[4] {
+			return curvePow(p[1]*x+p[2], g)
+		}
+		return p[3] * x
+	case c.fn == 4 && len(p) >= 7:
+		if x >= p[4] {
+			return curvePow(p[1]*x+p[2], g) + p[5]
+		}
+		return p[3]*x + p[6]
+	default:
+		return curvePow(x, g)
+	}
+}
+
+// curvePow is base^g for para curves. Profiles may put the break point where
+// the base is still negative, which would make math.Pow return NaN; such
+// bases and non-finite results map to 0.
+func curvePow(base, g float64) float64 {
+	if base <= 0 {
+		return 0
+	}
+	v := math.Pow(base, g)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
+	}
+	return v
+}
+
+// iccColorSpace returns the data color space signature of an ICC profile, e.g. "RGB ".
+func iccColorSpace(data []byte) string {
+	if len(data) < iccHeaderSize || string(data[36:40]) != "acsp" {
+		return ""
+	}
+	return string(data[16:20])
+}
+
+// parseICC reads the tone curves and colorants of an RGB matrix/TRC profile.
+// LUT-based profiles and other color spaces are reported as errors.
+func parseICC(data []byte) (*iccProfile, error) {
+	if iccColorSpace(data) != "RGB " {
+		return nil, fmt.Errorf("icc: not an rgb profile")
+	}
+	if string(data[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("icc: unsupported pcs %q", data[20:24])
+	}
+	if len(data) < iccHeaderSize+4 {
+		return nil, fmt.Errorf("icc: truncated tag table")
+	}
+	count := int(binary.BigEndian.Uint32(data[iccHeaderSize:]))
+	if count < 0 || count > (len(data)-iccHeaderSize-4)/12 {
+		return nil, fmt.Errorf("icc: invalid tag count %d", count)
+	}
+	tags := make(map[string][]byte, count)
+	for i := 0; i < count; i++ {
+		p := iccHeaderSize + 4 + 12*i
+		sig := string(data[p : p+4])
+		off := int(binary.BigEndian.Uint32(data[p+4:]))
+		size := int(binary.BigEndian.Uint32(data[p+8:]))
+		if off < 0 || size < 8 || off+size > len(data) || off+size < off {
+			continue
+		}
+		tags[sig] = data[off : off+size]
+	}
+
+	prof := &iccProfile{description: iccDescription(tags["desc"])}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := iccXYZ(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("icc %s: %w", sig, err)
+		}
+		for row := 0; row < 3; row++ {
+			prof.matrix[row][i] = xyz[row]
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := iccParseCurve(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("icc %s: %w", sig, err)
+		}
+		prof.curves[i] = curve
+	}
+	return prof, nil
+}
+
+func iccXYZ(tag []byte) ([3]float64, error) {
+	var xyz [3]float64
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return xyz, fmt.Errorf("missing or invalid XYZ tag")
+	}
+	for i := range xyz {
+		xyz[i] = s15Fixed16(tag[8+4*i:])
+	}
+	return xyz, nil
+}
+
+func iccParseCurve(tag []byte) (iccCurve, error) {
+	if len(tag) < 12 {
+		return iccCurve{}, fmt.Errorf("missing or invalid curve")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return iccCurve{}, nil
+		case n == 1 && len(tag) >= 14:
+			return iccCurve{params: []float64{float64(binary.BigEndian.Uint16(tag[12:])) / 256}}, nil
+		case n > 1 && len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return iccCurve{table: table}, nil
+		}
+	case "para":
+		fn := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if fn >= len(counts) || len(tag) < 12+4*counts[fn] {
+			break
+		}
+		params := make([]float64, counts[fn])
+		for i := range params {
+			params[i] = s15Fixed16(tag[12+4*i:])
+		}
+		return iccCurve{params: params, fn: fn}, nil
+	}
+	return iccCurve{}, fmt.Errorf("unsupported curve %q", tag[:4])
+}
+
+// iccDescription reads a v2 desc or v4 mluc profile description.
+func iccDescription(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > 0 && 12+n <= len(tag) {
+			return strings.TrimRight(string(tag[12:12+n]), "\x00")
+		}
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		off := int(binary.BigEndian.Uint32(tag[24:]))
+		if n <= 0 || off+n > len(tag) {
+			return ""
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[off+2*i:])
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// isSRGB reports whether the profile matches sRGB closely enough to skip conversion.
+func (p *iccProfile) isSRGB() bool {
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			if math.Abs(p.matrix[row][col]-srgbD50[row][col]) > iccIdentityEps {
+				return false
+			}
+		}
+	}
+	for _, c := range p.curves {
+		for i := 0; i <= 16; i++ {
+			x := float64(i) / 16
+			if math.Abs(c.eval(x)-srgbToLinear(x)) > iccIdentityEps {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// convertToSRGB converts img from the given ICC profile to sRGB.
+// It reports false when the profile is sRGB already or cannot be converted.
+func convertToSRGB(img image.Image, icc []byte) (image.Image, bool) {
+	prof, err := parseICC(icc)
+	if err != nil || prof.isSRGB() {
+		return img, false
+	}
+	inv, ok := invert3(srgbD50)
+	if !ok {
+		return img, false
+	}
+	m := mul3(inv, prof.matrix)
+
+	var in [3][256]float64
+	for ch := range in {
+		for v := range in[ch] {
+			in[ch][v] = prof.curves[ch].eval(float64(v) / 255)
+		}
+	}
+	const outSize = 4096
+	var out [outSize + 1]uint8
+	for i := range out {
+		out[i] = uint8(math.Round(linearToSRGB(float64(i)/outSize) * 255))
+	}
+
+	dst := imaging.Clone(img)
+	pix := dst.Pix
+	for i := 0; i+3 < len(pix); i += 4 {
+		r, g, b := in[0][pix[i]], in[1][pix[i+1]], in[2][pix[i+2]]
+		for ch := 0; ch < 3; ch++ {
+			v := clamp01(m[ch][0]*r + m[ch][1]*g + m[ch][2]*b)
+			pix[i+ch] = out[int(v*outSize+0.5)]
+		}
+	}
+	return dst, true
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// clamp01 limits v to 0..1; NaN maps to 0 so it can never become an index.
+func clamp01(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return math.Max(0, math.Min(1, v))
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func invert3(m [3][3]float64) ([3][3]float64, bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return [3][3]float64{}, false
+	}
+	var inv [3][3]float64
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return inv, true
+}
+
+// extractICC returns the ICC profile describing the decoded pixels: the
+// preview's profile for RAW files, otherwise the container's profile.
+func extractICC(data []byte, decoded *Decoded) []byte {
+	if p := decoded.Preview; p != nil {
+		if p.Offset >= 0 && p.Offset+p.Length <= len(data) {
+			return jpegICC(data[p.Offset : p.Offset+p.Length])
+		}
+		return nil
+	}
+	switch decoded.Container {
+	case ContainerJPEG:
+		return jpegICC(data)
+	case ContainerPNG:
+		return pngICC(data)
+	case ContainerWebP:
+		return webpICC(data)
+	case ContainerTIFF:
+		return tiffICC(data)
+	case ContainerHEIC:
+		return heifICC(data)
+	}
+	return nil
+}
+
+// jpegICC reassembles an ICC profile split over APP2 segments.
+func jpegICC(data []byte) []byte {
+	chunks := make(map[int][]byte)
+	total := 0
+	forEachJPEGSegment(data, func(marker byte, payload []byte) {
+		if marker != 0xE2 || !bytes.HasPrefix(payload, []byte(jpegICCHeader)) || len(payload) < len(jpegICCHeader)+2 {
+			return
+		}
+		seq := int(payload[len(jpegICCHeader)])
+		total = int(payload[len(jpegICCHeader)+1])
+		chunks[seq] = payload[len(jpegICCHeader)+2:]
+	})
+	if total == 0 || len(chunks) != total {
+		return nil
+	}
+	var icc []byte
+	for seq := 1; seq <= total; seq++ {
+		chunk, ok := chunks[seq]
+		if !ok {
+			return nil
+		}
+		icc = append(icc, chunk...)
+	}
+	return icc
+}
+
+func pngICC(data []byte) []byte {
+	var icc []byte
+	forEachPNGChunk(data, func(typ string, payload []byte) {
+		if typ != "iCCP" || icc != nil {
+			return
+		}
+		// profile name\0 compression-method zlib-data
+		nul := bytes.IndexByte(payload, 0)
+		if nul < 0 || nul+2 > len(payload) || payload[nul+1] != 0 {
+			return
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(payload[nul+2:]))
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		raw, err := io.ReadAll(io.LimitReader(zr, iccMaxSize+1))
+		if err != nil || len(raw) > iccMaxSize {
+			return
+		}
+		icc = raw
+	})
+	return icc
+}
+
+func webpICC(data []byte) []byte {
+	i := 12
+	for i+8 <= len(data) {
+		typ := string(data[i : i+4])
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if n < 0 || i+8+n > len(data) {
+			return nil
+		}
+		if typ == "ICCP" {
+			return append([]byte(nil), data[i+8:i+8+n]...)
+		}
+		i += 8 + n + n%2
+	}
+	return nil
+}
+
+func tiffICC(data []byte) []byte {
+	t, err := newTIFFReader(data, 0)
+	if err != nil {
+		return nil
+	}
+	ifd, err := t.readIFD(t.first)
+	if err != nil {
+		return nil
+	}
+	e, ok := ifd.entries[tagInterColor]
+	if !ok {
+		return nil
+	}
+	return append([]byte(nil), t.data[e.pos:e.pos+int(e.count)*tiffTypeSize(e.typ)]...)
+}
+
+func heifICC(data []byte) []byte {
+	f, err := parseHEIF(data)
+	if err != nil {
+		return nil
+	}
+	item := f.items[f.primary]
+	if item == nil {
+		return nil
+	}
+	for _, prop := range item.props {
+		// colr: colour_type followed by the profile for prof/rICC.
+		if prop.typ == "colr" && len(prop.data) > 4 {
+			switch string(prop.data[:4]) {
+			case "prof", "rICC":
+				return append([]byte(nil), prop.data[4:]...)
+			}
+		}
+	}
+	return nil
+}
+
+// jpegICCSegments splits an ICC profile into APP2 segments.
+func jpegICCSegments(icc []byte) [][]byte {
+	total := (len(icc) + jpegICCChunk - 1) / jpegICCChunk
+	if total == 0 || total > 255 {
+		return nil
+	}
+	segments := make([][]byte, 0, total)
+	for seq := 1; seq <= total; seq++ {
+		chunk := icc[(seq-1)*jpegICCChunk:]
+		if len(chunk) > jpegICCChunk {
+			chunk = chunk[:jpegICCChunk]
+		}
+		payload := append([]byte{byte(seq), byte(total)}, chunk...)
+		segments = append(segments, jpegSegment(0xE2, jpegICCHeader, payload))
+	}
+	return segments
+}
+
+var (
+	srgbICCOnce sync.Once
+	srgbICCData []byte
+)
+
+// srgbICC returns a compact ICC v2 sRGB profile embedded in outputs.
+func srgbICC() []byte {
+	srgbICCOnce.Do(func() {
+		curve := make([]uint16, 1024)
+		for i := range curve {
+			curve[i] = uint16(math.Round(srgbToLinear(float64(i)/float64(len(curve)-1)) * 65535))
+		}
+		srgbICCData = buildICCProfile("sRGB IEC61966-2.1", srgbD50, curve)
+	})
+	return srgbICCData
+}
+
+// buildICCProfile writes an ICC v2 display profile with a shared tone curve.
+func buildICCProfile(desc string, matrix [3][3]float64, curve []uint16) []byte {
+	be := binary.BigEndian
+	xyzTag := func(x, y, z float64) []byte {
+		b := make([]byte, 20)
+		copy(b, "XYZ ")
+		for i, v := range []float64{x, y, z} {
+			be.PutUint32(b[8+4*i:], uint32(int32(math.Round(v*65536))))
+		}
+		return b
+	}
+
+	descTag := make([]byte, 12, 12+len(desc)+1+78)
+	copy(descTag, "desc")
+	be.PutUint32(descTag[8:], uint32(len(desc)+1))
+	descTag = append(descTag, desc...)
+	descTag = append(descTag, 0)
+	descTag = append(descTag, make([]byte, 78)...) // empty Unicode and ScriptCode records
+
+	cprt := append([]byte("text\x00\x00\x00\x00"), "No copyright, use freely\x00"...)
+
+	trc := make([]byte, 12+2*len(curve))
+	copy(trc, "curv")
+	be.PutUint32(trc[8:], uint32(len(curve)))
+	for i, v := range curve {
+		be.PutUint16(trc[12+2*i:], v)
+	}
+
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{
+		{"desc", descTag},
+		{"cprt", cprt},
+		{"wtpt", xyzTag(0.9642, 1, 0.8249)},
+		{"rXYZ", xyzTag(matrix[0][0], matrix[1][0], matrix[2][0])},
+		{"gXYZ", xyzTag(matrix[0][1], matrix[1][1], matrix[2][1])},
+		{"bXYZ", xyzTag(matrix[0][2], matrix[1][2], matrix[2][2])},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+
+	buf := make([]byte, iccHeaderSize+4+12*len(tags))
+	be.PutUint32(buf[iccHeaderSize:], uint32(len(tags)))
+	offsets := make(map[*byte]int)
+	for i, t := range tags {
+		off, ok := offsets[&t.data[0]]
+		if !ok {
+			off = len(buf)
+			offsets[&t.data[0]] = off
+			buf = append(buf, t.data...)
+			for len(buf)%4 != 0 {
+				buf = append(buf, 0)
+			}
+		}
+		p := iccHeaderSize + 4 + 12*i
+		copy(buf[p:], t.sig)
+		be.PutUint32(buf[p+4:], uint32(off))
+		be.PutUint32(buf[p+8:], uint32(len(t.data)))
+	}
+
+	be.PutUint32(buf[0:], uint32(len(buf)))
+	be.PutUint32(buf[8:], 0x02100000)
+	copy(buf[12:], "mntr")
+	copy(buf[16:], "RGB ")
+	copy(buf[20:], "XYZ ")
+	copy(buf[36:], "acsp")
+	// D50 illuminant
+	be.PutUint32(buf[68:], uint32(int32(math.Round(0.9642*65536))))
+	be.PutUint32(buf[72:], uint32(int32(math.Round(1.0*65536))))
+	be.PutUint32(buf[76:], uint32(int32(math.Round(0.8249*65536))))
+	return buf
+}
@@ -0,0 +1,220 @@
+package instafix
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// Display P3 and Adobe RGB (1998) colorants adapted to D50.
+var (
+	displayP3D50 = [3][3]float64{
+		{0.515102, 0.291965, 0.157153},
+		{0.241182, 0.692236, 0.066582},
+		{-0.001050, 0.041881, 0.784378},
+	}
+	adobeRGBD50 = [3][3]float64{
+		{0.609741, 0.205276, 0.149185},
+		{0.311111, 0.625671, 0.063217},
+		{0.019470, 0.060867, 0.744568},
+	}
+)
+
+func TestConvertToSRGB(t *testing.T) {
+	srgbCurve := testICCCurve(srgbToLinear)
+	gamma22 := testICCCurve(func(v float64) float64 { return math.Pow(v, 563.0/256) })
+
+	tests := []struct {
+		name      string
+		icc       []byte
+		in        color.NRGBA
+		converted bool
+		check     func(c color.NRGBA) bool
+	}{
+		{
+			name: "srgb is left alone",
+			icc:  srgbICC(),
+			in:   color.NRGBA{R: 200, G: 100, B: 100, A: 255},
+		},
+		{
+			name:      "display p3 gains saturation",
+			icc:       buildICCProfile("Display P3", displayP3D50, srgbCurve),
+			in:        color.NRGBA{R: 200, G: 100, B: 100, A: 255},
+			converted: true,
+			check:     func(c color.NRGBA) bool { return c.R > 205 && c.G < 95 },
+		},
+		{
+			name:      "display p3 keeps gray",
+			icc:       buildICCProfile("Display P3", displayP3D50, srgbCurve),
+			in:        color.NRGBA{R: 128, G: 128, B: 128, A: 255},
+			converted: true,
+			check:     func(c color.NRGBA) bool { return near(c.R, 128) && near(c.G, 128) && near(c.B, 128) },
+		},
+		{
+			name:      "adobe rgb gains saturation",
+			icc:       buildICCProfile("Adobe RGB (1998)", adobeRGBD50, gamma22),
+			in:        color.NRGBA{R: 100, G: 200, B: 100, A: 128},
+			converted: true,
+			check:     func(c color.NRGBA) bool { return c.R < 80 && c.G >= 195 && c.A == 128 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+			for i := 0; i < len(src.Pix); i += 4 {
+				src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = tt.in.R, tt.in.G, tt.in.B, tt.in.A
+			}
+			out, converted := convertToSRGB(src, tt.icc)
+			if converted != tt.converted {
+				t.Fatalf("converted = %v, want %v", converted, tt.converted)
+			}
+			got := color.NRGBAModel.Convert(out.At(1, 1)).(color.NRGBA)
+			if tt.check != nil && !tt.check(got) {
+				t.Fatalf("unexpected color %v for %v", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestConvertToSRGB_HostileParaCurve(t *testing.T) {
+	// A para type 3 curve with g=2.2, a=1, b=-0.5 and the break point at 0:
+	// a*x+b is negative for x < 0.5, where math.Pow returns NaN.
+	icc := withParaCurve(buildICCProfile("Display P3", displayP3D50, make([]uint16, 10)), 3, []float64{2.2, 1, -0.5, 0, 0})
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(src.Pix); i += 4 {
+		v := uint8(i / 4)
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = v, 255-v, v/2, 255
+	}
+	out, converted := convertToSRGB(src, icc)
+	if !converted {
+		t.Fatal("expected the profile to be converted")
+	}
+	if got := color.NRGBAModel.Convert(out.At(0, 0)).(color.NRGBA); got.R != 0 {
+		t.Fatalf("expected a negative curve base to map to black, got %v", got)
+	}
+
+	curve := iccCurve{fn: 3, params: []float64{2.2, 1, -0.5, 0, 0}}
+	for _, x := range []float64{0, 0.25, 0.5, 1, math.NaN()} {
+		if v := curve.eval(x); math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Fatalf("eval(%v) = %v, want a finite value", x, v)
+		}
+	}
+	if clamp01(math.NaN()) != 0 {
+		t.Fatal("expected clamp01(NaN) = 0")
+	}
+}
+
+func TestDecodeImage_ConvertsJPEGICCToSRGB(t *testing.T) {
+	p3 := buildICCProfile("Display P3", displayP3D50, testICCCurve(srgbToLinear))
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, solidImage(16, 16, color.NRGBA{R: 200, G: 100, B: 100, A: 255}), 95, Metadata{ICC: p3}); err != nil {
+		t.Fatalf("EncodeJPEG: %v", err)
+	}
+
+	decoded, err := DecodeImage(bytes.NewReader(buf.Bytes()), "p3.jpg")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.ColorProfile != "Display P3" {
+		t.Fatalf("expected Display P3 profile, got %q", decoded.ColorProfile)
+	}
+	if !bytes.Equal(decoded.Metadata.ICC, srgbICC()) {
+		t.Fatal("expected the converted image to carry the sRGB profile")
+	}
+	if c := color.NRGBAModel.Convert(decoded.Image.At(8, 8)).(color.NRGBA); c.R < 205 {
+		t.Fatalf("expected pixels converted to sRGB, got %v", c)
+	}
+
+	kept, err := DecodeImageWithOptions(bytes.NewReader(buf.Bytes()), "p3.jpg", DecodeOptions{KeepColorProfile: true})
+	if err != nil {
+		t.Fatalf("DecodeImageWithOptions: %v", err)
+	}
+	if !bytes.Equal(kept.Metadata.ICC, p3) {
+		t.Fatal("expected the source profile to be kept")
+	}
+	if c := color.NRGBAModel.Convert(kept.Image.At(8, 8)).(color.NRGBA); !near(c.R, 200) {
+		t.Fatalf("expected pixels unchanged, got %v", c)
+	}
+}
+
+func TestDecodeImage_PNGICCP(t *testing.T) {
+	adobe := buildICCProfile("Adobe RGB (1998)", adobeRGBD50, testICCCurve(func(v float64) float64 { return math.Pow(v, 563.0/256) }))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, solidImage(4, 4, color.NRGBA{R: 100, G: 200, B: 100, A: 255})); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	data := insertPNGChunk(buf.Bytes(), "iCCP", iccpPayload(t, "Adobe RGB", adobe))
+
+	decoded, err := DecodeImage(bytes.NewReader(data), "adobe.png")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if decoded.ColorProfile != "Adobe RGB (1998)" {
+		t.Fatalf("expected Adobe RGB profile, got %q", decoded.ColorProfile)
+	}
+	if c := color.NRGBAModel.Convert(decoded.Image.At(1, 1)).(color.NRGBA); c.R >= 80 {
+		t.Fatalf("expected pixels converted to sRGB, got %v", c)
+	}
+}
+
+func testICCCurve(fn func(float64) float64) []uint16 {
+	curve := make([]uint16, 256)
+	for i := range curve {
+		curve[i] = uint16(math.Round(fn(float64(i)/255) * 65535))
+	}
+	return curve
+}
+
+// withParaCurve replaces the shared tone curve of a buildICCProfile profile
+// with a para curve; the curv tag must be as long as the para one.
+func withParaCurve(icc []byte, fn uint16, params []float64) []byte {
+	out := append([]byte(nil), icc...)
+	at := bytes.Index(out, []byte("curv"))
+	para := make([]byte, 12+4*len(params))
+	copy(para, "para")
+	binary.BigEndian.PutUint16(para[8:], fn)
+	for i, v := range params {
+		binary.BigEndian.PutUint32(para[12+4*i:], uint32(int32(math.Round(v*65536))))
+	}
+	copy(out[at:], para)
+	return out
+}
+
+func iccpPayload(t *testing.T, name string, icc []byte) []byte {
+	t.Helper()
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	if _, err := zw.Write(icc); err != nil {
+		t.Fatalf("zlib: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zlib: %v", err)
+	}
+	payload := append([]byte(name), 0, 0)
+	return append(payload, z.Bytes()...)
+}
+
+// insertPNGChunk inserts a chunk right after IHDR.
+func insertPNGChunk(data []byte, typ string, payload []byte) []byte {
+	const afterIHDR = 8 + 12 + 13
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	out := append([]byte{}, data[:afterIHDR]...)
+	out = append(out, chunk...)
+	return append(out, data[afterIHDR:]...)
+}
+
+func near(v, want uint8) bool {
+	d := int(v) - int(want)
+	return d >= -3 && d <= 3
+}
@@ -0,0 +1,451 @@
+package instafix
+
+import (
+	"bufio"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// The standard library JPEG encoder only writes baseline 4:2:0 files. This
+// encoder adds progressive scans (spectral selection) and 4:4:4 chroma, using
+// the quantization and Huffman tables from Annex K of the JPEG spec.
+
+// jpegZigzag maps zig-zag order to natural order within an 8x8 block.
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegQuantK1 holds the Annex K.1 luminance and chrominance tables in zig-zag order.
+var jpegQuantK1 = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26, 26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+type jpegHuffSpec struct {
+	count [16]byte
+	value []byte
+}
+
+// jpegHuffK3 holds the Annex K.3 tables: luminance DC, luminance AC,
+// chrominance DC, chrominance AC.
+var jpegHuffK3 = [4]jpegHuffSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegDCTTable[u][x] = C(u)/2 * cos((2x+1)uπ/16).
+var jpegDCTTable = func() (t [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		c := 1.0
+		if u == 0 {
+			c = 1 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			t[u][x] = c / 2 * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// jpegComponent is one color plane split into quantized blocks (zig-zag order).
+type jpegComponent struct {
+	id        byte
+	h, v      int // sampling factors
+	table     int // quantization and Huffman table index
+	blocksW   int // blocks per row, padded to whole MCUs
+	blocksH   int
+	scanW     int // blocks per row covering the component, used by non-interleaved scans
+	scanH     int
+	blocks    [][64]int32
+	predictor int32
+}
+
+type jpegWriter struct {
+	w     *bufio.Writer
+	err   error
+	bits  uint32
+	nbits uint
+	huff  [4][]uint32 // value -> size<<24 | code
+}
+
+// encodeJPEGExtended writes img as a JPEG with the given chroma subsampling,
+// using progressive scans when requested.
+func encodeJPEGExtended(w io.Writer, img image.Image, quality int, progressive, subsample420 bool) error {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	width, height := b.Dx(), b.Dy()
+
+	quant := jpegQuantTables(quality)
+	comps := jpegComponents(rgba, quant, subsample420)
+
+	jw := &jpegWriter{w: bufio.NewWriter(w)}
+	for i, spec := range jpegHuffK3 {
+		jw.huff[i] = jpegHuffLUT(spec)
+	}
+
+	jw.marker(0xD8, nil)
+	dqt := make([]byte, 0, 2*65)
+	for i, q := range quant {
+		dqt = append(dqt, byte(i))
+		for _, v := range q {
+			dqt = append(dqt, byte(v))
+		}
+	}
+	jw.marker(0xDB, dqt)
+
+	sof := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(comps))}
+	for _, c := range comps {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), byte(c.table))
+	}
+	if progressive {
+		jw.marker(0xC2, sof)
+	} else {
+		jw.marker(0xC0, sof)
+	}
+
+	var dht []byte
+	for i, spec := range jpegHuffK3 {
+		// Tables are stored as luminance DC/AC, chrominance DC/AC.
+		dht = append(dht, byte((i%2)<<4|i/2))
+		dht = append(dht, spec.count[:]...)
+		dht = append(dht, spec.value...)
+	}
+	jw.marker(0xC4, dht)
+
+	if progressive {
+		jw.scan(comps, 0, 0)
+		for i := range comps {
+			jw.scan(comps[i:i+1], 1, 5)
+			jw.scan(comps[i:i+1], 6, 63)
+		}
+	} else {
+		jw.scan(comps, 0, 63)
+	}
+	jw.marker(0xD9, nil)
+
+	if jw.err != nil {
+		return jw.err
+	}
+	return jw.w.Flush()
+}
+
+func jpegQuantTables(quality int) [2][64]int {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var out [2][64]int
+	for i := range out {
+		for j, v := range jpegQuantK1[i] {
+			q := (v*scale + 50) / 100
+			if q < 1 {
+				q = 1
+			} else if q > 255 {
+				q = 255
+			}
+			out[i][j] = q
+		}
+	}
+	return out
+}
+
+// jpegComponents converts the image to YCbCr and computes quantized DCT blocks.
+func jpegComponents(img *image.RGBA, quant [2][64]int, subsample420 bool) []*jpegComponent {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	mcu := 8
+	if subsample420 {
+		mcu = 16
+	}
+	mcusX := (width + mcu - 1) / mcu
+	mcusY := (height + mcu - 1) / mcu
+	pw, ph := mcusX*mcu, mcusY*mcu
+
+	// Full resolution planes, edge-padded to whole MCUs.
+	planes := [3][]float64{make([]float64, pw*ph), make([]float64, pw*ph), make([]float64, pw*ph)}
+	for y := 0; y < ph; y++ {
+		sy := min(y, height-1)
+		for x := 0; x < pw; x++ {
+			sx := min(x, width-1)
+			p := img.PixOffset(sx, sy)
+			r, g, b := float64(img.Pix[p]), float64(img.Pix[p+1]), float64(img.Pix[p+2])
+			i := y*pw + x
+			planes[0][i] = 0.299*r + 0.587*g + 0.114*b
+			planes[1][i] = -0.168736*r - 0.331264*g + 0.5*b + 128
+			planes[2][i] = 0.5*r - 0.418688*g - 0.081312*b + 128
+		}
+	}
+
+	comps := make([]*jpegComponent, 3)
+	for i := range comps {
+		c := &jpegComponent{id: byte(i + 1), h: 1, v: 1}
+		plane, cw, ch := planes[i], pw, ph
+		compW, compH := width, height
+		if i > 0 {
+			c.table = 1
+			if subsample420 {
+				plane, cw, ch = downsample2x2(plane, pw, ph), pw/2, ph/2
+				compW, compH = (width+1)/2, (height+1)/2
+			}
+		} else if subsample420 {
+			c.h, c.v = 2, 2
+		}
+		c.blocksW, c.blocksH = cw/8, ch/8
+		c.scanW, c.scanH = (compW+7)/8, (compH+7)/8
+		c.blocks = make([][64]int32, c.blocksW*c.blocksH)
+		for by := 0; by < c.blocksH; by++ {
+			for bx := 0; bx < c.blocksW; bx++ {
+				c.blocks[by*c.blocksW+bx] = jpegFDCT(plane, cw, bx*8, by*8, quant[c.table])
+			}
+		}
+		comps[i] = c
+	}
+	return comps
+}
+
+func downsample2x2(plane []float64, w, h int) []float64 {
+	out := make([]float64, (w/2)*(h/2))
+	for y := 0; y < h/2; y++ {
+		for x := 0; x < w/2; x++ {
+			i := 2*y*w + 2*x
+			out[y*(w/2)+x] = (plane[i] + plane[i+1] + plane[i+w] + plane[i+w+1]) / 4
+		}
+	}
+	return out
+}
+
+// jpegFDCT transforms and quantizes the 8x8 block at (x0, y0).
+func jpegFDCT(plane []float64, stride, x0, y0 int, quant [64]int) [64]int32 {
+	var rows [8][8]float64
+	for y := 0; y < 8; y++ {
+		line := plane[(y0+y)*stride+x0:]
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += jpegDCTTable[u][x] * (line[x] - 128)
+			}
+			rows[y][u] = s
+		}
+	}
+	var out [64]int32
+	for k := 0; k < 64; k++ {
+		n := jpegZigzag[k]
+		u, v := n%8, n/8
+		var s float64
+		for y := 0; y < 8; y++ {
+			s += jpegDCTTable[v][y] * rows[y][u]
+		}
+		out[k] = int32(math.Round(s / float64(quant[k])))
+	}
+	return out
+}
+
+func jpegHuffLUT(spec jpegHuffSpec) []uint32 {
+	lut := make([]uint32, 256)
+	code, k := uint32(0), 0
+	for i, n := range spec.count {
+		for j := 0; j < int(n); j++ {
+			lut[spec.value[k]] = uint32(i+1)<<24 | code
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return lut
+}
+
+// scan writes one scan over comps covering coefficients ss..se. DC-only and
+// sequential scans interleave all components by MCU; AC-only scans are
+// non-interleaved and cover each component's own block grid.
+func (jw *jpegWriter) scan(comps []*jpegComponent, ss, se int) {
+	sos := []byte{byte(len(comps))}
+	for _, c := range comps {
+		sos = append(sos, c.id, byte(c.table<<4|c.table))
+	}
+	sos = append(sos, byte(ss), byte(se), 0)
+	jw.marker(0xDA, sos)
+
+	for _, c := range comps {
+		c.predictor = 0
+	}
+	if ss > 0 {
+		c := comps[0]
+		for by := 0; by < c.scanH; by++ {
+			for bx := 0; bx < c.scanW; bx++ {
+				jw.block(c, &c.blocks[by*c.blocksW+bx], ss, se)
+			}
+		}
+	} else {
+		mcusX := comps[0].blocksW / comps[0].h
+		mcusY := comps[0].blocksH / comps[0].v
+		for my := 0; my < mcusY; my++ {
+			for mx := 0; mx < mcusX; mx++ {
+				for _, c := range comps {
+					for v := 0; v < c.v; v++ {
+						for h := 0; h < c.h; h++ {
+							bx, by := mx*c.h+h, my*c.v+v
+							jw.block(c, &c.blocks[by*c.blocksW+bx], ss, se)
+						}
+					}
+				}
+			}
+		}
+	}
+	// Pad the last byte with 1 bits.
+	jw.emit(0x7F, 7)
+	jw.bits, jw.nbits = 0, 0
+}
+
+func (jw *jpegWriter) block(c *jpegComponent, blk *[64]int32, ss, se int) {
+	dcTable, acTable := 2*c.table, 2*c.table+1
+	if ss == 0 {
+		diff := blk[0] - c.predictor
+		c.predictor = blk[0]
+		jw.emitValue(dcTable, 0, diff)
+		ss = 1
+	}
+	if ss > se {
+		return
+	}
+	run := 0
+	for k := ss; k <= se; k++ {
+		v := blk[k]
+		if v == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			jw.emitHuff(acTable, 0xF0)
+			run -= 16
+		}
+		jw.emitValue(acTable, run, v)
+		run = 0
+	}
+	if run > 0 {
+		// EOB; in progressive AC scans this is EOBRUN=1.
+		jw.emitHuff(acTable, 0x00)
+	}
+}
+
+func (jw *jpegWriter) emitValue(table, run int, v int32) {
+	a, b := v, v
+	if a < 0 {
+		a, b = -v, v-1
+	}
+	size := 0
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+	jw.emitHuff(table, byte(run<<4|size))
+	if size > 0 {
+		jw.emit(uint32(b)&(1<<size-1), uint(size))
+	}
+}
+
+func (jw *jpegWriter) emitHuff(table int, value byte) {
+	x := jw.huff[table][value]
+	jw.emit(x&(1<<24-1), uint(x>>24))
+}
+
+func (jw *jpegWriter) emit(bits uint32, n uint) {
+	if jw.err != nil || n == 0 {
+		return
+	}
+	nbits := jw.nbits + n
+	bits <<= 32 - nbits
+	bits |= jw.bits
+	for nbits >= 8 {
+		b := byte(bits >> 24)
+		jw.writeByte(b)
+		if b == 0xFF {
+			jw.writeByte(0)
+		}
+		bits <<= 8
+		nbits -= 8
+	}
+	jw.bits, jw.nbits = bits, nbits
+}
+
+func (jw *jpegWriter) writeByte(b byte) {
+	if jw.err == nil {
+		jw.err = jw.w.WriteByte(b)
+	}
+}
+
+// marker writes a marker segment; payload nil means a standalone marker.
+func (jw *jpegWriter) marker(m byte, payload []byte) {
+	if jw.err != nil {
+		return
+	}
+	_, jw.err = jw.w.Write([]byte{0xFF, m})
+	if payload == nil || jw.err != nil {
+		return
+	}
+	n := len(payload) + 2
+	if _, jw.err = jw.w.Write([]byte{byte(n >> 8), byte(n)}); jw.err == nil {
+		_, jw.err = jw.w.Write(payload)
+	}
+}
@@ -0,0 +1,128 @@
+package instafix
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/fogleman/gg"
+)
+
+// drawLayers composites the background layers over dc in order.
+func drawLayers(dc *gg.Context, src image.Image, layers []config.Background, assetsPath string, assets *assetCache, width, height int, fitted image.Image, fitX, fitY int) error {
+	dst, ok := dc.Image().(*image.RGBA)
+	if !ok {
+		return nil
+	}
+	for _, layer := range layers {
+		var img *image.RGBA
+		switch strings.ToLower(strings.TrimSpace(layer.Type)) {
+		case config.LayerNoise:
+			img = noiseLayer(width, height)
+		case config.LayerVignette:
+			img = vignetteLayer(layer, width, height)
+		case config.LayerTint:
+			c, _ := parseHexColor(layer.Color)
+			img = image.NewRGBA(image.Rect(0, 0, width, height))
+			fillRect(img, img.Bounds(), c)
+		default:
+			lc := gg.NewContext(width, height)
+			if err := drawBackground(lc, src, layer, assetsPath, assets, width, height, fitted, fitX, fitY); err != nil {
+				return err
+			}
+			img = lc.Image().(*image.RGBA)
+		}
+		opacity := layer.Opacity
+		if opacity == 0 {
+			opacity = 1
+		}
+		blendLayer(dst, img, strings.ToLower(strings.TrimSpace(layer.Blend)), opacity)
+	}
+	return nil
+}
+
+// noiseLayer returns opaque gray noise around middle gray, meant to be
+// blended (overlay, screen) as film grain. The seed is fixed so the same
+// input renders the same output.
+func noiseLayer(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < len(img.Pix); i += 4 {
+		v := uint8(rng.IntN(256))
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = v, v, v, 255
+	}
+	return img
+}
+
+// vignetteLayer returns the layer color (black by default) fading in from
+// layer.Radius of the center-to-corner distance to fully opaque corners.
+func vignetteLayer(layer config.Background, width, height int) *image.RGBA {
+	c := color.NRGBA{A: 255}
+	if layer.Color != "" {
+		c, _ = parseHexColor(layer.Color)
+	}
+	radius := layer.Radius
+	if radius == 0 {
+		radius = config.DefaultVignetteRadius
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	cx, cy := float64(width)/2, float64(height)/2
+	maxDist := math.Hypot(cx, cy)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / maxDist
+			t := math.Min(math.Max((d-radius)/(1-radius), 0), 1)
+			a := t * t * (3 - 2*t) * float64(c.A) / 255
+			i := img.PixOffset(x, y)
+			img.Pix[i] = roundByte(float64(c.R) * a)
+			img.Pix[i+1] = roundByte(float64(c.G) * a)
+			img.Pix[i+2] = roundByte(float64(c.B) * a)
+			img.Pix[i+3] = roundByte(255 * a)
+		}
+	}
+	return img
+}
+
+// blendLayer composites src over dst with the blend mode and opacity, using
+// the W3C compositing formulas on premultiplied pixels.
+func blendLayer(dst, src *image.RGBA, mode string, opacity float64) {
+	for i := 0; i+3 < len(dst.Pix) && i+3 < len(src.Pix); i += 4 {
+		sa := float64(src.Pix[i+3]) / 255
+		if sa == 0 {
+			continue
+		}
+		da := float64(dst.Pix[i+3]) / 255
+		a := sa * opacity
+		for ch := 0; ch < 3; ch++ {
+			cs := float64(src.Pix[i+ch]) / 255 / sa
+			cd := 0.0
+			if da > 0 {
+				cd = float64(dst.Pix[i+ch]) / 255 / da
+			}
+			mixed := (1-da)*cs + da*blendChannel(mode, cd, cs)
+			dst.Pix[i+ch] = roundByte(255 * (a*mixed + da*cd*(1-a)))
+		}
+		dst.Pix[i+3] = roundByte(255 * (a + da*(1-a)))
+	}
+}
+
+// blendChannel blends one straight color channel in 0..1.
+func blendChannel(mode string, cd, cs float64) float64 {
+	switch mode {
+	case config.BlendMultiply:
+		return cd * cs
+	case config.BlendScreen:
+		return cd + cs - cd*cs
+	case config.BlendOverlay:
+		if cd <= 0.5 {
+			return 2 * cd * cs
+		}
+		return 1 - 2*(1-cd)*(1-cs)
+	default:
+		return cs
+	}
+}
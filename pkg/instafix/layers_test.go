@@ -0,0 +1,90 @@
+package instafix
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/fogleman/gg"
+)
+
+func TestBlendModes(t *testing.T) {
+	// Mid gray under light gray: each mode has a distinct, known result.
+	tests := []struct {
+		blend   string
+		opacity float64
+		want    uint8
+	}{
+		{blend: "", opacity: 1, want: 192},
+		{blend: config.BlendNormal, opacity: 0.5, want: 160},
+		{blend: config.BlendMultiply, opacity: 1, want: 96},
+		{blend: config.BlendScreen, opacity: 1, want: 224},
+		{blend: config.BlendOverlay, opacity: 1, want: 192},
+	}
+	for _, tt := range tests {
+		t.Run(tt.blend, func(t *testing.T) {
+			dst := image.NewRGBA(image.Rect(0, 0, 1, 1))
+			fillRect(dst, dst.Bounds(), color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+			src := image.NewRGBA(image.Rect(0, 0, 1, 1))
+			fillRect(src, src.Bounds(), color.NRGBA{R: 192, G: 192, B: 192, A: 255})
+
+			blendLayer(dst, src, tt.blend, tt.opacity)
+			if got := dst.Pix[0]; absDiff(got, tt.want) > 1 || dst.Pix[3] != 255 {
+				t.Fatalf("got %v, want gray %d", dst.Pix[:4], tt.want)
+			}
+		})
+	}
+}
+
+func TestDrawBackground_Layers(t *testing.T) {
+	photo := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	fillRect(photo, photo.Bounds(), color.NRGBA{R: 200, G: 200, B: 200, A: 255})
+
+	bg := config.Background{
+		Layers: []config.Background{
+			{Type: "solid", Color: "#808080"},
+			{Type: config.LayerTint, Color: "#ff0000", Opacity: 0.5, Blend: config.BlendMultiply},
+			{Type: config.LayerVignette, Radius: 0.2},
+		},
+	}
+	dc := gg.NewContext(100, 100)
+	if err := drawBackground(dc, photo, bg, "", nil, 100, 100, photo, 30, 30); err != nil {
+		t.Fatalf("drawBackground: %v", err)
+	}
+	img := dc.Image()
+
+	center := colorToNRGBA(img.At(50, 50))
+	// Half-strength red multiply keeps red and halves green and blue.
+	if absDiff(center.R, 128) > 2 || absDiff(center.G, 64) > 2 || center.A != 255 {
+		t.Fatalf("center = %v, want ~(128,64,64)", center)
+	}
+	corner := colorToNRGBA(img.At(0, 0))
+	if corner.R > 8 || corner.G > 8 {
+		t.Fatalf("corner = %v, want vignette black", corner)
+	}
+}
+
+func TestNoiseLayer_Deterministic(t *testing.T) {
+	a, b := noiseLayer(16, 16), noiseLayer(16, 16)
+	var sum int
+	for i := range a.Pix {
+		if a.Pix[i] != b.Pix[i] {
+			t.Fatalf("noise differs at %d", i)
+		}
+		if i%4 == 0 {
+			sum += int(a.Pix[i])
+		}
+	}
+	if mean := sum / 256; mean < 96 || mean > 160 {
+		t.Fatalf("noise mean = %d, want around middle gray", mean)
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
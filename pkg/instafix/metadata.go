@@ -0,0 +1,287 @@
+package instafix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+// Metadata holds the metadata blocks extracted from the source file.
+type Metadata struct {
+	// EXIF is a TIFF-structured EXIF block without the "Exif\0\0" header.
+	EXIF []byte
+	// XMP is the XMP packet.
+	XMP []byte
+	// IPTC is the Photoshop IRB block (JPEG APP13) carrying IPTC-IIM records.
+	IPTC []byte
+	// ICC is the RGB color profile of the pixels; nil means sRGB.
+	ICC []byte
+}
+
+const (
+	jpegExifHeader = "Exif\x00\x00"
+	jpegXMPHeader  = "http://ns.adobe.com/xap/1.0/\x00"
+	jpegIPTCHeader = "Photoshop 3.0\x00"
+)
+
+// extractMetadata reads EXIF, XMP and IPTC from the source container.
+// Missing or malformed blocks are skipped.
+func extractMetadata(data []byte, container string) Metadata {
+	switch container {
+	case ContainerJPEG:
+		return jpegMetadata(data)
+	case ContainerPNG:
+		return pngMetadata(data)
+	case ContainerWebP:
+		return webpMetadata(data)
+	case ContainerHEIC:
+		return heifMetadata(data)
+	case ContainerTIFF, ContainerDNG, ContainerCR2, ContainerNEF, ContainerARW, ContainerPEF:
+		return tiffMetadata(data, 0, 42)
+	case ContainerORF:
+		return tiffMetadata(data, 0, 0x4F52, 0x5352)
+	case ContainerRAF:
+		// RAF keeps its EXIF inside the embedded JPEG.
+		if previews := rafPreviews(data); len(previews) > 0 {
+			c := previews[0]
+			return jpegMetadata(data[c.offset : c.offset+c.length])
+		}
+	}
+	return Metadata{}
+}
+
+func jpegMetadata(data []byte) Metadata {
+	var meta Metadata
+	forEachJPEGSegment(data, func(marker byte, payload []byte) {
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte(jpegExifHeader)) && meta.EXIF == nil:
+			meta.EXIF = append([]byte(nil), payload[len(jpegExifHeader):]...)
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte(jpegXMPHeader)) && meta.XMP == nil:
+			meta.XMP = append([]byte(nil), payload[len(jpegXMPHeader):]...)
+		case marker == 0xED && bytes.HasPrefix(payload, []byte(jpegIPTCHeader)) && meta.IPTC == nil:
+			meta.IPTC = append([]byte(nil), payload[len(jpegIPTCHeader):]...)
+		}
+	})
+	return meta
+}
+
+// forEachJPEGSegment calls fn for every marker segment before the first scan.
+func forEachJPEGSegment(data []byte, fn func(marker byte, payload []byte)) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2:]))
+		if segLen < 2 || i+2+segLen > len(data) {
+			return
+		}
+		fn(marker, data[i+4:i+2+segLen])
+		i += 2 + segLen
+	}
+}
+
+func pngMetadata(data []byte) Metadata {
+	var meta Metadata
+	forEachPNGChunk(data, func(typ string, payload []byte) {
+		switch typ {
+		case "eXIf":
+			meta.EXIF = append([]byte(nil), payload...)
+		case "iTXt":
+			// keyword\0 compression-flag compression-method language\0 translated\0 text
+			parts := bytes.SplitN(payload, []byte{0}, 2)
+			if len(parts) != 2 || string(parts[0]) != "XML:com.adobe.xmp" || len(parts[1]) < 2 || parts[1][0] != 0 {
+				return
+			}
+			rest := bytes.SplitN(parts[1][2:], []byte{0}, 3)
+			if len(rest) == 3 {
+				meta.XMP = append([]byte(nil), rest[2]...)
+			}
+		}
+	})
+	return meta
+}
+
+// forEachPNGChunk calls fn for every chunk of a PNG stream.
+func forEachPNGChunk(data []byte, fn func(typ string, payload []byte)) {
+	i := 8
+	for i+12 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		if n < 0 || i+12+n > len(data) {
+			return
+		}
+		fn(typ, data[i+8:i+8+n])
+		if typ == "IEND" {
+			return
+		}
+		i += 12 + n
+	}
+}
+
+func webpMetadata(data []byte) Metadata {
+	var meta Metadata
+	i := 12
+	for i+8 <= len(data) {
+		typ := string(data[i : i+4])
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if n < 0 || i+8+n > len(data) {
+			break
+		}
+		payload := data[i+8 : i+8+n]
+		switch typ {
+		case "EXIF":
+			payload = bytes.TrimPrefix(payload, []byte(jpegExifHeader))
+			meta.EXIF = append([]byte(nil), payload...)
+		case "XMP ":
+			meta.XMP = append([]byte(nil), payload...)
+		}
+		i += 8 + n + n%2
+	}
+	return meta
+}
+
+func heifMetadata(data []byte) Metadata {
+	var meta Metadata
+	f, err := parseHEIF(data)
+	if err != nil {
+		return meta
+	}
+	for _, id := range f.order {
+		item := f.items[id]
+		payload, err := f.payload(item)
+		if err != nil {
+			continue
+		}
+		switch {
+		case item.typ == "Exif" && meta.EXIF == nil && len(payload) >= 4:
+			off := 4 + int(binary.BigEndian.Uint32(payload))
+			if off < len(payload) {
+				meta.EXIF = append([]byte(nil), payload[off:]...)
+			}
+		case item.typ == "mime" && strings.Contains(item.contentType, "rdf+xml") && meta.XMP == nil:
+			meta.XMP = append([]byte(nil), payload...)
+		}
+	}
+	return meta
+}
+
+// tiffMetadata builds an EXIF block from the descriptive IFD0 tags of a
+// TIFF-based container; the XMP packet is taken from the XMLPacket tag.
+func tiffMetadata(data []byte, base int, magics ...uint16) Metadata {
+	var meta Metadata
+	t, err := newTIFFReader(data, base, magics...)
+	if err != nil {
+		return meta
+	}
+	ifd0, err := t.readIFD(t.first)
+	if err != nil {
+		return meta
+	}
+	if e, ok := ifd0.entries[tagXMLPacket]; ok {
+		meta.XMP = append([]byte(nil), t.data[e.pos:e.pos+int(e.count)*tiffTypeSize(e.typ)]...)
+	}
+	exif, err := parseExifIFD(t, t.first, exifDescriptiveTags, make(map[int]bool))
+	if err == nil && len(exif.entries) > 0 {
+		meta.EXIF = (&exifData{order: t.order, ifd0: exif}).encode()
+	}
+	return meta
+}
+
+// filterMetadata applies a metadata policy for an output image of size w x h.
+// Kept EXIF and XMP get orientation 1 since pixels are already rotated.
+func filterMetadata(meta Metadata, policy string, tags []string, w, h int) (Metadata, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	if policy == "" || policy == config.MetadataStripAll {
+		return Metadata{}, nil
+	}
+
+	out := Metadata{XMP: meta.XMP, IPTC: meta.IPTC}
+	allowed := make(map[uint16]bool)
+	if policy == config.MetadataAllowlist {
+		out = Metadata{}
+		for _, name := range tags {
+			switch strings.ToUpper(strings.TrimSpace(name)) {
+			case "XMP":
+				out.XMP = meta.XMP
+				continue
+			case "IPTC":
+				out.IPTC = meta.IPTC
+				continue
+			}
+			id, ok := lookupExifTag(name)
+			if !ok {
+				return Metadata{}, fmt.Errorf("unknown metadata tag: %s", name)
+			}
+			allowed[id] = true
+		}
+	}
+
+	if len(meta.EXIF) > 0 {
+		exif, err := parseExif(meta.EXIF)
+		if err == nil {
+			switch policy {
+			case config.MetadataStripGPS:
+				exif.ifd0.remove(tagGPSPointer)
+			case config.MetadataAllowlist:
+				exif.ifd0.filter(allowed)
+			}
+			if exif.ifd0.find(tagOrientation) != nil {
+				exif.ifd0.setShort(exif.order, tagOrientation, 1)
+			}
+			if sub := exif.exifIFD(); sub != nil {
+				if sub.find(tagPixelXDimension) != nil {
+					sub.setLong(exif.order, tagPixelXDimension, uint32(w))
+				}
+				if sub.find(tagPixelYDimension) != nil {
+					sub.setLong(exif.order, tagPixelYDimension, uint32(h))
+				}
+			}
+			block := exif.encode()
+			if len(block) > exifMaxSegmentLength {
+				// Maker notes are the usual reason EXIF outgrows one APP1 segment.
+				if sub := exif.exifIFD(); sub != nil {
+					sub.remove(tagMakerNote)
+				}
+				block = exif.encode()
+			}
+			if len(exif.ifd0.entries) > 0 && len(block) <= exifMaxSegmentLength {
+				out.EXIF = block
+			}
+		}
+	}
+
+	if len(out.XMP) > 0 {
+		xmp := resetXMPOrientation(out.XMP)
+		if policy == config.MetadataStripGPS {
+			xmp = stripXMPGPS(xmp)
+		}
+		out.XMP = xmp
+	}
+	return out, nil
+}
+
+var (
+	xmpOrientationAttr = regexp.MustCompile(`tiff:Orientation="\d+"`)
+	xmpOrientationElem = regexp.MustCompile(`<tiff:Orientation>\d+</tiff:Orientation>`)
+	xmpGPSAttr         = regexp.MustCompile(`\s+exif:GPS\w+="[^"]*"`)
+	xmpGPSElem         = regexp.MustCompile(`(?s)<exif:(GPS\w+)\b[^>]*?(/>|>.*?</exif:GPS\w+>)`)
+)
+
+func resetXMPOrientation(xmp []byte) []byte {
+	xmp = xmpOrientationAttr.ReplaceAll(xmp, []byte(`tiff:Orientation="1"`))
+	return xmpOrientationElem.ReplaceAll(xmp, []byte(`<tiff:Orientation>1</tiff:Orientation>`))
+}
+
+func stripXMPGPS(xmp []byte) []byte {
+	xmp = xmpGPSAttr.ReplaceAll(xmp, nil)
+	return xmpGPSElem.ReplaceAll(xmp, nil)
+}
@@ -0,0 +1,124 @@
+package instafix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestMetadata_JPEGRoundTripStripsGPS(t *testing.T) {
+	exif := testExifBlock()
+	app1 := append([]byte(jpegExifHeader), exif...)
+	src := encodeTestJPEG(t, 20, 10, app1)
+
+	decoded, err := DecodeImage(bytes.NewReader(src), "photo.jpg")
+	if err != nil {
+		t.Fatalf("DecodeImage: %v", err)
+	}
+	if len(decoded.Metadata.EXIF) == 0 {
+		t.Fatal("expected EXIF to be extracted")
+	}
+
+	meta, err := filterMetadata(decoded.Metadata, config.MetadataStripGPS, nil, 640, 480)
+	if err != nil {
+		t.Fatalf("filterMetadata: %v", err)
+	}
+	var out bytes.Buffer
+	if err := EncodeJPEG(&out, decoded.Image, 90, meta); err != nil {
+		t.Fatalf("EncodeJPEG: %v", err)
+	}
+
+	written := jpegMetadata(out.Bytes())
+	parsed, err := parseExif(written.EXIF)
+	if err != nil {
+		t.Fatalf("parseExif: %v", err)
+	}
+	if got := exifString(parsed.ifd0, 0x013B); got != "Jane Doe" {
+		t.Fatalf("expected artist to be kept, got %q", got)
+	}
+	if parsed.ifd0.find(tagGPSPointer) != nil {
+		t.Fatal("expected GPS IFD to be stripped")
+	}
+	if o := parsed.ifd0.find(tagOrientation); o == nil || parsed.order.Uint16(o.value) != 1 {
+		t.Fatal("expected orientation reset to 1")
+	}
+	if px := parsed.exifIFD().find(tagPixelXDimension); px == nil || parsed.order.Uint32(px.value) != 640 {
+		t.Fatal("expected PixelXDimension to match the output width")
+	}
+}
+
+func TestFilterMetadata_Policies(t *testing.T) {
+	src := Metadata{
+		EXIF: testExifBlock(),
+		XMP:  []byte(`<rdf:Description exif:GPSLatitude="55,45N" tiff:Orientation="6" dc:creator="Jane"/>`),
+	}
+
+	stripped, err := filterMetadata(src, config.MetadataStripAll, nil, 10, 10)
+	if err != nil {
+		t.Fatalf("strip_all: %v", err)
+	}
+	if len(stripped.EXIF) != 0 || len(stripped.XMP) != 0 {
+		t.Fatal("expected strip_all to drop everything")
+	}
+
+	allow, err := filterMetadata(src, config.MetadataAllowlist, []string{"Copyright"}, 10, 10)
+	if err != nil {
+		t.Fatalf("allowlist: %v", err)
+	}
+	parsed, err := parseExif(allow.EXIF)
+	if err != nil {
+		t.Fatalf("parseExif: %v", err)
+	}
+	if len(parsed.ifd0.entries) != 1 || exifString(parsed.ifd0, 0x8298) != "(c) Jane Doe" {
+		t.Fatalf("expected only copyright, got %d entries", len(parsed.ifd0.entries))
+	}
+	if len(allow.XMP) != 0 {
+		t.Fatal("expected XMP to be dropped unless allowlisted")
+	}
+
+	noGPS, err := filterMetadata(src, config.MetadataStripGPS, nil, 10, 10)
+	if err != nil {
+		t.Fatalf("strip_gps: %v", err)
+	}
+	xmp := string(noGPS.XMP)
+	if strings.Contains(xmp, "GPSLatitude") || !strings.Contains(xmp, `tiff:Orientation="1"`) || !strings.Contains(xmp, "dc:creator") {
+		t.Fatalf("unexpected filtered XMP: %s", xmp)
+	}
+
+	if _, err := filterMetadata(src, config.MetadataAllowlist, []string{"NoSuchTag"}, 10, 10); err == nil {
+		t.Fatal("expected error for unknown allowlist tag")
+	}
+}
+
+// testExifBlock builds EXIF with artist, copyright, orientation 6, an Exif IFD and a GPS IFD.
+func testExifBlock() []byte {
+	order := binary.LittleEndian
+	gps := &exifIFD{entries: []exifEntry{asciiEntry(0x0001, "N")}}
+	sub := &exifIFD{}
+	sub.setLong(order, tagPixelXDimension, 4000)
+	sub.setLong(order, tagPixelYDimension, 3000)
+	ifd0 := &exifIFD{entries: []exifEntry{
+		asciiEntry(0x013B, "Jane Doe"),
+		asciiEntry(0x8298, "(c) Jane Doe"),
+		{tag: tagExifPointer, typ: 4, count: 1, sub: sub},
+		{tag: tagGPSPointer, typ: 4, count: 1, sub: gps},
+	}}
+	ifd0.setShort(order, tagOrientation, 6)
+	return (&exifData{order: order, ifd0: ifd0}).encode()
+}
+
+func asciiEntry(tag uint16, s string) exifEntry {
+	value := append([]byte(s), 0)
+	return exifEntry{tag: tag, typ: 2, count: uint32(len(value)), value: value}
+}
+
+func exifString(ifd *exifIFD, tag uint16) string {
+	e := ifd.find(tag)
+	if e == nil {
+		return ""
+	}
+	return strings.TrimRight(string(e.value), "\x00")
+}
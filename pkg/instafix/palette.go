@@ -0,0 +1,201 @@
+package instafix
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// paletteSampleSide is the size of the thumbnail the palette is computed on.
+	paletteSampleSide = 64
+	// paletteIterations bounds the k-means refinement.
+	paletteIterations = 16
+	// paletteMinShare is the share a cluster needs to be picked by a strategy
+	// other than dominant, so a few stray pixels cannot color the background.
+	paletteMinShare = 0.05
+)
+
+// PaletteColor is one color of an image palette.
+type PaletteColor struct {
+	Color color.NRGBA
+	// Share is the fraction of the image's pixels closest to Color.
+	Share float64
+}
+
+// Hex returns the color as #rrggbb.
+func (c PaletteColor) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.Color.R, c.Color.G, c.Color.B)
+}
+
+// extractPalette clusters the colors of a thumbnail of src into at most k
+// colors with k-means and returns them by decreasing share. Centers start
+// from the most frequent color and then the farthest remaining ones, so the
+// result is deterministic.
+func extractPalette(src image.Image, k int) []PaletteColor {
+	thumb := imaging.Fit(src, paletteSampleSide, paletteSampleSide, imaging.Box)
+	w, h := thumb.Bounds().Dx(), thumb.Bounds().Dy()
+	pixels := make([][3]float64, 0, w*h)
+	for y := 0; y < h; y++ {
+		row := thumb.Pix[y*thumb.Stride:]
+		for x := 0; x < w; x++ {
+			px := row[x*4:]
+			pixels = append(pixels, [3]float64{float64(px[0]), float64(px[1]), float64(px[2])})
+		}
+	}
+	if len(pixels) == 0 {
+		return []PaletteColor{{Color: color.NRGBA{A: 255}, Share: 1}}
+	}
+
+	centers := [][3]float64{mostFrequent(pixels)}
+	nearest := make([]float64, len(pixels))
+	for i, p := range pixels {
+		nearest[i] = distance3(p, centers[0])
+	}
+	for len(centers) < k {
+		far, farDist := -1, 0.0
+		for i, d := range nearest {
+			if d > farDist {
+				far, farDist = i, d
+			}
+		}
+		if far < 0 {
+			break // fewer distinct colors than k
+		}
+		centers = append(centers, pixels[far])
+		for i, p := range pixels {
+			nearest[i] = math.Min(nearest[i], distance3(p, pixels[far]))
+		}
+	}
+
+	assign := make([]int, len(pixels))
+	counts := make([]int, len(centers))
+	for iter := 0; iter < paletteIterations; iter++ {
+		sums := make([][3]float64, len(centers))
+		counts = make([]int, len(centers))
+		changed := iter == 0
+		for i, p := range pixels {
+			best, bestDist := 0, math.Inf(1)
+			for c, center := range centers {
+				if d := distance3(p, center); d < bestDist {
+					best, bestDist = c, d
+				}
+			}
+			if assign[i] != best {
+				assign[i], changed = best, true
+			}
+			counts[best]++
+			for j := range sums[best] {
+				sums[best][j] += p[j]
+			}
+		}
+		for c := range centers {
+			if counts[c] > 0 {
+				for j := range centers[c] {
+					centers[c][j] = sums[c][j] / float64(counts[c])
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	palette := make([]PaletteColor, 0, len(centers))
+	for c, center := range centers {
+		if counts[c] == 0 {
+			continue
+		}
+		palette = append(palette, PaletteColor{
+			Color: color.NRGBA{R: roundByte(center[0]), G: roundByte(center[1]), B: roundByte(center[2]), A: 255},
+			Share: float64(counts[c]) / float64(len(pixels)),
+		})
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Share > palette[j].Share })
+	return palette
+}
+
+// mostFrequent returns the mean of the fullest bin of a 4-bit-per-channel histogram.
+func mostFrequent(pixels [][3]float64) [3]float64 {
+	type bin struct {
+		sum [3]float64
+		n   int
+	}
+	bins := make(map[int]*bin)
+	bestKey := -1
+	for _, p := range pixels {
+		key := int(p[0])>>4<<8 | int(p[1])>>4<<4 | int(p[2])>>4
+		b := bins[key]
+		if b == nil {
+			b = &bin{}
+			bins[key] = b
+		}
+		b.n++
+		for j := range p {
+			b.sum[j] += p[j]
+		}
+		if bestKey < 0 || b.n > bins[bestKey].n || (b.n == bins[bestKey].n && key < bestKey) {
+			bestKey = key
+		}
+	}
+	b := bins[bestKey]
+	return [3]float64{b.sum[0] / float64(b.n), b.sum[1] / float64(b.n), b.sum[2] / float64(b.n)}
+}
+
+// paletteSize returns the number of palette colors a background asks for.
+func paletteSize(bg config.Background) int {
+	if bg.PaletteSize > 0 {
+		return bg.PaletteSize
+	}
+	return config.DefaultPaletteSize
+}
+
+// pickPaletteColor selects a palette color by strategy.
+func pickPaletteColor(palette []PaletteColor, strategy string) color.NRGBA {
+	if len(palette) == 0 {
+		return color.NRGBA{A: 255}
+	}
+	var score func(PaletteColor) float64
+	switch strings.ToLower(strings.TrimSpace(strategy)) {
+	case config.PaletteSaturated:
+		score = func(c PaletteColor) float64 { _, s, _ := rgbToHSL(c.Color); return s }
+	case config.PaletteDarkest:
+		score = func(c PaletteColor) float64 { return -luminance(c.Color) }
+	case config.PaletteLightest:
+		score = func(c PaletteColor) float64 { return luminance(c.Color) }
+	default:
+		return palette[0].Color
+	}
+	best := palette[0]
+	for _, c := range palette[1:] {
+		if c.Share >= paletteMinShare && score(c) > score(best) {
+			best = c
+		}
+	}
+	return best.Color
+}
+
+// adjustHSL shifts the saturation and lightness of c, clamped to 0..1.
+func adjustHSL(c color.NRGBA, saturation, lightness float64) color.NRGBA {
+	if saturation == 0 && lightness == 0 {
+		return c
+	}
+	h, s, l := rgbToHSL(c)
+	return hslToRGB(h, clamp01(s+saturation), clamp01(l+lightness))
+}
+
+func distance3(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
+
+func roundByte(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(255, v))))
+}
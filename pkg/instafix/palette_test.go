@@ -0,0 +1,87 @@
+package instafix
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestExtractPalette(t *testing.T) {
+	red := color.NRGBA{R: 220, G: 30, B: 30, A: 255}
+	blue := color.NRGBA{R: 20, G: 40, B: 200, A: 255}
+	white := color.NRGBA{R: 250, G: 250, B: 250, A: 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 100; x++ {
+			switch {
+			case x < 60:
+				src.SetNRGBA(x, y, red)
+			case x < 90:
+				src.SetNRGBA(x, y, blue)
+			default:
+				src.SetNRGBA(x, y, white)
+			}
+		}
+	}
+
+	palette := extractPalette(src, config.DefaultPaletteSize)
+	// Downscaling blends the borders between areas into a few minor colors.
+	if len(palette) < 3 {
+		t.Fatalf("expected at least 3 colors, got %v", palette)
+	}
+	want := []struct {
+		c     color.NRGBA
+		share float64
+	}{{red, 0.6}, {blue, 0.3}, {white, 0.1}}
+	for i, w := range want {
+		if colorDistance(palette[i].Color, w.c) > 12 || math.Abs(palette[i].Share-w.share) > 0.05 {
+			t.Fatalf("palette[%d] = %v %.2f, want %v %.2f", i, palette[i].Color, palette[i].Share, w.c, w.share)
+		}
+	}
+	if hex := (PaletteColor{Color: red}).Hex(); hex != "#dc1e1e" {
+		t.Fatalf("Hex() = %s", hex)
+	}
+}
+
+func TestPickPaletteColor(t *testing.T) {
+	gray := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+	red := color.NRGBA{R: 200, G: 40, B: 40, A: 255}
+	black := color.NRGBA{R: 10, G: 10, B: 10, A: 255}
+	white := color.NRGBA{R: 245, G: 245, B: 245, A: 255}
+	stray := color.NRGBA{G: 255, A: 255}
+	palette := []PaletteColor{
+		{Color: gray, Share: 0.5},
+		{Color: red, Share: 0.3},
+		{Color: black, Share: 0.1},
+		{Color: white, Share: 0.09},
+		{Color: stray, Share: 0.01},
+	}
+	tests := []struct {
+		strategy string
+		want     color.NRGBA
+	}{
+		{strategy: "", want: gray},
+		{strategy: "dominant", want: gray},
+		{strategy: "saturated", want: red},
+		{strategy: "darkest", want: black},
+		{strategy: "lightest", want: white},
+	}
+	for _, tt := range tests {
+		if got := pickPaletteColor(palette, tt.strategy); got != tt.want {
+			t.Fatalf("pickPaletteColor(%q) = %v, want %v", tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestAdjustHSL(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	if got := adjustHSL(red, 0, 0.25); colorDistance(got, color.NRGBA{R: 255, G: 128, B: 128, A: 255}) > 2 {
+		t.Fatalf("lighter red = %v", got)
+	}
+	if got := adjustHSL(red, -1, 0); colorDistance(got, color.NRGBA{R: 128, G: 128, B: 128, A: 255}) > 2 {
+		t.Fatalf("desaturated red = %v", got)
+	}
+}
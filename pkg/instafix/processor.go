@@ -4,6 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/aeperfilev/instafix/config"
 )
@@ -23,7 +28,8 @@ func (e UserError) Unwrap() error {
 
 // Processor applies profiles from the config to images.
 type Processor struct {
-	cfg config.Config
+	cfg    config.Config
+	assets *assetCache
 }
 
 // NewProcessor validates the config and returns a processor.
@@ -31,17 +37,118 @@ func NewProcessor(cfg config.Config) (*Processor, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
-	return &Processor{cfg: cfg}, nil
+	for name, profile := range cfg.Profiles {
+		// Validate accepts webp, but the encoder is registered separately.
+		format, _ := config.ParseOutputFormat(profile.OutputFormat)
+		if format == config.OutputFormatWebP && currentWebPEncoder() == nil {
+			return nil, fmt.Errorf("profiles.%s.output_format: %w: webp", name, ErrFormatUnavailable)
+		}
+		for _, tag := range profile.MetadataTags {
+			if strings.EqualFold(tag, "XMP") || strings.EqualFold(tag, "IPTC") {
+				continue
+			}
+			if _, ok := lookupExifTag(tag); !ok {
+				return nil, fmt.Errorf("profiles.%s.metadata_tags has unknown tag: %s", name, tag)
+			}
+		}
+	}
+	for name, wm := range cfg.Watermarks {
+		if _, err := parseTemplate(wm.Template); err != nil {
+			return nil, fmt.Errorf("watermarks.%s.template: %w", name, err)
+		}
+	}
+	// Decode textures up front: broken assets fail here rather than per request.
+	assets := newAssetCache()
+	for name, bg := range cfg.Backgrounds {
+		for _, file := range bg.Images() {
+			if _, err := assets.image(config.AssetPath(cfg.Settings.AssetsPath, file)); err != nil {
+				return nil, fmt.Errorf("backgrounds.%s.image: %w", name, err)
+			}
+		}
+	}
+	for name, wm := range cfg.Watermarks {
+		if wm.Image == "" {
+			continue
+		}
+		if _, err := assets.image(config.AssetPath(cfg.Settings.AssetsPath, wm.Image)); err != nil {
+			return nil, fmt.Errorf("watermarks.%s.image: %w", name, err)
+		}
+	}
+	for name, profile := range cfg.Profiles {
+		if cp := profile.Caption; cp != nil && cp.Logo != "" {
+			if _, err := assets.image(config.AssetPath(cfg.Settings.AssetsPath, cp.Logo)); err != nil {
+				return nil, fmt.Errorf("profiles.%s.caption.logo: %w", name, err)
+			}
+		}
+	}
+	return &Processor{cfg: cfg, assets: assets}, nil
+}
+
+// FocalPoint is a point of interest in relative image coordinates:
+// (0,0) is the top-left corner and (1,1) the bottom-right one.
+type FocalPoint struct {
+	X, Y float64
+}
+
+// ParseFocalPoint parses a focal point given as "x,y". An empty string
+// returns nil.
+func ParseFocalPoint(s string) (*FocalPoint, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	xs, ys, ok := strings.Cut(s, ",")
+	if !ok {
+		return nil, UserError{Err: fmt.Errorf("invalid focal point %q: want x,y", s)}
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(xs), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(ys), 64)
+	if errX != nil || errY != nil {
+		return nil, UserError{Err: fmt.Errorf("invalid focal point %q: want x,y", s)}
+	}
+	// ParseFloat accepts "NaN" and "Inf", which no crop can use.
+	if !isFinite(x) || !isFinite(y) {
+		return nil, UserError{Err: fmt.Errorf("invalid focal point %q: coordinates must be finite", s)}
+	}
+	return &FocalPoint{X: x, Y: y}, nil
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// ProcessOptions holds the per-request inputs of ProcessWithOptions.
+type ProcessOptions struct {
+	// WatermarkText is drawn in the profile's first text watermark layer as
+	// is; braces in it are literal. The style's template inserts it as {text}.
+	WatermarkText string
+	// Watermarks holds the text of watermark layers by layer name and
+	// overrides WatermarkText for the first layer.
+	Watermarks map[string]string
+	// Vars are user variables of watermark templates; they take precedence
+	// over the EXIF and filename ones.
+	Vars map[string]string
+	// Filename is the source file name, for the {filename} variable.
+	Filename string
+	// Focus, when set, centers the crop of the cover and smart fit modes
+	// instead of the image center or the detected salient region.
+	Focus *FocalPoint
+	// Exif is the source's shooting details (Decoded.Exif), drawn by the
+	// profile's caption strip.
+	Exif ExifInfo
 }
 
 // Process applies a profile to the source image.
-// It returns the resulting image and JPEG quality to use for encoding.
+// It returns the resulting image and the profile's jpeg_quality. Encode
+// applies that quality (and any max_bytes search) itself, so callers that
+// encode through it can ignore the value.
 func (p *Processor) Process(src image.Image, profileName, watermarkText string) (image.Image, int, error) {
-	resolved, err := p.cfg.ResolveProfile(profileName)
+	return p.ProcessWithOptions(src, profileName, ProcessOptions{WatermarkText: watermarkText})
+}
+
+// ProcessWithOptions is Process with explicit per-request options.
+func (p *Processor) ProcessWithOptions(src image.Image, profileName string, opts ProcessOptions) (image.Image, int, error) {
+	resolved, err := p.resolveProfile(profileName)
 	if err != nil {
-		if errors.Is(err, config.ErrProfileNotFound) {
-			return nil, 0, UserError{Err: err}
-		}
 		return nil, 0, err
 	}
 
@@ -50,14 +157,186 @@ func (p *Processor) Process(src image.Image, profileName, watermarkText string)
 		return nil, 0, err
 	}
 
-	if watermarkText != "" && resolved.Watermark == nil {
-		return nil, 0, UserError{Err: fmt.Errorf("watermark text provided, but profile has no watermark_ref")}
+	opts, err = prepareProcessOptions(resolved, opts)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	result, err := renderImage(src, resolved, format, watermarkText)
+	result, err := renderImage(src, resolved, format, opts, p.assets)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	return result, resolved.JpegQuality, nil
 }
+
+// fixedFormat returns the named format, or the profile's one when formatName
+// is empty, and sets the padding of resolved to match it. Multi-image modes
+// lay out a known tile size, so the format must be fixed.
+func (p *Processor) fixedFormat(resolved *config.ResolvedProfile, formatName string) (config.Format, error) {
+	format := resolved.Format
+	if formatName != "" {
+		f, ok := p.cfg.Formats[formatName]
+		if !ok {
+			return config.Format{}, UserError{Err: fmt.Errorf("%w: %s", config.ErrFormatNotFound, formatName)}
+		}
+		format = f
+		resolved.PaddingPercent = f.PaddingPercent
+		if padding := p.cfg.Profiles[resolved.Name].PaddingPercent; padding != nil {
+			resolved.PaddingPercent = *padding
+		}
+	} else {
+		formatName = resolved.FormatName
+	}
+	if strings.ToLower(format.Type) != config.FormatTypeFixed {
+		return config.Format{}, UserError{Err: fmt.Errorf("format %s is not fixed", formatName)}
+	}
+	return format, nil
+}
+
+// prepareProcessOptions validates per-request options against the profile
+// and expands the watermark templates into opts.Watermarks, keyed by layer.
+func prepareProcessOptions(resolved config.ResolvedProfile, opts ProcessOptions) (ProcessOptions, error) {
+	if f := opts.Focus; f != nil && (!isFinite(f.X) || !isFinite(f.Y) || f.X < 0 || f.X > 1 || f.Y < 0 || f.Y > 1) {
+		return opts, UserError{Err: fmt.Errorf("focal point must be within 0..1: %g,%g", f.X, f.Y)}
+	}
+	texts, err := watermarkTexts(resolved, opts)
+	if err != nil {
+		return opts, err
+	}
+	opts.WatermarkText = ""
+	opts.Watermarks = texts
+	return opts, nil
+}
+
+// Palette returns the colors of src by decreasing share, clustered the way
+// the profile's palette background does it, so callers can reuse them.
+func (p *Processor) Palette(src image.Image, profileName string) ([]PaletteColor, error) {
+	resolved, err := p.resolveProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	return extractPalette(src, paletteSize(resolved.Background)), nil
+}
+
+// DecodeOptions returns opts with the decode settings of the profile applied.
+func (p *Processor) DecodeOptions(profileName string, opts DecodeOptions) (DecodeOptions, error) {
+	resolved, err := p.resolveProfile(profileName)
+	if err != nil {
+		return opts, err
+	}
+	opts.KeepColorProfile = resolved.KeepColorProfile
+	return opts, nil
+}
+
+// Encode writes img in the given output format, or in the profile's format
+// when format is empty, applying the profile's quality and size limit.
+func (p *Processor) Encode(w io.Writer, profileName string, img image.Image, meta Metadata, format string) (EncodeResult, error) {
+	resolved, err := p.resolveProfile(profileName)
+	if err != nil {
+		return EncodeResult{}, err
+	}
+	opts := EncodeOptions{
+		Format:            resolved.OutputFormat,
+		Quality:           resolved.JpegQuality,
+		MaxBytes:          resolved.MaxBytes,
+		MinQuality:        resolved.MinJpegQuality,
+		ChromaSubsampling: resolved.ChromaSubsampling,
+	}
+	if format != "" {
+		opts.Format, err = config.ParseOutputFormat(format)
+		if err != nil {
+			return EncodeResult{}, UserError{Err: err}
+		}
+		if opts.Format == config.OutputFormatWebP && currentWebPEncoder() == nil {
+			return EncodeResult{}, UserError{Err: fmt.Errorf("%w: webp", ErrFormatUnavailable)}
+		}
+	}
+	return Encode(w, img, opts, meta)
+}
+
+// NegotiateFormat picks the output format for an HTTP Accept header: the
+// supported media type with the highest q-value, preferring the profile's
+// own format on ties. Wildcards and unsupported headers resolve to ""
+// (the profile's format).
+func (p *Processor) NegotiateFormat(profileName, accept string) (string, error) {
+	resolved, err := p.resolveProfile(profileName)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(accept) == "" {
+		return "", nil
+	}
+
+	type mediaRange struct {
+		typ string
+		q   float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		r := mediaRange{typ: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, param := range fields[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(k, "q") {
+				if q, err := strconv.ParseFloat(v, 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		if r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+
+	profileType := formatContentType(resolved.OutputFormat)
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return ranges[i].typ == profileType && ranges[j].typ != profileType
+	})
+
+	for _, r := range ranges {
+		switch r.typ {
+		case profileType, "image/*", "*/*":
+			return "", nil
+		case "image/jpeg", "image/pjpeg":
+			return config.OutputFormatJPEG, nil
+		case "image/png":
+			return config.OutputFormatPNG, nil
+		case "image/webp":
+			if currentWebPEncoder() != nil {
+				return config.OutputFormatWebP, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// OutputMetadata filters source metadata by the profile's metadata policy
+// for an output image of the given size. The ICC profile is always kept;
+// outputs without one get an sRGB profile.
+func (p *Processor) OutputMetadata(profileName string, meta Metadata, width, height int) (Metadata, error) {
+	resolved, err := p.resolveProfile(profileName)
+	if err != nil {
+		return Metadata{}, err
+	}
+	out, err := filterMetadata(meta, resolved.MetadataPolicy, resolved.MetadataTags, width, height)
+	if err != nil {
+		return Metadata{}, err
+	}
+	out.ICC = meta.ICC
+	if len(out.ICC) == 0 {
+		out.ICC = srgbICC()
+	}
+	return out, nil
+}
+
+func (p *Processor) resolveProfile(profileName string) (config.ResolvedProfile, error) {
+	resolved, err := p.cfg.ResolveProfile(profileName)
+	if err != nil && errors.Is(err, config.ErrProfileNotFound) {
+		return resolved, UserError{Err: err}
+	}
+	return resolved, err
+}
@@ -1,8 +1,11 @@
 package instafix
 
 import (
+	"bytes"
+	"errors"
 	"image"
 	"image/color"
+	"math"
 	"testing"
 
 	"github.com/aeperfilev/instafix/config"
@@ -24,7 +27,7 @@ func TestProcess_NoUpscaleKeepsSmallImage(t *testing.T) {
 			"default": {
 				BackgroundRef:  "black",
 				FormatRef:      "square",
-				PaddingPercent: 0,
+				PaddingPercent: new(float64),
 				NoUpscale:      true,
 			},
 		},
@@ -101,6 +104,233 @@ func TestResolveFormatAutoChoosesClosestRatio(t *testing.T) {
 	}
 }
 
+func TestResolveFormatRange(t *testing.T) {
+	format := config.Format{Type: "range", Width: 1080, MinRatio: 0.8, MaxRatio: 1.91}
+	tests := []struct {
+		name       string
+		srcW, srcH int
+		wantH      int
+	}{
+		{name: "inside window keeps ratio", srcW: 1000, srcH: 1100, wantH: 1188},
+		{name: "too tall clamps to min ratio", srcW: 1000, srcH: 2000, wantH: 1350},
+		{name: "too wide clamps to max ratio", srcW: 3000, srcH: 1000, wantH: 565},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveFormat(nil, format, tt.srcW, tt.srcH)
+			if err != nil {
+				t.Fatalf("resolveFormat: %v", err)
+			}
+			if got.Width != 1080 || got.Height != tt.wantH {
+				t.Fatalf("expected 1080x%d, got %dx%d", tt.wantH, got.Width, got.Height)
+			}
+		})
+	}
+}
+
+func TestProcess_RangeFormatHasNoBars(t *testing.T) {
+	cfg := config.Config{
+		Settings: config.Settings{
+			JpegQuality: 90,
+			AssetsPath:  "assets",
+		},
+		Backgrounds: map[string]config.Background{
+			"black": {Type: "solid", Color: "#000000"},
+		},
+		Formats: map[string]config.Format{
+			"instagram": {Type: "range", Width: 300, MinRatio: 0.8, MaxRatio: 1.91},
+		},
+		Profiles: map[string]config.Profile{
+			"default": {BackgroundRef: "black", FormatRef: "instagram"},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	out, _, err := processor.Process(solidImage(701, 523, white), "default", "")
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	b := out.Bounds()
+	if b.Dx() != 300 || b.Dy() != 224 {
+		t.Fatalf("expected 300x224, got %dx%d", b.Dx(), b.Dy())
+	}
+	for _, pt := range []image.Point{{0, 0}, {b.Dx() - 1, 0}, {0, b.Dy() - 1}, {b.Dx() - 1, b.Dy() - 1}} {
+		if c := color.NRGBAModel.Convert(out.At(pt.X, pt.Y)).(color.NRGBA); c.R < 250 {
+			t.Fatalf("expected photo at %v, got background %v", pt, c)
+		}
+	}
+
+	out, _, err = processor.Process(solidImage(100, 400, white), "default", "")
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if b := out.Bounds(); b.Dx() != 300 || b.Dy() != 375 {
+		t.Fatalf("expected clamped 300x375, got %dx%d", b.Dx(), b.Dy())
+	}
+	if c := color.NRGBAModel.Convert(out.At(0, 187)).(color.NRGBA); c.R != 0 {
+		t.Fatalf("expected background bar on the side, got %v", c)
+	}
+}
+
+func TestProcessor_NegotiateFormat(t *testing.T) {
+	cfg := config.Config{
+		Settings: config.Settings{
+			JpegQuality: 90,
+			AssetsPath:  "assets",
+		},
+		Backgrounds: map[string]config.Background{
+			"black": {Type: "solid", Color: "#000000"},
+		},
+		Formats: map[string]config.Format{
+			"square": {Type: "fixed", Width: 100, Height: 100},
+		},
+		Profiles: map[string]config.Profile{
+			"default": {BackgroundRef: "black", FormatRef: "square"},
+			"png":     {BackgroundRef: "black", FormatRef: "square", OutputFormat: "png"},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+
+	tests := []struct {
+		profile string
+		accept  string
+		want    string
+	}{
+		{profile: "default", accept: "", want: ""},
+		{profile: "default", accept: "*/*", want: ""},
+		{profile: "default", accept: "image/png", want: "png"},
+		{profile: "default", accept: "image/png;q=0.5, image/jpeg", want: ""},
+		{profile: "default", accept: "image/webp, image/png;q=0.9", want: "png"},
+		{profile: "png", accept: "image/jpeg, image/png", want: ""},
+		{profile: "png", accept: "image/jpeg, image/png;q=0", want: "jpeg"},
+		{profile: "png", accept: "text/html", want: ""},
+	}
+	for _, tt := range tests {
+		got, err := processor.NegotiateFormat(tt.profile, tt.accept)
+		if err != nil {
+			t.Fatalf("NegotiateFormat(%q, %q): %v", tt.profile, tt.accept, err)
+		}
+		if got != tt.want {
+			t.Fatalf("NegotiateFormat(%q, %q) = %q, want %q", tt.profile, tt.accept, got, tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err = processor.Encode(&buf, "default", solidImage(4, 4, color.NRGBA{A: 255}), Metadata{}, "gif")
+	var userErr UserError
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError for unknown format, got %v", err)
+	}
+}
+
+func TestProcess_FitModes(t *testing.T) {
+	cfg := config.Config{
+		Settings: config.Settings{
+			JpegQuality: 90,
+			AssetsPath:  "assets",
+		},
+		Backgrounds: map[string]config.Background{
+			"black": {Type: "solid", Color: "#000000"},
+		},
+		Formats: map[string]config.Format{
+			"square": {Type: "fixed", Width: 100, Height: 100},
+		},
+		Profiles: map[string]config.Profile{
+			"contain": {BackgroundRef: "black", FormatRef: "square"},
+			"cover":   {BackgroundRef: "black", FormatRef: "square", FitMode: "cover"},
+			"smart":   {BackgroundRef: "black", FormatRef: "square", FitMode: "smart"},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+
+	// A white 300x100 photo with a red/black checkerboard near the right edge.
+	src := image.NewNRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			c := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+			if x >= 230 && x < 280 && y >= 25 && y < 75 {
+				c = color.NRGBA{A: 255}
+				if (x/5+y/5)%2 == 0 {
+					c.R = 255
+				}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		profile    string
+		focus      *FocalPoint
+		background bool
+		detail     bool
+	}{
+		{name: "contain letterboxes", profile: "contain", background: true, detail: true},
+		{name: "cover crops the center", profile: "cover"},
+		{name: "cover follows the focal point", profile: "cover", focus: &FocalPoint{X: 1, Y: 0.5}, detail: true},
+		{name: "smart finds the detail", profile: "smart", detail: true},
+		{name: "focal point overrides smart", profile: "smart", focus: &FocalPoint{X: 0, Y: 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, err := processor.ProcessWithOptions(src, tt.profile, ProcessOptions{Focus: tt.focus})
+			if err != nil {
+				t.Fatalf("Process: %v", err)
+			}
+			if got := sameColor(out.At(0, 0), color.NRGBA{A: 255}); got != tt.background {
+				t.Fatalf("background at corner = %v, want %v", got, tt.background)
+			}
+			red := 0
+			for y := 0; y < 100; y++ {
+				for x := 0; x < 100; x++ {
+					if c := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA); c.R > 200 && c.G < 60 {
+						red++
+					}
+				}
+			}
+			if got := red > 0; got != tt.detail {
+				t.Fatalf("detail visible = %v (%d red pixels), want %v", got, red, tt.detail)
+			}
+		})
+	}
+
+	_, _, err = processor.ProcessWithOptions(src, "cover", ProcessOptions{Focus: &FocalPoint{X: 1.5, Y: 0}})
+	var userErr UserError
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError for out-of-range focal point, got %v", err)
+	}
+	_, _, err = processor.ProcessWithOptions(src, "cover", ProcessOptions{Focus: &FocalPoint{X: math.NaN(), Y: 0.5}})
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError for a NaN focal point, got %v", err)
+	}
+}
+
+func TestParseFocalPoint(t *testing.T) {
+	got, err := ParseFocalPoint(" 0.25, 0.75 ")
+	if err != nil || got == nil || got.X != 0.25 || got.Y != 0.75 {
+		t.Fatalf("ParseFocalPoint = %v, %v", got, err)
+	}
+	if got, err := ParseFocalPoint(""); got != nil || err != nil {
+		t.Fatalf("expected nil focal point for empty input, got %v, %v", got, err)
+	}
+	for _, s := range []string{"0.5", "a,b", "0.5;0.5", "NaN,0.5", "0.5,+Inf"} {
+		var userErr UserError
+		if _, err := ParseFocalPoint(s); !errors.As(err, &userErr) {
+			t.Fatalf("expected UserError for %q, got %v", s, err)
+		}
+	}
+}
+
 func solidImage(w, h int, c color.NRGBA) image.Image {
 	img := image.NewNRGBA(image.Rect(0, 0, w, h))
 	for y := 0; y < h; y++ {
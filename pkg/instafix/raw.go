@@ -0,0 +1,383 @@
+package instafix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// RawPreview describes the embedded JPEG preview picked from a RAW file.
+type RawPreview struct {
+	Container string // dng, cr2, nef, arw, orf, raf, pef or tiff
+	IFD       string // where the preview was found, e.g. "IFD0/SubIFD1"
+	Offset    int
+	Length    int
+	Width     int
+	Height    int
+}
+
+type previewCandidate struct {
+	ifd    string
+	offset int
+	length int
+	width  int
+	height int
+}
+
+// rawExtensions lists file extensions that are always handled as RAW containers.
+var rawExtensions = map[string]bool{
+	".dng": true,
+	".raw": true,
+	".cr2": true,
+	".nef": true,
+	".arw": true,
+	".orf": true,
+	".raf": true,
+	".pef": true,
+}
+
+// detectRawContainer reports the RAW container type from magic bytes.
+// Plain TIFF files without camera markers return an empty string.
+func detectRawContainer(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("FUJIFILMCCD-RAW")):
+		return ContainerRAF
+	case bytes.HasPrefix(data, []byte("IIRO")), bytes.HasPrefix(data, []byte("IIRS")),
+		bytes.HasPrefix(data, []byte("MMOR")):
+		return ContainerORF
+	}
+	t, err := newTIFFReader(data, 0)
+	if err != nil {
+		return ""
+	}
+	if len(data) > 10 && string(data[8:10]) == "CR" {
+		return ContainerCR2
+	}
+	if c := tiffContainer(t); c != ContainerTIFF {
+		return c
+	}
+	return ""
+}
+
+// tiffContainer identifies a TIFF-based RAW container by its IFD0 tags.
+func tiffContainer(t *tiffReader) string {
+	ifd0, err := t.readIFD(t.first)
+	if err != nil {
+		return ContainerTIFF
+	}
+	if _, ok := ifd0.entries[tagDNGVersion]; ok {
+		return ContainerDNG
+	}
+	maker := strings.ToUpper(t.str(ifd0, tagMake))
+	switch {
+	case strings.HasPrefix(maker, "CANON"):
+		return ContainerCR2
+	case strings.HasPrefix(maker, "NIKON"):
+		return ContainerNEF
+	case strings.HasPrefix(maker, "SONY"):
+		return ContainerARW
+	case strings.HasPrefix(maker, "OLYMPUS"), strings.HasPrefix(maker, "OM DIGITAL"):
+		return ContainerORF
+	case strings.HasPrefix(maker, "PENTAX"), strings.HasPrefix(maker, "RICOH"):
+		return ContainerPEF
+	}
+	return ContainerTIFF
+}
+
+// decodeRawPreview walks the RAW container and decodes its largest JPEG preview.
+// Previews larger than the decode limits are skipped.
+func decodeRawPreview(data []byte, opts DecodeOptions) (image.Image, RawPreview, error) {
+	container, candidates, orient := findRawPreviews(data)
+	if len(candidates) == 0 {
+		// Some containers keep previews only inside maker notes; fall back to
+		// a marker-aware scan that validates each JPEG's segment structure.
+		candidates = scanJPEGs(data)
+	}
+	if container == "" {
+		container = ContainerTIFF
+	}
+	if len(candidates) == 0 {
+		return nil, RawPreview{}, fmt.Errorf("no embedded JPEG preview found in %s", strings.ToUpper(container))
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].width*candidates[i].height > candidates[j].width*candidates[j].height
+	})
+	var limitErr error
+	for _, c := range candidates {
+		if err := opts.checkSize(c.width, c.height); err != nil {
+			limitErr = err
+			continue
+		}
+		payload := data[c.offset : c.offset+c.length]
+		img, err := imaging.Decode(bytes.NewReader(payload), imaging.AutoOrientation(true))
+		if err != nil {
+			continue
+		}
+		// Previews without their own EXIF rely on the container orientation.
+		if orient > 1 && !jpegHasExif(payload) {
+			img = applyOrientation(img, orient)
+		}
+		return img, RawPreview{
+			Container: container,
+			IFD:       c.ifd,
+			Offset:    c.offset,
+			Length:    c.length,
+			Width:     c.width,
+			Height:    c.height,
+		}, nil
+	}
+	if limitErr != nil {
+		return nil, RawPreview{}, limitErr
+	}
+	return nil, RawPreview{}, fmt.Errorf("failed to decode embedded JPEG preview in %s", strings.ToUpper(container))
+}
+
+// findRawPreviews returns the container type, the JPEG previews referenced by
+// its IFDs and the orientation stored in IFD0.
+func findRawPreviews(data []byte) (string, []previewCandidate, int) {
+	if bytes.HasPrefix(data, []byte("FUJIFILMCCD-RAW")) {
+		return ContainerRAF, rafPreviews(data), 0
+	}
+
+	container := ""
+	var t *tiffReader
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte("IIRO")), bytes.HasPrefix(data, []byte("IIRS")),
+		bytes.HasPrefix(data, []byte("MMOR")):
+		container = ContainerORF
+		t, err = newTIFFReader(data, 0, 0x4F52, 0x5352)
+	default:
+		t, err = newTIFFReader(data, 0)
+	}
+	if err != nil {
+		return "", nil, 0
+	}
+	if container == "" {
+		container = tiffContainer(t)
+		if len(data) > 10 && string(data[8:10]) == "CR" {
+			container = ContainerCR2
+		}
+	}
+
+	orient := 0
+	if ifd0, err := t.readIFD(t.first); err == nil {
+		if v, ok := t.uint(ifd0, tagOrientation); ok {
+			orient = int(v)
+		}
+	}
+
+	visited := make(map[int]bool)
+	var candidates []previewCandidate
+	t.walkChain(t.first, visited, &candidates)
+	return container, candidates, orient
+}
+
+// walkChain follows the main IFD chain starting at off.
+func (t *tiffReader) walkChain(off int, visited map[int]bool, out *[]previewCandidate) {
+	for i := 0; off != 0 && i < tiffMaxIFDs; i++ {
+		next, ok := t.walkIFD(off, fmt.Sprintf("IFD%d", i), 0, visited, out)
+		if !ok {
+			return
+		}
+		off = next
+	}
+}
+
+// walkIFD collects previews from one IFD and descends into its SubIFDs.
+// It returns the offset of the next IFD in the chain.
+func (t *tiffReader) walkIFD(off int, label string, depth int, visited map[int]bool, out *[]previewCandidate) (int, bool) {
+	if visited[off] {
+		return 0, false
+	}
+	visited[off] = true
+
+	ifd, err := t.readIFD(off)
+	if err != nil {
+		return 0, false
+	}
+	t.collectPreviews(ifd, label, out)
+
+	if e, ok := ifd.entries[tagSubIFDs]; ok && depth < tiffMaxDepth {
+		for i, sub := range t.uints(e) {
+			t.walkIFD(int(sub), fmt.Sprintf("%s/SubIFD%d", label, i), depth+1, visited, out)
+		}
+	}
+	return ifd.next, true
+}
+
+func (t *tiffReader) collectPreviews(ifd tiffIFD, label string, out *[]previewCandidate) {
+	if off, ok := t.uint(ifd, tagJPEGInterchangeFormat); ok {
+		length, _ := t.uint(ifd, tagJPEGInterchangeFormatLength)
+		if c, ok := jpegCandidate(t.data, t.base+int(off), int(length), label); ok {
+			*out = append(*out, c)
+		}
+	}
+
+	compression, _ := t.uint(ifd, tagCompression)
+	if compression != 6 && compression != 7 {
+		return
+	}
+	offsets, ok := ifd.entries[tagStripOffsets]
+	if !ok {
+		return
+	}
+	starts := t.uints(offsets)
+	var counts []uint32
+	if e, ok := ifd.entries[tagStripByteCounts]; ok {
+		counts = t.uints(e)
+	}
+	// Multi-strip JPEG data is tiled raw sensor data, not a preview.
+	if len(starts) != 1 {
+		return
+	}
+	length := 0
+	if len(counts) == 1 {
+		length = int(counts[0])
+	}
+	if c, ok := jpegCandidate(t.data, t.base+int(starts[0]), length, label); ok {
+		*out = append(*out, c)
+	}
+}
+
+// rafPreviews reads the JPEG pointer from a Fujifilm RAF header.
+func rafPreviews(data []byte) []previewCandidate {
+	if len(data) < 92 {
+		return nil
+	}
+	off := int(binary.BigEndian.Uint32(data[84:]))
+	length := int(binary.BigEndian.Uint32(data[88:]))
+	if c, ok := jpegCandidate(data, off, length, "RAF"); ok {
+		return []previewCandidate{c}
+	}
+	return nil
+}
+
+// jpegCandidate validates a JPEG referenced at off and reads its dimensions.
+// A zero or out-of-range length is recomputed from the JPEG markers.
+func jpegCandidate(data []byte, off, length int, label string) (previewCandidate, bool) {
+	if off < 0 || off+4 > len(data) || data[off] != 0xFF || data[off+1] != 0xD8 {
+		return previewCandidate{}, false
+	}
+	if length <= 0 || off+length > len(data) {
+		length = jpegLength(data[off:])
+		if length <= 0 {
+			return previewCandidate{}, false
+		}
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data[off : off+length]))
+	if err != nil {
+		return previewCandidate{}, false
+	}
+	return previewCandidate{ifd: label, offset: off, length: length, width: cfg.Width, height: cfg.Height}, true
+}
+
+// scanJPEGs finds complete JPEG streams by walking their segment structure,
+// so thumbnails nested inside APP segments do not terminate the outer image.
+func scanJPEGs(data []byte) []previewCandidate {
+	var results []previewCandidate
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0xFF || data[i+1] != 0xD8 || data[i+2] != 0xFF {
+			continue
+		}
+		n := jpegLength(data[i:])
+		if n <= 0 {
+			continue
+		}
+		if c, ok := jpegCandidate(data, i, n, "scan"); ok {
+			results = append(results, c)
+		}
+		i += n - 1
+	}
+	return results
+}
+
+// jpegLength returns the byte length of the JPEG stream at the start of data,
+// or -1 when the markers do not form a complete image.
+func jpegLength(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return -1
+	}
+	i := 2
+	for i+1 < len(data) {
+		if data[i] != 0xFF {
+			return -1
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			i++
+			continue
+		case marker == 0xD9:
+			return i + 2
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return -1
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2:]))
+		if segLen < 2 {
+			return -1
+		}
+		i += 2 + segLen
+		if marker != 0xDA {
+			continue
+		}
+		// Skip entropy-coded data up to the next real marker.
+		for i+1 < len(data) {
+			if data[i] == 0xFF && data[i+1] != 0x00 && (data[i+1] < 0xD0 || data[i+1] > 0xD7) {
+				break
+			}
+			i++
+		}
+	}
+	return -1
+}
+
+// jpegHasExif reports whether the JPEG stream carries an APP1 Exif segment.
+func jpegHasExif(data []byte) bool {
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return false
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xE1 && i+10 <= len(data) && string(data[i+4:i+10]) == "Exif\x00\x00" {
+			return true
+		}
+		i += 2 + segLen
+	}
+	return false
+}
+
+// applyOrientation transforms img according to an EXIF orientation value.
+func applyOrientation(img image.Image, orient int) image.Image {
+	switch orient {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
@@ -6,45 +6,113 @@ import (
 	"image/color"
 	"image/draw"
 	"math"
-	"path/filepath"
 	"strings"
 
 	"github.com/aeperfilev/instafix/config"
 
 	"github.com/disintegration/imaging"
 	"github.com/fogleman/gg"
+	"golang.org/x/image/font"
 )
 
-func renderImage(src image.Image, resolved config.ResolvedProfile, format config.Format, watermarkText string) (image.Image, error) {
+func renderImage(src image.Image, resolved config.ResolvedProfile, format config.Format, opts ProcessOptions, assets *assetCache) (image.Image, error) {
 	targetW := format.Width
 	targetH := format.Height
 	if targetW <= 0 || targetH <= 0 {
 		return nil, fmt.Errorf("invalid target size: %dx%d", targetW, targetH)
 	}
 
-	dc := gg.NewContext(targetW, targetH)
+	pad := paddingInsets(resolved, targetW, targetH)
+	var stripH float64
+	if resolved.Caption != nil {
+		stripH = captionHeight(*resolved.Caption, targetH)
+		pad.bottom += stripH
+	}
+	dc, photo, err := renderCanvas(src, resolved, targetW, targetH, pad, opts.Focus, assets)
+	if err != nil {
+		return nil, err
+	}
+	if resolved.Caption != nil {
+		if err := drawCaption(dc, *resolved.Caption, opts.Exif, stripH, photo, resolved.AssetsPath, assets); err != nil {
+			return nil, err
+		}
+	}
+
+	areas := newWatermarkAreas(image.Rect(0, 0, targetW, targetH), photo, resolved.BorderWidth, int(stripH))
+	if err := drawWatermarks(dc, resolved, opts.Watermarks, areas, assets); err != nil {
+		return nil, err
+	}
+
+	return dc.Image(), nil
+}
+
+// insets are the padding in pixels on each side of the canvas.
+type insets struct {
+	top, right, bottom, left float64
+}
 
-	img, x, y := fitImage(src, targetW, targetH, resolved.PaddingPercent, resolved.NoUpscale)
-	drawBackground(dc, src, resolved.Background, targetW, targetH, img, int(x), int(y))
+// paddingInsets resolves the profile padding on a width x height canvas.
+func paddingInsets(resolved config.ResolvedProfile, width, height int) insets {
+	w, h := float64(width), float64(height)
+	if p := resolved.Padding; p != nil {
+		return insets{top: p.Top.Pixels(h), right: p.Right.Pixels(w), bottom: p.Bottom.Pixels(h), left: p.Left.Pixels(w)}
+	}
+	padding := math.Max(resolved.PaddingPercent, 0) / 100
+	return insets{top: h * padding, right: w * padding, bottom: h * padding, left: w * padding}
+}
+
+// renderCanvas draws the background, border and fitted photo on a new
+// canvas, leaving pad pixels of padding around the photo. It returns the
+// canvas and the bounds of the photo on it.
+func renderCanvas(src image.Image, resolved config.ResolvedProfile, canvasW, canvasH int, pad insets, focus *FocalPoint, assets *assetCache) (*gg.Context, image.Rectangle, error) {
+	// Pixel padding is only checked against fixed formats in the config; a
+	// format picked by the request can still be too small for it.
+	if (resolved.Padding != nil || resolved.Caption != nil) && (float64(canvasW)-pad.left-pad.right < 1 || float64(canvasH)-pad.top-pad.bottom < 1) {
+		return nil, image.Rectangle{}, UserError{Err: fmt.Errorf("padding leaves no room for the photo on a %dx%d canvas", canvasW, canvasH)}
+	}
+	dc := gg.NewContext(canvasW, canvasH)
+
+	img, x, y := fitImage(src, canvasW, canvasH, pad, resolved.NoUpscale, resolved.FitMode, focus)
+	if resolved.OpticalCenter {
+		// Shift by the free space inside the padded area only, so the photo
+		// never moves into the top padding.
+		free := float64(canvasH) - pad.top - pad.bottom - float64(img.Bounds().Dy())
+		y = math.Max(y-config.OpticalCenterShift*math.Max(free, 0), pad.top)
+	}
+	if err := drawBackground(dc, src, resolved.Background, resolved.AssetsPath, assets, canvasW, canvasH, img, int(x), int(y)); err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	x, y = math.Floor(x), math.Floor(y)
 	imgW := float64(img.Bounds().Dx())
 	imgH := float64(img.Bounds().Dy())
 
+	// Shadow and corners follow the photo together with its border.
+	bw := math.Max(float64(resolved.BorderWidth), 0)
+	frameW, frameH := imgW+2*bw, imgH+2*bw
+	radius := math.Min(resolved.CornerRadius.Pixels(math.Min(frameW, frameH)), math.Min(frameW, frameH)/2)
+	if resolved.Shadow != nil {
+		drawShadow(dc, x-bw, y-bw, frameW, frameH, radius, *resolved.Shadow)
+	}
 	if resolved.BorderWidth > 0 {
-		drawBorder(dc, x, y, imgW, imgH, resolved.BorderWidth, resolved.BorderColor)
+		drawBorder(dc, x, y, imgW, imgH, resolved.BorderWidth, resolved.BorderColor, radius)
 	}
-	dc.DrawImage(img, int(x), int(y))
-
-	if watermarkText != "" && resolved.Watermark != nil {
-		if err := drawWatermark(dc, watermarkText, *resolved.Watermark, resolved.AssetsPath); err != nil {
-			return nil, err
-		}
+	if inner := radius - bw; inner > 0 {
+		dc.DrawRoundedRectangle(x, y, imgW, imgH, inner)
+		dc.Clip()
+		dc.DrawImage(img, int(x), int(y))
+		dc.ResetClip()
+	} else {
+		dc.DrawImage(img, int(x), int(y))
 	}
-
-	return dc.Image(), nil
+	return dc, image.Rect(int(x), int(y), int(x)+img.Bounds().Dx(), int(y)+img.Bounds().Dy()), nil
 }
 
-func drawBackground(dc *gg.Context, src image.Image, bg config.Background, width, height int, fitted image.Image, fitX, fitY int) {
-	switch strings.ToLower(bg.Type) {
+func drawBackground(dc *gg.Context, src image.Image, bg config.Background, assetsPath string, assets *assetCache, width, height int, fitted image.Image, fitX, fitY int) error {
+	typ := strings.ToLower(bg.Type)
+	if typ == "" && len(bg.Layers) > 0 {
+		return drawLayers(dc, src, bg.Layers, assetsPath, assets, width, height, fitted, fitX, fitY)
+	}
+	switch typ {
 	case "solid":
 		setHexColor(dc, bg.Color, 1.0)
 		dc.Clear()
@@ -56,7 +124,7 @@ func drawBackground(dc *gg.Context, src image.Image, bg config.Background, width
 	case "stretch":
 		stretched, err := stretchBackground(src, fitted, width, height, fitX, fitY)
 		if err != nil {
-			return
+			return nil
 		}
 		dc.DrawImage(stretched, 0, 0)
 		applyDarken(dc, width, height, bg.Darken)
@@ -65,63 +133,175 @@ func drawBackground(dc *gg.Context, src image.Image, bg config.Background, width
 		blurred := imaging.Blur(bgFill, bg.BlurRadius)
 		dc.DrawImage(blurred, 0, 0)
 		applyDarken(dc, width, height, bg.Darken)
+	case "palette":
+		c := adjustHSL(pickPaletteColor(extractPalette(src, paletteSize(bg)), bg.Strategy), bg.Saturation, bg.Lightness)
+		dc.SetColor(c)
+		dc.Clear()
+		applyDarken(dc, width, height, bg.Darken)
+	case "gradient":
+		drawGradient(dc, src, bg, width, height)
+		applyDarken(dc, width, height, bg.Darken)
+	case "image":
+		texture, err := assets.image(config.AssetPath(assetsPath, bg.Image))
+		if err != nil {
+			return err
+		}
+		drawTexture(dc, texture, bg, width, height)
+		applyDarken(dc, width, height, bg.Darken)
 	default:
 		dc.SetRGB(0, 0, 0)
 		dc.Clear()
 	}
+	return drawLayers(dc, src, bg.Layers, assetsPath, assets, width, height, fitted, fitX, fitY)
+}
+
+// drawTexture lays a texture over the canvas by the background mode and
+// applies its tint.
+func drawTexture(dc *gg.Context, texture image.Image, bg config.Background, width, height int) {
+	switch strings.ToLower(strings.TrimSpace(bg.Mode)) {
+	case config.ImageModeTile:
+		tw, th := texture.Bounds().Dx(), texture.Bounds().Dy()
+		for y := 0; y < height; y += th {
+			for x := 0; x < width; x += tw {
+				dc.DrawImage(texture, x, y)
+			}
+		}
+	case config.ImageModeStretch:
+		dc.DrawImage(imaging.Resize(texture, width, height, imaging.Lanczos), 0, 0)
+	default:
+		dc.DrawImage(imaging.Fill(texture, width, height, imaging.Center, imaging.Lanczos), 0, 0)
+	}
+	if bg.Tint != "" {
+		opacity := bg.TintOpacity
+		if opacity == 0 {
+			opacity = config.DefaultTintOpacity
+		}
+		setHexColor(dc, bg.Tint, opacity)
+		dc.DrawRectangle(0, 0, float64(width), float64(height))
+		dc.Fill()
+	}
 }
 
-func fitImage(src image.Image, targetW, targetH int, paddingPercent float64, noUpscale bool) (image.Image, float64, float64) {
+// fitImage scales src into the canvas minus the padding and returns it with
+// its position, centered in the padded area. In cover and smart modes src is
+// first cropped to the ratio of that area, so it fills the area unless
+// noUpscale keeps a small crop as is.
+func fitImage(src image.Image, targetW, targetH int, pad insets, noUpscale bool, fitMode string, focus *FocalPoint) (image.Image, float64, float64) {
 	canvasW := float64(targetW)
 	canvasH := float64(targetH)
 
-	padding := math.Max(paddingPercent, 0)
-	availW := canvasW * (1.0 - (padding * 2 / 100.0))
-	availH := canvasH * (1.0 - (padding * 2 / 100.0))
+	availW := canvasW - pad.left - pad.right
+	availH := canvasH - pad.top - pad.bottom
 	if availW < 1 {
 		availW = 1
 	}
 	if availH < 1 {
 		availH = 1
 	}
+	cropped := fitMode == config.FitCover || fitMode == config.FitSmart
+	if cropped {
+		src = cropToRatio(src, availW/availH, fitMode, focus)
+	}
 
 	srcW := float64(src.Bounds().Dx())
 	srcH := float64(src.Bounds().Dy())
 	scale := math.Min(availW/srcW, availH/srcH)
 
 	var fitted image.Image
-	if noUpscale && scale > 1.0 {
+	switch {
+	case noUpscale && scale > 1.0:
 		fitted = src
-	} else {
+	case cropped, math.Abs(srcW*scale-availW) < 1 && math.Abs(srcH*scale-availH) < 1:
+		// The ratios match up to rounding (cropped images, range formats):
+		// fill the box exactly instead of leaving a sliver of background.
+		fitted = imaging.Resize(src, int(availW), int(availH), imaging.Lanczos)
+	default:
 		fitted = imaging.Fit(src, int(availW), int(availH), imaging.Lanczos)
 	}
 
-	x := (canvasW - float64(fitted.Bounds().Dx())) / 2
-	y := (canvasH - float64(fitted.Bounds().Dy())) / 2
+	x := pad.left + (availW-float64(fitted.Bounds().Dx()))/2
+	y := pad.top + (availH-float64(fitted.Bounds().Dy()))/2
 	return fitted, x, y
 }
 
-func drawBorder(dc *gg.Context, x, y, w, h float64, borderWidth int, borderColor string) {
+func drawBorder(dc *gg.Context, x, y, w, h float64, borderWidth int, borderColor string, radius float64) {
 	if borderWidth <= 0 {
 		return
 	}
 	setHexColor(dc, borderColor, 1.0)
 	bw := float64(borderWidth)
-	dc.DrawRectangle(x-bw, y-bw, w+bw*2, h+bw*2)
+	if radius > 0 {
+		dc.DrawRoundedRectangle(x-bw, y-bw, w+bw*2, h+bw*2, radius)
+	} else {
+		dc.DrawRectangle(x-bw, y-bw, w+bw*2, h+bw*2)
+	}
 	dc.Fill()
 }
 
-func drawWatermark(dc *gg.Context, text string, wm config.Watermark, assetsPath string) error {
-	fontPath := wm.Font
-	if !filepath.IsAbs(fontPath) {
-		fontPath = filepath.Join(assetsPath, wm.Font)
+// drawShadow draws a blurred copy of the w x h frame at x, y shifted by the
+// shadow offset. Only the frame's neighbourhood is blurred.
+func drawShadow(dc *gg.Context, x, y, w, h, radius float64, shadow config.Shadow) {
+	margin := math.Ceil(3 * shadow.Blur)
+	sc := gg.NewContext(int(w+2*margin), int(h+2*margin))
+	setHexColor(sc, shadow.Color, shadow.Opacity)
+	sc.DrawRoundedRectangle(margin, margin, w, h, radius)
+	sc.Fill()
+	var img image.Image = sc.Image()
+	if shadow.Blur > 0 {
+		img = imaging.Blur(img, shadow.Blur)
 	}
-	if err := dc.LoadFontFace(fontPath, wm.Size); err != nil {
-		return fmt.Errorf("load watermark font: %w", err)
+	dc.DrawImage(img, int(math.Round(x+shadow.OffsetX-margin)), int(math.Round(y+shadow.OffsetY-margin)))
+}
+
+// drawWatermarks draws the watermark layers of the profile in order, with the
+// text of each layer from texts.
+func drawWatermarks(dc *gg.Context, resolved config.ResolvedProfile, texts map[string]string, areas watermarkAreas, assets *assetCache) error {
+	for _, layer := range resolved.Watermarks {
+		area := areas.area(layer.Anchor)
+		if err := drawWatermark(dc, texts[layer.Name], layer.Watermark, area, resolved.AssetsPath, assets); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	x, y, ax, ay := anchorForAlign(dc.Width(), dc.Height(), wm.Align, wm.OffsetX, wm.OffsetY)
+// drawWatermark draws the watermark of style wm in area: the text, or the
+// image for image watermarks, once or tiled. A text watermark without text
+// draws nothing.
+func drawWatermark(dc *gg.Context, text string, wm config.Watermark, area image.Rectangle, assetsPath string, assets *assetCache) error {
+	if !isImageWatermark(wm) && text == "" {
+		return nil
+	}
+	if isTiledWatermark(wm) {
+		return drawTiledWatermark(dc, text, wm, area, assetsPath, assets)
+	}
+	if isImageWatermark(wm) {
+		return drawImageWatermark(dc, wm, area, assetsPath, assets)
+	}
+	face, err := watermarkFont(wm, area, assetsPath)
+	if err != nil {
+		return err
+	}
+	dc.SetFontFace(face)
 
+	x, y, ax, ay := anchorInArea(area, wm)
+	wm = contrastWatermark(dc, wm, textBounds(dc, text, x, y, ax, ay))
+	drawWatermarkText(dc, text, wm, x, y, ax, ay)
+	return nil
+}
+
+// watermarkFont loads the font of wm, sized against area.
+func watermarkFont(wm config.Watermark, area image.Rectangle, assetsPath string) (font.Face, error) {
+	face, err := gg.LoadFontFace(config.AssetPath(assetsPath, wm.Font), wm.Size.Pixels(float64(area.Dx())))
+	if err != nil {
+		return nil, fmt.Errorf("load watermark font: %w", err)
+	}
+	return face, nil
+}
+
+// drawWatermarkText draws text anchored at x, y in the color, outline and
+// opacity of wm.
+func drawWatermarkText(dc *gg.Context, text string, wm config.Watermark, x, y, ax, ay float64) {
 	if wm.Outline {
 		outlineWidth := wm.OutlineWidth
 		if outlineWidth == 0 {
@@ -140,7 +320,6 @@ func drawWatermark(dc *gg.Context, text string, wm config.Watermark, assetsPath
 
 	setHexColor(dc, wm.Color, wm.Opacity)
 	dc.DrawStringAnchored(text, x, y, ax, ay)
-	return nil
 }
 
 func stretchBackground(src image.Image, fitted image.Image, width, height, x0, y0 int) (image.Image, error) {
@@ -0,0 +1,144 @@
+package instafix
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestRenderCanvas_ShadowAndCorners(t *testing.T) {
+	resolved := config.ResolvedProfile{
+		Background:   config.Background{Type: "solid", Color: "#ffffff"},
+		BorderWidth:  4,
+		BorderColor:  "#0000ff",
+		FitMode:      config.FitContain,
+		CornerRadius: config.Length{Value: 20},
+		Shadow:       &config.Shadow{OffsetY: 10, Blur: 3, Color: "#000000", Opacity: 0.5},
+	}
+	src := solidImage(120, 120, color.NRGBA{R: 255, A: 255})
+	dc, _, err := renderCanvas(src, resolved, 200, 200, insets{40, 40, 40, 40}, nil, nil)
+	if err != nil {
+		t.Fatalf("renderCanvas: %v", err)
+	}
+	img := dc.Image()
+
+	// The photo sits at 40..160 inside a 4px border: 36..164.
+	if c := colorToNRGBA(img.At(100, 100)); c != (color.NRGBA{R: 255, A: 255}) {
+		t.Fatalf("photo center = %v, want red", c)
+	}
+	if c := colorToNRGBA(img.At(37, 100)); c.B < 250 || c.R > 5 {
+		t.Fatalf("border = %v, want blue", c)
+	}
+	if c := colorToNRGBA(img.At(37, 37)); c.R < 240 || c.G < 240 {
+		t.Fatalf("rounded corner = %v, want background", c)
+	}
+	if c := colorToNRGBA(img.At(43, 44)); c.R > 5 || c.B < 200 {
+		t.Fatalf("photo corner = %v, want border around the inner radius", c)
+	}
+	if c := colorToNRGBA(img.At(100, 168)); c.R > 200 {
+		t.Fatalf("below the frame = %v, want shadow", c)
+	}
+	if c := colorToNRGBA(img.At(100, 195)); c.R < 250 {
+		t.Fatalf("far below the frame = %v, want background", c)
+	}
+}
+
+func TestRenderCanvas_Padding(t *testing.T) {
+	src := solidImage(400, 400, color.NRGBA{R: 255, A: 255})
+	bottomHeavy := &config.Padding{
+		Top:    config.Length{Value: 10},
+		Right:  config.Length{Value: 5, Percent: true},
+		Bottom: config.Length{Value: 30, Percent: true},
+		Left:   config.Length{Value: 10},
+	}
+	topLight := &config.Padding{
+		Top:    config.Length{Value: 4, Percent: true},
+		Right:  config.Length{Value: 10},
+		Bottom: config.Length{Value: 30, Percent: true},
+		Left:   config.Length{Value: 10},
+	}
+	tests := []struct {
+		name     string
+		src      image.Image
+		resolved config.ResolvedProfile
+		want     image.Rectangle
+	}{
+		{
+			name:     "uniform percent",
+			resolved: config.ResolvedProfile{PaddingPercent: 10},
+			want:     image.Rect(20, 20, 180, 180),
+		},
+		{
+			// 200 - 10 - 10 wide, 200 - 10 - 60 high: a 130px square centered
+			// horizontally in the padded area.
+			name:     "per side",
+			resolved: config.ResolvedProfile{Padding: bottomHeavy},
+			want:     image.Rect(35, 10, 165, 140),
+		},
+		{
+			// A 160x80 photo leaves 80px free in the padded area; the top
+			// takes 5% of it less.
+			name:     "optical center",
+			src:      solidImage(400, 200, color.NRGBA{R: 255, A: 255}),
+			resolved: config.ResolvedProfile{PaddingPercent: 10, OpticalCenter: true},
+			want:     image.Rect(20, 56, 180, 136),
+		},
+		{
+			// The photo fills the padded area: nothing is free to shift.
+			name:     "optical center with a filled area",
+			resolved: config.ResolvedProfile{PaddingPercent: 10, OpticalCenter: true},
+			want:     image.Rect(20, 20, 180, 180),
+		},
+		{
+			// Cover fills 180x132 below an 8px top; the 60px bottom padding
+			// is not free space, so the top padding stays intact.
+			name:     "optical center keeps the top padding",
+			resolved: config.ResolvedProfile{Padding: topLight, FitMode: config.FitCover, OpticalCenter: true},
+			want:     image.Rect(10, 8, 190, 140),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.resolved.Background = config.Background{Type: "solid", Color: "#000000"}
+			img := tt.src
+			if img == nil {
+				img = src
+			}
+			pad := paddingInsets(tt.resolved, 200, 200)
+			dc, photo, err := renderCanvas(img, tt.resolved, 200, 200, pad, nil, nil)
+			if err != nil {
+				t.Fatalf("renderCanvas: %v", err)
+			}
+			if float64(photo.Min.Y) < math.Floor(pad.top) {
+				t.Fatalf("photo top %d is inside the %v px top padding", photo.Min.Y, pad.top)
+			}
+			if got := redBounds(dc.Image()); got != tt.want {
+				t.Fatalf("photo at %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	full := config.ResolvedProfile{Padding: &config.Padding{Left: config.Length{Value: 150}, Right: config.Length{Value: 60}}}
+	var userErr UserError
+	if _, _, err := renderCanvas(src, full, 200, 200, paddingInsets(full, 200, 200), nil, nil); !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError when the padding leaves no room, got %v", err)
+	}
+}
+
+// redBounds returns the bounding box of the red pixels of img.
+func redBounds(img image.Image) image.Rectangle {
+	var r image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := colorToNRGBA(img.At(x, y)); c.R > 128 && c.G < 64 {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
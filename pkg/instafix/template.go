@@ -0,0 +1,190 @@
+package instafix
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+// DefaultDateLayout formats {date} when the template gives no layout.
+const DefaultDateLayout = "2006-01-02"
+
+// templatePart is a literal or a {name} / {name:format} variable.
+type templatePart struct {
+	literal string
+	name    string
+	format  string
+}
+
+// parseTemplate splits a watermark template into literals and variables.
+// "{{" and "}}" stand for literal braces.
+func parseTemplate(tmpl string) ([]templatePart, error) {
+	var parts []templatePart
+	var lit strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		switch c := tmpl[i]; {
+		case c == '{' && strings.HasPrefix(tmpl[i:], "{{"), c == '}' && strings.HasPrefix(tmpl[i:], "}}"):
+			lit.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed { in template %q", tmpl)
+			}
+			name, format, _ := strings.Cut(tmpl[i+1:i+end], ":")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				return nil, fmt.Errorf("empty variable in template %q", tmpl)
+			}
+			if lit.Len() > 0 {
+				parts = append(parts, templatePart{literal: lit.String()})
+				lit.Reset()
+			}
+			parts = append(parts, templatePart{name: name, format: format})
+			i += end
+		case c == '}':
+			return nil, fmt.Errorf("unexpected } in template %q", tmpl)
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	if lit.Len() > 0 {
+		parts = append(parts, templatePart{literal: lit.String()})
+	}
+	return parts, nil
+}
+
+// expandTemplate fills the variables of tmpl with lookup. Unknown variables
+// are a UserError.
+func expandTemplate(tmpl string, lookup func(name, format string) (string, bool)) (string, error) {
+	parts, err := parseTemplate(tmpl)
+	if err != nil {
+		return "", UserError{Err: err}
+	}
+	var out strings.Builder
+	for _, p := range parts {
+		if p.name == "" {
+			out.WriteString(p.literal)
+			continue
+		}
+		v, ok := lookup(p.name, p.format)
+		if !ok {
+			return "", UserError{Err: fmt.Errorf("unknown watermark variable: {%s}", p.name)}
+		}
+		out.WriteString(v)
+	}
+	return out.String(), nil
+}
+
+// watermarkTexts expands the text of every text watermark layer, by layer
+// name. opts.WatermarkText goes to the first text layer unless opts.Watermarks
+// has text for it.
+func watermarkTexts(resolved config.ResolvedProfile, opts ProcessOptions) (map[string]string, error) {
+	if opts.WatermarkText != "" && len(resolved.Watermarks) == 0 {
+		return nil, UserError{Err: fmt.Errorf("watermark text provided, but profile has no watermark_ref")}
+	}
+	layers := make(map[string]config.Watermark, len(resolved.Watermarks))
+	for _, layer := range resolved.Watermarks {
+		layers[layer.Name] = layer.Watermark
+	}
+	for name := range opts.Watermarks {
+		wm, ok := layers[name]
+		if !ok {
+			return nil, UserError{Err: fmt.Errorf("unknown watermark layer: %s", name)}
+		}
+		if isImageWatermark(wm) {
+			return nil, UserError{Err: fmt.Errorf("watermark text provided, but watermark layer %s is an image", name)}
+		}
+	}
+
+	texts := make(map[string]string, len(resolved.Watermarks))
+	first := true
+	for _, layer := range resolved.Watermarks {
+		if isImageWatermark(layer.Watermark) {
+			continue
+		}
+		text, ok := opts.Watermarks[layer.Name]
+		if !ok && first {
+			text = opts.WatermarkText
+		}
+		first = false
+		expanded, err := watermarkText(layer.Watermark, text, opts)
+		if err != nil {
+			return nil, err
+		}
+		texts[layer.Name] = expanded
+	}
+	if first && opts.WatermarkText != "" {
+		return nil, UserError{Err: fmt.Errorf("watermark text provided, but profile watermark is an image")}
+	}
+	return texts, nil
+}
+
+// watermarkText expands the text of a watermark layer: the style's template
+// (default "{text}") with {text} set to the runtime text verbatim. Runtime
+// text is never parsed, so braces in it are literal. Variables come from
+// opts.Vars first, then from the EXIF and the filename; missing EXIF values
+// expand to "".
+func watermarkText(wm config.Watermark, runtime string, opts ProcessOptions) (string, error) {
+	if wm.Template == "" {
+		return strings.TrimSpace(runtime), nil
+	}
+	out, err := expandTemplate(wm.Template, func(name, format string) (string, bool) {
+		if name == "text" {
+			return runtime, true
+		}
+		return templateValue(name, format, opts)
+	})
+	return strings.TrimSpace(out), err
+}
+
+// templateValue resolves a template variable other than {text}.
+func templateValue(name, format string, opts ProcessOptions) (string, bool) {
+	for k, v := range opts.Vars {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	e := opts.Exif
+	switch name {
+	case "date":
+		if e.DateTime.IsZero() {
+			return "", true
+		}
+		if format == "" {
+			format = DefaultDateLayout
+		}
+		return e.DateTime.Format(format), true
+	case "camera":
+		return e.Camera(), true
+	case "make":
+		return e.Make, true
+	case "model":
+		return e.Model, true
+	case "lens":
+		return e.LensModel, true
+	case "focal":
+		return e.Focal(), true
+	case "aperture":
+		return e.Aperture(), true
+	case "shutter":
+		return e.Shutter(), true
+	case "iso":
+		if e.ISO == 0 {
+			return "", true
+		}
+		return strconv.Itoa(e.ISO), true
+	case "settings":
+		return e.Settings(), true
+	case "filename":
+		base := filepath.Base(opts.Filename)
+		if opts.Filename == "" || base == "." {
+			return "", true
+		}
+		return strings.TrimSuffix(base, filepath.Ext(base)), true
+	}
+	return "", false
+}
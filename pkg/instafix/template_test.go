@@ -0,0 +1,132 @@
+package instafix
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aeperfilev/instafix/config"
+)
+
+func TestWatermarkText(t *testing.T) {
+	exif := ExifInfo{
+		Make:         "FUJIFILM",
+		Model:        "X-T4",
+		FocalLength:  35,
+		FNumber:      1.4,
+		ExposureTime: 1.0 / 250,
+		ISO:          320,
+		DateTime:     time.Date(2024, 5, 17, 18, 30, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name     string
+		template string
+		text     string
+		vars     map[string]string
+		exif     ExifInfo
+		want     string
+		wantErr  bool
+	}{
+		{name: "literal", text: "@jane", want: "@jane"},
+		{name: "runtime text is literal", text: "© studio {2024}", want: "© studio {2024}"},
+		{name: "runtime text with stray brace", text: "a}b", want: "a}b"},
+		{name: "runtime text with unclosed brace", text: "{date", want: "{date"},
+		{name: "template", template: "{author} · {date:2006-01-02} · {camera}", vars: map[string]string{"author": "Jane"}, exif: exif, want: "Jane · 2024-05-17 · FUJIFILM X-T4"},
+		{name: "default date layout", template: "{date}", exif: exif, want: "2024-05-17"},
+		{name: "settings", template: "{focal} {aperture} {shutter} ISO{iso}", exif: exif, want: "35mm f/1.4 1/250s ISO320"},
+		{name: "filename", template: "{filename}", want: "IMG_0042"},
+		{name: "user vars win", template: "{camera}", vars: map[string]string{"Camera": "Pinhole"}, exif: exif, want: "Pinhole"},
+		{name: "missing exif", template: "{lens}", want: ""},
+		{name: "escaped braces", template: "{{{author}}}", vars: map[string]string{"author": "Jane"}, want: "{Jane}"},
+		{name: "text inserted verbatim", template: "{text} · {model}", text: "© studio {2024}", exif: exif, want: "© studio {2024} · X-T4"},
+		{name: "template without text", template: "{camera}", text: "@jane", exif: exif, want: "FUJIFILM X-T4"},
+		{name: "unknown variable", template: "{author}", wantErr: true},
+		{name: "unknown with text", template: "{text} {who}", text: "x", wantErr: true},
+		{name: "unclosed", template: "{date", wantErr: true},
+		{name: "stray brace", template: "a}b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := watermarkText(config.Watermark{Template: tt.template}, tt.text, ProcessOptions{
+				Vars:     tt.vars,
+				Exif:     tt.exif,
+				Filename: "/photos/IMG_0042.JPG",
+			})
+			if tt.wantErr {
+				var userErr UserError
+				if !errors.As(err, &userErr) {
+					t.Fatalf("expected UserError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("watermarkText: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("watermarkText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatermarkTexts_Layers(t *testing.T) {
+	resolved := config.ResolvedProfile{Watermarks: []config.ResolvedWatermark{
+		{Name: "logo", Watermark: config.Watermark{Kind: "image"}},
+		{Name: "handle"},
+		{Name: "exif", Watermark: config.Watermark{Template: "{text} {model}"}},
+	}}
+	exif := ExifInfo{Model: "X-T4"}
+	tests := []struct {
+		name    string
+		text    string
+		layers  map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "text goes to the first text layer", text: "@jane", want: map[string]string{"handle": "@jane", "exif": "X-T4"}},
+		{name: "keyed text", layers: map[string]string{"handle": "@jane", "exif": "shot on"}, want: map[string]string{"handle": "@jane", "exif": "shot on X-T4"}},
+		{name: "keyed text wins", text: "@john", layers: map[string]string{"handle": "@jane"}, want: map[string]string{"handle": "@jane", "exif": "X-T4"}},
+		{name: "unknown layer", layers: map[string]string{"footer": "x"}, wantErr: true},
+		{name: "text for an image layer", layers: map[string]string{"logo": "x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := watermarkTexts(resolved, ProcessOptions{WatermarkText: tt.text, Watermarks: tt.layers, Exif: exif})
+			if tt.wantErr {
+				var userErr UserError
+				if !errors.As(err, &userErr) {
+					t.Fatalf("expected UserError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("watermarkTexts: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("watermarkTexts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	logoOnly := config.ResolvedProfile{Watermarks: resolved.Watermarks[:1]}
+	for _, r := range []config.ResolvedProfile{{}, logoOnly} {
+		var userErr UserError
+		if _, err := watermarkTexts(r, ProcessOptions{WatermarkText: "@jane"}); !errors.As(err, &userErr) {
+			t.Fatalf("expected UserError for text without a text layer, got %v", err)
+		}
+	}
+}
+
+func TestNewProcessor_RejectsBadTemplate(t *testing.T) {
+	cfg := config.Config{
+		Settings:    config.Settings{JpegQuality: 90},
+		Backgrounds: map[string]config.Background{"black": {Type: "solid", Color: "#000000"}},
+		Formats:     map[string]config.Format{"square": {Type: "fixed", Width: 100, Height: 100}},
+		Watermarks:  map[string]config.Watermark{"broken": {Font: "font.ttf", Size: config.Length{Value: 12}, Template: "{date"}},
+		Profiles:    map[string]config.Profile{"default": {BackgroundRef: "black", FormatRef: "square", WatermarkRef: "broken"}},
+	}
+	if _, err := NewProcessor(cfg); err == nil {
+		t.Fatal("expected an error for an unclosed template variable")
+	}
+}
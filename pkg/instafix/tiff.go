@@ -0,0 +1,178 @@
+package instafix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// TIFF tags used to locate embedded previews and read basic image info.
+const (
+	tagCompression                 = 0x0103
+	tagMake                        = 0x010F
+	tagStripOffsets                = 0x0111
+	tagOrientation                 = 0x0112
+	tagStripByteCounts             = 0x0117
+	tagSubIFDs                     = 0x014A
+	tagJPEGInterchangeFormat       = 0x0201
+	tagJPEGInterchangeFormatLength = 0x0202
+	tagDNGVersion                  = 0xC612
+)
+
+const (
+	tiffMaxIFDs  = 16
+	tiffMaxDepth = 4
+)
+
+// tiffMaxPages bounds the page walk of multi-page TIFF documents such as
+// archive scans; it only stops absurd page numbers, loops are caught anyway.
+const tiffMaxPages = 10000
+
+// tiffReader reads IFDs from a TIFF structure embedded at base within data.
+// Offsets stored in the structure are relative to base.
+type tiffReader struct {
+	data  []byte
+	base  int
+	order binary.ByteOrder
+	first int
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	pos   int // absolute position of the value bytes within data
+}
+
+type tiffIFD struct {
+	entries map[uint16]tiffEntry
+	next    int
+}
+
+// newTIFFReader parses a TIFF header at base. magics lists the accepted
+// header magic numbers (42 for plain TIFF, camera-specific values for ORF/RW2).
+func newTIFFReader(data []byte, base int, magics ...uint16) (*tiffReader, error) {
+	if base < 0 || base+8 > len(data) {
+		return nil, fmt.Errorf("tiff header out of range")
+	}
+	var order binary.ByteOrder
+	switch string(data[base : base+2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid tiff byte order")
+	}
+	if len(magics) == 0 {
+		magics = []uint16{42}
+	}
+	magic := order.Uint16(data[base+2:])
+	known := false
+	for _, m := range magics {
+		if magic == m {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("invalid tiff magic: %d", magic)
+	}
+	return &tiffReader{
+		data:  data,
+		base:  base,
+		order: order,
+		first: int(order.Uint32(data[base+4:])),
+	}, nil
+}
+
+func (t *tiffReader) readIFD(off int) (tiffIFD, error) {
+	pos := t.base + off
+	if off <= 0 || pos+2 > len(t.data) {
+		return tiffIFD{}, fmt.Errorf("ifd offset out of range: %d", off)
+	}
+	n := int(t.order.Uint16(t.data[pos:]))
+	end := pos + 2 + n*12
+	if end+4 > len(t.data) {
+		return tiffIFD{}, fmt.Errorf("ifd at %d is truncated", off)
+	}
+
+	entries := make(map[uint16]tiffEntry, n)
+	for i := 0; i < n; i++ {
+		p := pos + 2 + i*12
+		e := tiffEntry{
+			tag:   t.order.Uint16(t.data[p:]),
+			typ:   t.order.Uint16(t.data[p+2:]),
+			count: t.order.Uint32(t.data[p+4:]),
+			pos:   p + 8,
+		}
+		size := tiffTypeSize(e.typ) * int(e.count)
+		if size <= 0 {
+			continue
+		}
+		if size > 4 {
+			e.pos = t.base + int(t.order.Uint32(t.data[p+8:]))
+		}
+		if e.pos < 0 || e.pos+size > len(t.data) {
+			continue
+		}
+		entries[e.tag] = e
+	}
+	return tiffIFD{entries: entries, next: int(t.order.Uint32(t.data[end:]))}, nil
+}
+
+// uints returns integer values of BYTE, SHORT, LONG and IFD entries.
+func (t *tiffReader) uints(e tiffEntry) []uint32 {
+	size := tiffTypeSize(e.typ)
+	out := make([]uint32, 0, e.count)
+	for i := 0; i < int(e.count); i++ {
+		p := e.pos + i*size
+		switch e.typ {
+		case 1, 7:
+			out = append(out, uint32(t.data[p]))
+		case 3:
+			out = append(out, uint32(t.order.Uint16(t.data[p:])))
+		case 4, 13:
+			out = append(out, t.order.Uint32(t.data[p:]))
+		default:
+			return nil
+		}
+	}
+	return out
+}
+
+func (t *tiffReader) uint(ifd tiffIFD, tag uint16) (uint32, bool) {
+	e, ok := ifd.entries[tag]
+	if !ok {
+		return 0, false
+	}
+	vals := t.uints(e)
+	if len(vals) == 0 {
+		return 0, false
+	}
+	return vals[0], true
+}
+
+func (t *tiffReader) str(ifd tiffIFD, tag uint16) string {
+	e, ok := ifd.entries[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	raw := t.data[e.pos : e.pos+int(e.count)]
+	return strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+}
+
+func tiffTypeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11, 13:
+		return 4
+	case 5, 10, 12:
+		return 8
+	default:
+		return 0
+	}
+}
@@ -1,6 +1,18 @@
 package instafix
 
-import "strings"
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
 
 func anchorForAlign(width, height int, align string, offsetX, offsetY float64) (float64, float64, float64, float64) {
 	w := float64(width)
@@ -61,3 +73,261 @@ func anchorForAlign(width, height int, align string, offsetX, offsetY float64) (
 
 	return x, y, ax, ay
 }
+
+// watermarkAreas are the areas of a canvas a watermark can be anchored to.
+type watermarkAreas struct {
+	canvas, photo, padding image.Rectangle
+}
+
+// newWatermarkAreas returns the anchor areas of canvas with the photo at
+// photo inside a border of the given width. The padding area is the margin
+// below the border, above the reserved rows of a caption strip.
+func newWatermarkAreas(canvas, photo image.Rectangle, border, reserved int) watermarkAreas {
+	return watermarkAreas{
+		canvas: canvas,
+		photo:  photo,
+		padding: image.Rectangle{
+			Min: image.Pt(canvas.Min.X, photo.Max.Y+border),
+			Max: image.Pt(canvas.Max.X, canvas.Max.Y-reserved),
+		},
+	}
+}
+
+// area returns the area of the anchor; an empty photo or padding area falls
+// back to the canvas.
+func (a watermarkAreas) area(anchor string) image.Rectangle {
+	var r image.Rectangle
+	switch strings.ToLower(strings.TrimSpace(anchor)) {
+	case config.AnchorPhoto:
+		r = a.photo
+	case config.AnchorPadding:
+		r = a.padding
+	}
+	if r.Empty() {
+		return a.canvas
+	}
+	return r
+}
+
+// anchorInArea is anchorForAlign within area, with the offsets of wm resolved
+// against the area size.
+func anchorInArea(area image.Rectangle, wm config.Watermark) (float64, float64, float64, float64) {
+	w, h := float64(area.Dx()), float64(area.Dy())
+	x, y, ax, ay := anchorForAlign(area.Dx(), area.Dy(), wm.Align, wm.OffsetX.Pixels(w), wm.OffsetY.Pixels(h))
+	return x + float64(area.Min.X), y + float64(area.Min.Y), ax, ay
+}
+
+// isImageWatermark reports whether wm draws an image rather than text.
+func isImageWatermark(wm config.Watermark) bool {
+	return strings.ToLower(strings.TrimSpace(wm.Kind)) == config.WatermarkKindImage
+}
+
+// isTiledWatermark reports whether wm repeats over its area.
+func isTiledWatermark(wm config.Watermark) bool {
+	return strings.ToLower(strings.TrimSpace(wm.Mode)) == config.WatermarkModeTile
+}
+
+// watermarkImage returns the watermark image scaled to wm.Width of area and
+// tinted, or nil when it scales to nothing.
+func watermarkImage(wm config.Watermark, area image.Rectangle, assetsPath string, assets *assetCache) (*image.NRGBA, error) {
+	logo, err := assets.image(config.AssetPath(assetsPath, wm.Image))
+	if err != nil {
+		return nil, fmt.Errorf("load watermark image: %w", err)
+	}
+	logoW := int(math.Round(wm.Width.Pixels(float64(area.Dx()))))
+	if logoW <= 0 {
+		return nil, nil
+	}
+	scaled := imaging.Resize(logo, logoW, 0, imaging.Lanczos)
+	if wm.Tint != "" {
+		c, _ := parseHexColor(wm.Tint)
+		tintImage(scaled, c)
+	}
+	return scaled, nil
+}
+
+// drawImageWatermark draws the watermark image scaled to wm.Width, tinted and
+// faded to wm.Opacity, placed in area like text.
+func drawImageWatermark(dc *gg.Context, wm config.Watermark, area image.Rectangle, assetsPath string, assets *assetCache) error {
+	scaled, err := watermarkImage(wm, area, assetsPath, assets)
+	if err != nil || scaled == nil {
+		return err
+	}
+	dst, ok := dc.Image().(*image.RGBA)
+	if !ok {
+		return nil
+	}
+	b := scaled.Bounds()
+	x, y, ax, ay := anchorInArea(area, wm)
+	at := image.Pt(int(math.Round(x-ax*float64(b.Dx()))), int(math.Round(y-ay*float64(b.Dy()))))
+	mask := image.NewUniform(color.Alpha{A: roundByte(255 * wm.Opacity)})
+	draw.DrawMask(dst, b.Add(at), scaled, b.Min, mask, image.Point{}, draw.Over)
+	return nil
+}
+
+// tintImage replaces the color of every pixel of img with c, keeping the
+// pixel alpha.
+func tintImage(img *image.NRGBA, c color.NRGBA) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = c.R, c.G, c.B
+	}
+}
+
+// textBounds returns the box of text drawn with DrawStringAnchored at x, y,
+// from the top of the font height to the baseline.
+func textBounds(dc *gg.Context, text string, x, y, ax, ay float64) image.Rectangle {
+	w, h := dc.MeasureString(text)
+	left, baseline := x-ax*w, y+ay*h
+	return image.Rect(int(math.Floor(left)), int(math.Floor(baseline-h)), int(math.Ceil(left+w)), int(math.Ceil(baseline)))
+}
+
+// contrastWatermark resolves color = "auto" and auto_outline of a text
+// watermark against the average color of the pixels under it, in r. Auto
+// picks the light or dark color with the most contrast at the watermark
+// opacity; auto_outline outlines the text, in outline_color or the other of
+// the two colors, when the contrast stays under config.MinWatermarkContrast.
+func contrastWatermark(dc *gg.Context, wm config.Watermark, r image.Rectangle) config.Watermark {
+	auto := strings.EqualFold(strings.TrimSpace(wm.Color), config.WatermarkColorAuto)
+	r = r.Intersect(dc.Image().Bounds())
+	if (!auto && !wm.AutoOutline) || r.Empty() {
+		if auto {
+			wm.Color = config.DefaultWatermarkLightColor
+		}
+		return wm
+	}
+
+	under := averageColor(imaging.Crop(dc.Image(), r))
+	light, dark := wm.LightColor, wm.DarkColor
+	if light == "" {
+		light = config.DefaultWatermarkLightColor
+	}
+	if dark == "" {
+		dark = config.DefaultWatermarkDarkColor
+	}
+	contrast := func(hex string) float64 {
+		c, err := parseHexColor(hex)
+		if err != nil {
+			c = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		}
+		return contrastRatio(mixColor(under, c, wm.Opacity), under)
+	}
+	if auto {
+		wm.Color = light
+		if contrast(dark) > contrast(light) {
+			wm.Color = dark
+		}
+	}
+	if wm.AutoOutline && !wm.Outline && contrast(wm.Color) < config.MinWatermarkContrast {
+		wm.Outline = true
+		if wm.OutlineColor == "" {
+			wm.OutlineColor = dark
+			if wm.Color == dark {
+				wm.OutlineColor = light
+			}
+		}
+	}
+	return wm
+}
+
+// mixColor returns c drawn over base at the given opacity.
+func mixColor(base, c color.NRGBA, opacity float64) color.NRGBA {
+	mix := func(b, v uint8) uint8 {
+		return roundByte(float64(b)*(1-opacity) + float64(v)*opacity)
+	}
+	return color.NRGBA{R: mix(base.R, c.R), G: mix(base.G, c.G), B: mix(base.B, c.B), A: 255}
+}
+
+// contrastRatio returns the WCAG contrast ratio of two colors, 1..21.
+func contrastRatio(a, b color.NRGBA) float64 {
+	la, lb := relativeLuminance(a), relativeLuminance(b)
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+// relativeLuminance returns the WCAG relative luminance of c, 0..1.
+func relativeLuminance(c color.NRGBA) float64 {
+	return 0.2126*srgbToLinear(float64(c.R)/255) + 0.7152*srgbToLinear(float64(c.G)/255) + 0.0722*srgbToLinear(float64(c.B)/255)
+}
+
+// drawTiledWatermark repeats the watermark over area in staggered rows,
+// rotated by wm.Angle and faded to wm.Opacity. The watermark is drawn once
+// into a stamp that is copied across a pattern, and the pattern is rotated
+// and composited in one pass.
+func drawTiledWatermark(dc *gg.Context, text string, wm config.Watermark, area image.Rectangle, assetsPath string, assets *assetCache) error {
+	area = area.Intersect(dc.Image().Bounds())
+	dst, ok := dc.Image().(*image.RGBA)
+	if !ok || area.Empty() {
+		return nil
+	}
+	stamp, gap, err := watermarkStamp(dc, text, wm, area, assetsPath, assets)
+	if err != nil || stamp == nil {
+		return err
+	}
+	if wm.Spacing.Value > 0 {
+		gap = wm.Spacing.Pixels(float64(area.Dx()))
+	}
+
+	// A square of the area diagonal covers the area at any angle.
+	side := int(math.Ceil(math.Hypot(float64(area.Dx()), float64(area.Dy()))))
+	sb := stamp.Bounds()
+	cellW := sb.Dx() + int(math.Round(gap))
+	cellH := sb.Dy() + int(math.Round(gap))
+	pattern := image.NewNRGBA(image.Rect(0, 0, side, side))
+	for row, y := 0, 0; y < side; row, y = row+1, y+cellH {
+		x := 0
+		if row%2 == 1 {
+			x = -cellW / 2
+		}
+		for ; x < side; x += cellW {
+			draw.Draw(pattern, sb.Add(image.Pt(x, y)), stamp, sb.Min, draw.Over)
+		}
+	}
+	rotated := imaging.Rotate(pattern, wm.Angle, color.Transparent)
+
+	rb := rotated.Bounds()
+	at := image.Pt(area.Min.X+(area.Dx()-rb.Dx())/2, area.Min.Y+(area.Dy()-rb.Dy())/2)
+	mask := image.NewUniform(color.Alpha{A: roundByte(255 * wm.Opacity)})
+	draw.DrawMask(dst, area, rotated, area.Min.Sub(at), mask, image.Point{}, draw.Over)
+	return nil
+}
+
+// watermarkStamp returns one opaque copy of the watermark, text or image, on
+// a transparent background, with the default gap between tiled copies.
+func watermarkStamp(dc *gg.Context, text string, wm config.Watermark, area image.Rectangle, assetsPath string, assets *assetCache) (image.Image, float64, error) {
+	if isImageWatermark(wm) {
+		img, err := watermarkImage(wm, area, assetsPath, assets)
+		if err != nil || img == nil {
+			return nil, 0, err
+		}
+		return img, float64(img.Bounds().Dy()), nil
+	}
+
+	wm = contrastWatermark(dc, wm, area)
+	wm.Opacity = 1
+	size := wm.Size.Pixels(float64(area.Dx()))
+	outline := 0.0
+	if wm.Outline {
+		outline = wm.OutlineWidth
+		if outline == 0 {
+			outline = 2
+		}
+	}
+	face, err := watermarkFont(wm, area, assetsPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	dc.SetFontFace(face)
+	w, h := dc.MeasureString(text)
+	// Leave room below the baseline for descenders.
+	stampW := int(math.Ceil(w + 2*outline))
+	stampH := int(math.Ceil(h*1.5 + 2*outline))
+	if stampW <= 0 || stampH <= 0 {
+		return nil, 0, nil
+	}
+	sc := gg.NewContext(stampW, stampH)
+	sc.SetFontFace(face)
+	drawWatermarkText(sc, text, wm, float64(stampW)/2, float64(stampH)/2, 0.5, 0.5)
+	return sc.Image(), size, nil
+}
@@ -0,0 +1,261 @@
+package instafix
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aeperfilev/instafix/config"
+
+	"github.com/fogleman/gg"
+)
+
+func TestProcess_ImageWatermark(t *testing.T) {
+	dir := t.TempDir()
+	writeTestLogo(t, dir)
+
+	cfg := config.Config{
+		Settings:    config.Settings{JpegQuality: 90, AssetsPath: dir},
+		Backgrounds: map[string]config.Background{"white": {Type: "solid", Color: "#ffffff"}},
+		Formats:     map[string]config.Format{"square": {Type: "fixed", Width: 100, Height: 100}},
+		Watermarks: map[string]config.Watermark{
+			// 20% of 100px: a 20x20 logo 10px from the top-right corner.
+			"logo": {Kind: "image", Image: "logo.png", Width: config.Length{Value: 20, Percent: true}, Opacity: 0.5, Tint: "#ff0000", Align: "top-right", OffsetX: config.Length{Value: 10}, OffsetY: config.Length{Value: 10}},
+		},
+		Profiles: map[string]config.Profile{
+			"logo": {BackgroundRef: "white", FormatRef: "square", WatermarkRef: "logo"},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+
+	src := solidImage(100, 100, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	out, _, err := processor.Process(src, "logo", "")
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	// Half-opaque red over white on the opaque half, white elsewhere.
+	if c := colorToNRGBA(out.At(75, 20)); c.R != 255 || absDiff(c.G, 128) > 2 || absDiff(c.B, 128) > 2 {
+		t.Fatalf("logo = %v, want half-opaque red", c)
+	}
+	for _, p := range []image.Point{{85, 20}, {65, 20}, {75, 5}, {75, 35}} {
+		if c := colorToNRGBA(out.At(p.X, p.Y)); c.G < 250 {
+			t.Fatalf("pixel %v = %v, want white outside the logo", p, c)
+		}
+	}
+
+	_, _, err = processor.Process(src, "logo", "@jane")
+	var userErr UserError
+	if !errors.As(err, &userErr) {
+		t.Fatalf("expected UserError for text on an image watermark, got %v", err)
+	}
+}
+
+func TestContrastWatermark(t *testing.T) {
+	// Black on the left half, white on the right one.
+	dc := gg.NewContext(200, 100)
+	dc.SetRGB(1, 1, 1)
+	dc.Clear()
+	dc.SetRGB(0, 0, 0)
+	dc.DrawRectangle(0, 0, 100, 100)
+	dc.Fill()
+	overBlack, overWhite := image.Rect(10, 40, 90, 60), image.Rect(110, 40, 190, 60)
+
+	tests := []struct {
+		name        string
+		wm          config.Watermark
+		r           image.Rectangle
+		wantColor   string
+		wantOutline string
+	}{
+		{name: "auto over black", wm: config.Watermark{Color: "auto", Opacity: 1}, r: overBlack, wantColor: "#ffffff"},
+		{name: "auto over white", wm: config.Watermark{Color: "Auto", Opacity: 1}, r: overWhite, wantColor: "#000000"},
+		{name: "configured colors", wm: config.Watermark{Color: "auto", LightColor: "#f0f0f0", DarkColor: "#2c2c2c", Opacity: 0.8}, r: overWhite, wantColor: "#2c2c2c"},
+		{name: "fixed color", wm: config.Watermark{Color: "#ffffff", Opacity: 1}, r: overWhite, wantColor: "#ffffff"},
+		{name: "auto outline on low contrast", wm: config.Watermark{Color: "#f0f0f0", Opacity: 1, AutoOutline: true}, r: overWhite, wantColor: "#f0f0f0", wantOutline: "#000000"},
+		{name: "auto outline on faint auto color", wm: config.Watermark{Color: "auto", Opacity: 0.2, AutoOutline: true, OutlineColor: "#333333"}, r: overBlack, wantColor: "#ffffff", wantOutline: "#333333"},
+		{name: "no outline on high contrast", wm: config.Watermark{Color: "#f0f0f0", Opacity: 1, AutoOutline: true}, r: overBlack, wantColor: "#f0f0f0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contrastWatermark(dc, tt.wm, tt.r)
+			if got.Color != tt.wantColor {
+				t.Fatalf("color = %s, want %s", got.Color, tt.wantColor)
+			}
+			if tt.wantOutline == "" {
+				if got.Outline {
+					t.Fatalf("unexpected outline %s", got.OutlineColor)
+				}
+				return
+			}
+			if !got.Outline || got.OutlineColor != tt.wantOutline {
+				t.Fatalf("outline = %v %s, want %s", got.Outline, got.OutlineColor, tt.wantOutline)
+			}
+		})
+	}
+}
+
+func TestWatermarkAreas(t *testing.T) {
+	canvas := image.Rect(0, 0, 100, 200)
+	photo := image.Rect(10, 10, 90, 110)
+	areas := newWatermarkAreas(canvas, photo, 2, 20)
+	tests := []struct {
+		anchor string
+		want   image.Rectangle
+	}{
+		{anchor: "", want: canvas},
+		{anchor: config.AnchorCanvas, want: canvas},
+		{anchor: config.AnchorPhoto, want: photo},
+		{anchor: "Padding", want: image.Rect(0, 112, 100, 180)},
+	}
+	for _, tt := range tests {
+		if got := areas.area(tt.anchor); got != tt.want {
+			t.Fatalf("area(%q) = %v, want %v", tt.anchor, got, tt.want)
+		}
+	}
+	// A photo filling the canvas leaves no padding area.
+	full := newWatermarkAreas(canvas, canvas, 0, 0)
+	if got := full.area(config.AnchorPadding); got != canvas {
+		t.Fatalf("area(padding) without margin = %v, want the canvas", got)
+	}
+}
+
+func TestProcess_WatermarkScalesWithCanvas(t *testing.T) {
+	dir := t.TempDir()
+	writeTestLogo(t, dir)
+	padding := 25.0
+	cfg := config.Config{
+		Settings:    config.Settings{JpegQuality: 90, AssetsPath: dir},
+		Backgrounds: map[string]config.Background{"white": {Type: "solid", Color: "#ffffff"}},
+		Formats: map[string]config.Format{
+			"small": {Type: "fixed", Width: 100, Height: 100},
+			"large": {Type: "fixed", Width: 400, Height: 400},
+		},
+		Watermarks: map[string]config.Watermark{
+			// 20% of the margin below the photo, centered in it.
+			"mat": {Kind: "image", Image: "logo.png", Width: config.Length{Value: 20, Percent: true}, Opacity: 1, Align: "center", Anchor: "padding"},
+		},
+		Profiles: map[string]config.Profile{
+			"small": {BackgroundRef: "white", FormatRef: "small", WatermarkRef: "mat", PaddingPercent: &padding},
+			"large": {BackgroundRef: "white", FormatRef: "large", WatermarkRef: "mat", PaddingPercent: &padding},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+	src := solidImage(400, 400, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	for _, tt := range []struct {
+		profile string
+		size    int
+	}{{"small", 100}, {"large", 400}} {
+		out, _, err := processor.Process(src, tt.profile, "")
+		if err != nil {
+			t.Fatalf("Process(%s): %v", tt.profile, err)
+		}
+		// The margin spans 75%..100% of the height; the logo is 20% of the
+		// width, centered in the margin, with its opaque left half dark.
+		var dark image.Rectangle
+		b := out.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := colorToNRGBA(out.At(x, y)); c.R < 128 {
+					dark = dark.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+		s := float64(tt.size)
+		want := image.Rect(int(0.4*s), int(0.775*s), int(0.5*s), int(0.975*s))
+		near := func(a, b int) bool { return a-b >= -1 && a-b <= 1 }
+		if !near(dark.Min.X, want.Min.X) || !near(dark.Min.Y, want.Min.Y) || !near(dark.Max.X, want.Max.X) || !near(dark.Max.Y, want.Max.Y) {
+			t.Fatalf("%s: logo at %v, want %v", tt.profile, dark, want)
+		}
+	}
+}
+
+func TestProcess_TiledWatermark(t *testing.T) {
+	dir := t.TempDir()
+	writeTestLogo(t, dir)
+	padding := 20.0
+	tile := config.Watermark{Kind: "image", Image: "logo.png", Width: config.Length{Value: 10}, Opacity: 1, Mode: "tile", Spacing: config.Length{Value: 10}}
+	rotated := tile
+	rotated.Angle = 45
+	photo := tile
+	photo.Anchor = "photo"
+	cfg := config.Config{
+		Settings:    config.Settings{JpegQuality: 90, AssetsPath: dir},
+		Backgrounds: map[string]config.Background{"white": {Type: "solid", Color: "#ffffff"}},
+		Formats:     map[string]config.Format{"square": {Type: "fixed", Width: 100, Height: 100}},
+		Watermarks:  map[string]config.Watermark{"tile": tile, "rotated": rotated, "photo": photo},
+		Profiles: map[string]config.Profile{
+			"tile":    {BackgroundRef: "white", FormatRef: "square", WatermarkRef: "tile", PaddingPercent: &padding},
+			"rotated": {BackgroundRef: "white", FormatRef: "square", WatermarkRef: "rotated", PaddingPercent: &padding},
+			"photo":   {BackgroundRef: "white", FormatRef: "square", WatermarkRef: "photo", PaddingPercent: &padding},
+		},
+	}
+	processor, err := NewProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewProcessor: %v", err)
+	}
+	src := solidImage(400, 400, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	darkIn := func(img image.Image, r image.Rectangle) int {
+		n := 0
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if colorToNRGBA(img.At(x, y)).R < 128 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	for _, profile := range []string{"tile", "rotated"} {
+		out, _, err := processor.Process(src, profile, "")
+		if err != nil {
+			t.Fatalf("Process(%s): %v", profile, err)
+		}
+		// The 5x10 opaque half of the logo repeats every 20x20 pixels.
+		for y := 0; y < 100; y += 25 {
+			for x := 0; x < 100; x += 25 {
+				if darkIn(out, image.Rect(x, y, x+25, y+25)) == 0 {
+					t.Fatalf("%s: no watermark in the cell at %d,%d", profile, x, y)
+				}
+			}
+		}
+		if share := float64(darkIn(out, out.Bounds())) / 10000; share < 0.08 || share > 0.18 {
+			t.Fatalf("%s: watermark covers %.2f of the canvas, want about 0.125", profile, share)
+		}
+	}
+
+	out, _, err := processor.Process(src, "photo", "")
+	if err != nil {
+		t.Fatalf("Process(photo): %v", err)
+	}
+	inside := image.Rect(20, 20, 80, 80)
+	if darkIn(out, inside) == 0 || darkIn(out, out.Bounds()) != darkIn(out, inside) {
+		t.Fatal("photo-anchored tiles should cover the photo only")
+	}
+}
+
+// writeTestLogo writes logo.png to dir: a black 10x10 logo with a transparent
+// right half.
+func writeTestLogo(t *testing.T, dir string) {
+	t.Helper()
+	logo := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	fillRect(logo, image.Rect(0, 0, 5, 10), color.NRGBA{A: 255})
+	f, err := os.Create(filepath.Join(dir, "logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, logo); err != nil {
+		t.Fatal(err)
+	}
+}